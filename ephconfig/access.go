@@ -0,0 +1,46 @@
+package ephconfig
+
+import "fmt"
+
+// Annotations on the env ConfigMap that control who can reach the env's endpoints.
+//
+// Like actions, these live outside the ConfigMap data, so that
+// changing them doesn't restart the env.
+const (
+	AnnotationVisibility = "ephemerator.tilt.dev/visibility"
+
+	// Share tokens are only valid for the current share ID.
+	// Changing the ID revokes all the tokens minted so far.
+	AnnotationShareID = "ephemerator.tilt.dev/share-id"
+)
+
+// Who can reach an env's endpoints.
+type Visibility string
+
+const (
+	// Only the owner of the env.
+	VisibilityPrivate Visibility = "private"
+
+	// Any signed-in user.
+	VisibilityTeam Visibility = "team"
+
+	// Any signed-in user, and anyone with a share link.
+	VisibilityPublic Visibility = "public"
+)
+
+const DefaultVisibility = VisibilityTeam
+
+var Visibilities = []Visibility{VisibilityPrivate, VisibilityTeam, VisibilityPublic}
+
+// Parses the visibility annotation, falling back to the default.
+func ParseVisibility(value string) (Visibility, error) {
+	if value == "" {
+		return DefaultVisibility, nil
+	}
+	for _, v := range Visibilities {
+		if string(v) == value {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("Forbidden: unrecognized visibility: %s", value)
+}
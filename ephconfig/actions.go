@@ -0,0 +1,110 @@
+package ephconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Annotations on the env ConfigMap used to pass actions from ephdash to ephctrl.
+//
+// We deliberately keep these out of the ConfigMap data, because any change
+// to the data restarts the env.
+const (
+	AnnotationActionRequest = "ephemerator.tilt.dev/action-request"
+	AnnotationActionStatus  = "ephemerator.tilt.dev/action-status"
+)
+
+// Annotation on the env Service listing the Tilt resources in the env,
+// so that the dashboard can offer actions on them.
+const AnnotationResources = "ephemerator.tilt.dev/resources"
+
+// Format of each entry in the resources annotation.
+type ResourceInfo struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// An operation that a user can run against the Tilt instance in their env.
+type Action string
+
+const (
+	ActionTrigger Action = "trigger"
+	ActionEnable  Action = "enable"
+	ActionDisable Action = "disable"
+	ActionRestart Action = "restart"
+)
+
+// Actions that target a single Tilt resource.
+var resourceActions = map[Action]bool{
+	ActionTrigger: true,
+	ActionEnable:  true,
+	ActionDisable: true,
+}
+
+// Format of the action-request annotation.
+type ActionRequest struct {
+	// A unique ID, so that ephctrl can tell whether it has already
+	// run this request.
+	ID string `json:"id"`
+
+	Action   Action `json:"action"`
+	Resource string `json:"resource,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+// Format of the action-status annotation.
+type ActionStatus struct {
+	// The ID of the request this status applies to.
+	ID string `json:"id"`
+
+	Action   Action `json:"action"`
+	Resource string `json:"resource,omitempty"`
+	Time     string `json:"time"`
+	Error    string `json:"error,omitempty"`
+
+	// Set while the action runs. ephctrl records it before running the action,
+	// so that it never runs the same request twice.
+	Running bool `json:"running,omitempty"`
+}
+
+var resourceRe = regexp.MustCompile(`^[a-zA-Z0-9(][a-zA-Z_0-9.:()-]*$`)
+
+// Validate the action request for anything that looks suspicious:
+// - The action must be one we know how to run.
+// - The resource name must look like a Tilt resource name.
+func IsActionAllowed(req ActionRequest) error {
+	if req.ID == "" {
+		return fmt.Errorf("Forbidden: missing action id")
+	}
+
+	if req.Action == ActionRestart {
+		if req.Resource != "" {
+			return fmt.Errorf("Forbidden: restart does not take a resource")
+		}
+		return nil
+	}
+
+	if !resourceActions[req.Action] {
+		return fmt.Errorf("Forbidden: unrecognized action: %s", req.Action)
+	}
+
+	if !resourceRe.MatchString(req.Resource) {
+		return fmt.Errorf("Forbidden: malformed resource name")
+	}
+	return nil
+}
+
+// Parse an annotation value into the given struct.
+//
+// Returns false if the annotation is missing.
+func ParseAnnotation(value string, v interface{}) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	err := json.Unmarshal([]byte(value), v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
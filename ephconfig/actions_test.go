@@ -0,0 +1,40 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type actionAllowedCase struct {
+	req ActionRequest
+	msg string
+}
+
+func TestActionAllowed(t *testing.T) {
+	cases := []actionAllowedCase{
+		{req: ActionRequest{ID: "1", Action: ActionTrigger, Resource: "frontend"}, msg: ""},
+		{req: ActionRequest{ID: "1", Action: ActionDisable, Resource: "(Tiltfile)"}, msg: ""},
+		{req: ActionRequest{ID: "1", Action: ActionRestart}, msg: ""},
+		{req: ActionRequest{Action: ActionTrigger, Resource: "frontend"}, msg: "missing action id"},
+		{req: ActionRequest{ID: "1", Action: "delete", Resource: "frontend"}, msg: "unrecognized action"},
+		{req: ActionRequest{ID: "1", Action: ActionEnable, Resource: "--all"}, msg: "malformed resource name"},
+		{req: ActionRequest{ID: "1", Action: ActionEnable, Resource: ""}, msg: "malformed resource name"},
+		{req: ActionRequest{ID: "1", Action: ActionRestart, Resource: "frontend"}, msg: "restart does not take a resource"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestActionAllowed%d", i), func(t *testing.T) {
+			err := IsActionAllowed(c.req)
+			if c.msg == "" {
+				assert.NoError(t, err)
+			} else {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package ephconfig
+
+// Annotation on the env ConfigMap with the last time the ephgateway proxy
+// served a request for the env, in RFC3339 format.
+//
+// The proxy only updates it periodically, so it may lag behind
+// the most recent request by a minute or so.
+const AnnotationLastActivity = "ephemerator.tilt.dev/last-activity"
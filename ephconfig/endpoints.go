@@ -0,0 +1,42 @@
+package ephconfig
+
+// Annotation on the env Service listing the Tilt endpoint links,
+// so that the dashboard can link to them with their own names and paths.
+//
+// Several links may share a Service port.
+const AnnotationEndpoints = "ephemerator.tilt.dev/endpoints"
+
+// Format of each entry in the endpoints annotation.
+type EndpointInfo struct {
+	// The name of the Service port that serves the link.
+	PortName string `json:"portName"`
+
+	// The Tilt resource that the link belongs to.
+	Resource string `json:"resource"`
+
+	// The display label of the link in Tilt, if any.
+	Name string `json:"name,omitempty"`
+
+	// The path, query and fragment of the link, if any, e.g., "/admin?debug=1".
+	Path string `json:"path,omitempty"`
+}
+
+// Returns true if a Service port serves HTTP, so that the gateway
+// can route to it by host name.
+//
+// ephctrl sets the app protocol of every port that serves anything else,
+// e.g., "postgres" or "udp". Those ports are only reachable through a tunnel.
+func IsHTTPPort(protocol string, appProtocol *string) bool {
+	if protocol != "" && protocol != "TCP" {
+		return false
+	}
+	return appProtocol == nil || *appProtocol == "http" || *appProtocol == "https"
+}
+
+// Returns true if a Service port serves HTTPS.
+//
+// Only the ephgateway proxy connects to the env over TLS. The Ingress and
+// HTTPRoute backends route plain HTTP, so they leave these ports out.
+func IsHTTPSPort(protocol string, appProtocol *string) bool {
+	return IsHTTPPort(protocol, appProtocol) && appProtocol != nil && *appProtocol == "https"
+}
@@ -0,0 +1,28 @@
+package ephconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsHTTPPort(t *testing.T) {
+	https := "https"
+	postgres := "postgres"
+	udp := "udp"
+	assert.True(t, IsHTTPPort("TCP", nil))
+	assert.True(t, IsHTTPPort("", nil))
+	assert.True(t, IsHTTPPort("TCP", &https))
+	assert.False(t, IsHTTPPort("TCP", &postgres))
+	assert.False(t, IsHTTPPort("UDP", &udp))
+	assert.False(t, IsHTTPPort("UDP", nil))
+}
+
+func TestIsHTTPSPort(t *testing.T) {
+	https := "https"
+	http := "http"
+	assert.True(t, IsHTTPSPort("TCP", &https))
+	assert.False(t, IsHTTPSPort("UDP", &https))
+	assert.False(t, IsHTTPSPort("TCP", &http))
+	assert.False(t, IsHTTPSPort("TCP", nil))
+}
@@ -0,0 +1,103 @@
+package ephconfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Why a field of an env spec isn't allowed.
+type Reason string
+
+const (
+	// The value doesn't look like a repo, branch, path, etc.
+	ReasonMalformed Reason = "Malformed"
+
+	// The allowlist, or the user's group, doesn't allow the value.
+	ReasonNotAllowed Reason = "NotAllowed"
+
+	// The allowlist doesn't know the size or param.
+	ReasonUnknown Reason = "Unknown"
+
+	// The value doesn't match the param's type, enum or pattern.
+	ReasonInvalid Reason = "Invalid"
+
+	// The field needs a value.
+	ReasonRequired Reason = "Required"
+)
+
+// A problem with one field of an env spec.
+//
+// The field is the name of the form field, e.g., "branch" or "arg.profile".
+type FieldError struct {
+	Field   string `json:"field"`
+	Reason  Reason `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("Forbidden: %s", e.Message)
+}
+
+func forbidden(field string, reason Reason, format string, args ...interface{}) *FieldError {
+	return &FieldError{Field: field, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// All the problems with an env spec.
+type FieldErrors []*FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Message)
+	}
+	return fmt.Sprintf("Forbidden: %s", strings.Join(msgs, "; "))
+}
+
+// Adds the field errors in err, if any.
+func (e *FieldErrors) add(err error) {
+	if err == nil {
+		return
+	}
+	list := AsFieldErrors(err)
+	if list == nil {
+		list = FieldErrors{{Reason: ReasonNotAllowed, Message: strings.TrimPrefix(err.Error(), "Forbidden: ")}}
+	}
+	*e = append(*e, list...)
+}
+
+// Returns nil if there are no errors.
+func (e FieldErrors) toError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Finds the field errors in an error from IsAllowed or IsAllowedForGroup.
+//
+// Returns nil if err isn't about fields of the spec.
+func AsFieldErrors(err error) FieldErrors {
+	var list FieldErrors
+	if errors.As(err, &list) {
+		return list
+	}
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		return FieldErrors{fe}
+	}
+	return nil
+}
+
+// The message for each field, for highlighting fields on a form.
+//
+// If a field has several errors, the first wins.
+func (e FieldErrors) ByField() map[string]string {
+	result := map[string]string{}
+	for _, fe := range e {
+		if _, ok := result[fe.Field]; !ok {
+			result[fe.Field] = fe.Message
+		}
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+package ephconfig
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotation on the env ConfigMap with the name of the group policy
+// that the env was created under.
+//
+// ephdash sets it, because only ephdash knows the user's groups.
+// ephctrl reads it to enforce the same policy when it creates the pod.
+const AnnotationGroup = "ephemerator.tilt.dev/group"
+
+// A size that users can pick for their env, setting the resource
+// requests of the env's Docker-in-Docker container.
+type SizeClass struct {
+	Name string `json:"name" yaml:"name"`
+
+	// CPU and memory requests, as Kubernetes quantities (e.g., "2" or "4Gi").
+	// Empty means no request.
+	CPU    string `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+}
+
+// What members of a group may create.
+type GroupPolicy struct {
+	// The group name, as reported by the oauth2-proxy.
+	Name string `json:"name" yaml:"name"`
+
+	// Repo names that members may create envs for, as patterns like the
+	// names in repo rules. Empty means all the repos the allowlist allows.
+	RepoNames []string `json:"repoNames,omitempty" yaml:"repoNames,omitempty"`
+
+	// Sizes that members may pick. Empty means all of them.
+	Sizes []string `json:"sizes,omitempty" yaml:"sizes,omitempty"`
+
+	// How long envs live before they expire (e.g., "2h").
+	// Empty means the ephctrl default.
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// How many envs the members of the group may run at once.
+	// Zero means no limit.
+	MaxEnvs int `json:"maxEnvs,omitempty" yaml:"maxEnvs,omitempty"`
+}
+
+// How long envs live before they expire, or zero for the default.
+func (p *GroupPolicy) TTLDuration() time.Duration {
+	if p == nil || p.TTL == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(p.TTL)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Check that the sizes and groups are well-formed.
+func (a *Allowlist) validateGroups() error {
+	sizes := map[string]bool{}
+	for _, s := range a.Sizes {
+		if s.Name == "" {
+			return fmt.Errorf("sizes: missing name")
+		}
+		if sizes[s.Name] {
+			return fmt.Errorf("sizes: duplicate size %s", s.Name)
+		}
+		sizes[s.Name] = true
+		for _, q := range []string{s.CPU, s.Memory} {
+			if q == "" {
+				continue
+			}
+			_, err := resource.ParseQuantity(q)
+			if err != nil {
+				return fmt.Errorf("sizes: invalid quantity for %s: %q", s.Name, q)
+			}
+		}
+	}
+
+	groups := map[string]bool{}
+	for _, g := range a.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("groups: missing name")
+		}
+		if groups[g.Name] {
+			return fmt.Errorf("groups: duplicate group %s", g.Name)
+		}
+		groups[g.Name] = true
+		for _, r := range g.RepoNames {
+			err := validatePattern(r)
+			if err != nil {
+				return fmt.Errorf("groups: invalid repo pattern for %s: %q: %v", g.Name, r, err)
+			}
+			if isLiteralPattern(r) && !a.allowsRepoName(r) {
+				return fmt.Errorf("groups: %s allows repo %s, which no repo rule allows", g.Name, r)
+			}
+		}
+		for _, s := range g.Sizes {
+			if !sizes[s] {
+				return fmt.Errorf("groups: %s allows size %s, which is not in sizes", g.Name, s)
+			}
+		}
+		if g.TTL != "" {
+			d, err := time.ParseDuration(g.TTL)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("groups: invalid ttl for %s: %q", g.Name, g.TTL)
+			}
+		}
+		if g.MaxEnvs < 0 {
+			return fmt.Errorf("groups: invalid maxEnvs for %s: %d", g.Name, g.MaxEnvs)
+		}
+	}
+	return nil
+}
+
+// Looks up a size by name.
+//
+// An empty name means the first size, or no size at all
+// if the allowlist doesn't have any.
+func (a *Allowlist) Size(name string) (*SizeClass, error) {
+	if name == "" {
+		if len(a.Sizes) == 0 {
+			return nil, nil
+		}
+		return &a.Sizes[0], nil
+	}
+	for i, s := range a.Sizes {
+		if s.Name == name {
+			return &a.Sizes[i], nil
+		}
+	}
+	return nil, forbidden("size", ReasonUnknown, "unrecognized size: %s", name)
+}
+
+// Finds the policy for a user in the given groups.
+//
+// If the user is in several groups, they get the policy that's listed first.
+// If the allowlist has no groups, everyone may create envs and the policy is nil.
+func (a *Allowlist) PolicyFor(groups []string) (*GroupPolicy, error) {
+	if len(a.Groups) == 0 {
+		return nil, nil
+	}
+	for i, g := range a.Groups {
+		if contains(groups, g.Name) {
+			return &a.Groups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Forbidden: not a member of any group that may create envs")
+}
+
+// Looks up the policy recorded on an env.
+//
+// If the allowlist has no groups, the policy is nil. If it has groups,
+// every env needs one, so that no env gets around the groups' limits.
+func (a *Allowlist) Policy(name string) (*GroupPolicy, error) {
+	if len(a.Groups) == 0 {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Forbidden: env has no group")
+	}
+	for i, g := range a.Groups {
+		if g.Name == name {
+			return &a.Groups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Forbidden: unrecognized group: %q", name)
+}
+
+// Validate the environment spec against the allowlist, then against
+// the group policy, if there is one.
+func IsAllowedForGroup(allowlist *Allowlist, policy *GroupPolicy, spec EnvSpec) error {
+	err := IsAllowed(allowlist, spec)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	if !policy.AllowsRepo(spec.Repo) {
+		return forbidden("repo", ReasonNotAllowed, "group %s may not create envs for repo: %s", policy.Name, spec.Repo)
+	}
+
+	size, err := allowlist.Size(spec.Size)
+	if err != nil {
+		return err
+	}
+	if size != nil && len(policy.Sizes) > 0 && !contains(policy.Sizes, size.Name) {
+		return forbidden("size", ReasonNotAllowed, "group %s may not create envs of size: %s", policy.Name, size.Name)
+	}
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var groupAllowlist = &Allowlist{
+	RepoBase:  "tilt-dev",
+	RepoNames: []string{"tilt-avatars", "tilt-example-html"},
+	Sizes: []SizeClass{
+		{Name: "small", CPU: "1", Memory: "2Gi"},
+		{Name: "large", CPU: "4", Memory: "8Gi"},
+	},
+	Groups: []GroupPolicy{
+		{Name: "eng", TTL: "4h", MaxEnvs: 10},
+		{Name: "design", RepoNames: []string{"tilt-avatars"}, Sizes: []string{"small"}, MaxEnvs: 2},
+	},
+}
+
+func TestPolicyFor(t *testing.T) {
+	p, err := groupAllowlist.PolicyFor([]string{"design", "eng"})
+	require.NoError(t, err)
+	assert.Equal(t, "eng", p.Name)
+	assert.Equal(t, 4*time.Hour, p.TTLDuration())
+
+	p, err = groupAllowlist.PolicyFor([]string{"design"})
+	require.NoError(t, err)
+	assert.Equal(t, "design", p.Name)
+	assert.Equal(t, time.Duration(0), p.TTLDuration())
+
+	_, err = groupAllowlist.PolicyFor([]string{"sales"})
+	assert.Error(t, err)
+
+	_, err = groupAllowlist.Policy("sales")
+	assert.Error(t, err)
+
+	// Once the allowlist has groups, every env needs one.
+	_, err = groupAllowlist.Policy("")
+	assert.Error(t, err)
+
+	// Without groups, everyone gets a nil policy.
+	p, err = allowlist.PolicyFor(nil)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestAllowedForGroup(t *testing.T) {
+	design, err := groupAllowlist.Policy("design")
+	require.NoError(t, err)
+
+	cases := []struct {
+		spec EnvSpec
+		msg  string
+	}{
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile", Size: "small"}, msg: ""},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile", Size: "large"}, msg: "may not create envs of size"},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile", Size: "huge"}, msg: "unrecognized size"},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-example-html", Branch: "main", Path: "Tiltfile"}, msg: "may not create envs for repo"},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars2", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized repo name"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestAllowedForGroup%d", i), func(t *testing.T) {
+			err := IsAllowedForGroup(groupAllowlist, design, c.spec)
+			if c.msg == "" {
+				assert.NoError(t, err)
+			} else {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.msg)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupsValidate(t *testing.T) {
+	require.NoError(t, groupAllowlist.Validate())
+
+	cases := []struct {
+		sizes  []SizeClass
+		groups []GroupPolicy
+		msg    string
+	}{
+		{sizes: []SizeClass{{CPU: "1"}}, msg: "sizes: missing name"},
+		{sizes: []SizeClass{{Name: "small"}, {Name: "small"}}, msg: "duplicate size"},
+		{sizes: []SizeClass{{Name: "small", Memory: "lots"}}, msg: "invalid quantity"},
+		{groups: []GroupPolicy{{MaxEnvs: 1}}, msg: "groups: missing name"},
+		{groups: []GroupPolicy{{Name: "eng", RepoNames: []string{"tilt"}}}, msg: "which no repo rule allows"},
+		{groups: []GroupPolicy{{Name: "eng", Sizes: []string{"small"}}}, msg: "not in sizes"},
+		{groups: []GroupPolicy{{Name: "eng", TTL: "forever"}}, msg: "invalid ttl"},
+		{groups: []GroupPolicy{{Name: "eng", MaxEnvs: -1}}, msg: "invalid maxEnvs"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestGroupsValidate%d", i), func(t *testing.T) {
+			err := (&Allowlist{RepoNames: []string{"tilt-avatars"}, Sizes: c.sizes, Groups: c.groups}).Validate()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package ephconfig
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Separates the endpoint name from the env name in gateway hosts,
+// e.g., frontend---alice.preview.tilt.build
+const HostSeparator = "---"
+
+// The maximum length of a single DNS label.
+const maxDNSLabelLen = 63
+
+var endpointNameRe = regexp.MustCompile("^[a-z0-9]([a-z0-9-]*[a-z0-9])?$")
+var letterRe = regexp.MustCompile("[a-z]")
+
+// Endpoint names are Service port names. We use them as the first
+// part of a DNS label, so they can't contain the host separator.
+//
+// They must contain at least one letter, so that they
+// never look like a port number.
+func IsValidEndpointName(name string) bool {
+	return endpointNameRe.MatchString(name) &&
+		letterRe.MatchString(name) &&
+		!strings.Contains(name, "--")
+}
+
+// The host where the gateway serves the given endpoint of an env.
+func EndpointHost(endpoint, env, gatewayHost string) string {
+	return fmt.Sprintf("%s%s%s.%s", endpoint, HostSeparator, env, gatewayHost)
+}
+
+// All the hosts where the gateway serves a Service port of an env.
+//
+// The first host is the preferred, readable host derived from the port name.
+// The host derived from the port number is kept as an alias, and
+// is the only host if the port name can't be used.
+func PortHosts(portName string, port int32, env, gatewayHost string) []string {
+	hosts := []string{}
+	if IsValidEndpointName(portName) &&
+		len(portName)+len(HostSeparator)+len(env) <= maxDNSLabelLen {
+		hosts = append(hosts, EndpointHost(portName, env, gatewayHost))
+	}
+	return append(hosts, EndpointHost(fmt.Sprintf("%d", port), env, gatewayHost))
+}
+
+// Splits a host served by the gateway into the endpoint and env names.
+//
+// The endpoint is either a port name or a port number.
+// Returns false if the host is not an endpoint host.
+func ParseEndpointHost(host, gatewayHost string) (endpoint string, env string, ok bool) {
+	label := strings.TrimSuffix(host, "."+gatewayHost)
+	if label == host || label == "" || strings.Contains(label, ".") {
+		return "", "", false
+	}
+
+	i := strings.Index(label, HostSeparator)
+	if i <= 0 {
+		return "", "", false
+	}
+
+	endpoint = label[:i]
+	env = label[i+len(HostSeparator):]
+	if env == "" {
+		return "", "", false
+	}
+	return endpoint, env, true
+}
@@ -0,0 +1,49 @@
+package ephconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortHosts(t *testing.T) {
+	assert.Equal(t,
+		[]string{"frontend---alice.preview.tilt.build", "8000---alice.preview.tilt.build"},
+		PortHosts("frontend", 8000, "alice", "preview.tilt.build"))
+	assert.Equal(t,
+		[]string{"8000---alice.preview.tilt.build"},
+		PortHosts("front--end", 8000, "alice", "preview.tilt.build"))
+	assert.Equal(t,
+		[]string{"8000---alice.preview.tilt.build"},
+		PortHosts("8080", 8000, "alice", "preview.tilt.build"))
+}
+
+func TestIsValidEndpointName(t *testing.T) {
+	assert.True(t, IsValidEndpointName("frontend"))
+	assert.True(t, IsValidEndpointName("api-2"))
+	assert.False(t, IsValidEndpointName("Frontend"))
+	assert.False(t, IsValidEndpointName("-frontend"))
+	assert.False(t, IsValidEndpointName("front---end"))
+	assert.False(t, IsValidEndpointName("10350"))
+}
+
+func TestParseEndpointHost(t *testing.T) {
+	endpoint, env, ok := ParseEndpointHost("frontend---alice.preview.tilt.build", "preview.tilt.build")
+	assert.True(t, ok)
+	assert.Equal(t, "frontend", endpoint)
+	assert.Equal(t, "alice", env)
+
+	endpoint, env, ok = ParseEndpointHost("8000---alice.preview.tilt.build", "preview.tilt.build")
+	assert.True(t, ok)
+	assert.Equal(t, "8000", endpoint)
+	assert.Equal(t, "alice", env)
+
+	_, _, ok = ParseEndpointHost("preview.tilt.build", "preview.tilt.build")
+	assert.False(t, ok)
+	_, _, ok = ParseEndpointHost("alice.preview.tilt.build", "preview.tilt.build")
+	assert.False(t, ok)
+	_, _, ok = ParseEndpointHost("frontend---alice.example.com", "preview.tilt.build")
+	assert.False(t, ok)
+	_, _, ok = ParseEndpointHost("a.frontend---alice.preview.tilt.build", "preview.tilt.build")
+	assert.False(t, ok)
+}
@@ -3,6 +3,7 @@ package ephconfig
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,6 +19,11 @@ func ReadAllowlist() (*Allowlist, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Reading EPH_ALLOWLIST: %v", err)
 	}
+
+	err = allowlist.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Reading EPH_ALLOWLIST: %v", err)
+	}
 	return allowlist, nil
 }
 
@@ -28,3 +34,96 @@ func ReadGatewayHost() (string, error) {
 	}
 	return asString, nil
 }
+
+// Selects how ephctrl routes traffic from gateway hosts to envs.
+type GatewayBackend string
+
+const (
+	// Rewrite the rules of the shared ephgateway Ingress.
+	GatewayBackendIngress GatewayBackend = "ingress"
+
+	// Create an Ingress for each env, copying its settings from the ephgateway Ingress.
+	GatewayBackendIngressPerEnv GatewayBackend = "ingress-per-env"
+
+	// Create Gateway API HTTPRoutes attached to a Gateway.
+	GatewayBackendGatewayAPI GatewayBackend = "gateway-api"
+
+	// Leave routing to the ephgateway proxy, which watches env Services directly.
+	GatewayBackendProxy GatewayBackend = "proxy"
+)
+
+func ReadGatewayBackend() (GatewayBackend, error) {
+	asString := os.Getenv("EPH_GATEWAY_BACKEND")
+	switch GatewayBackend(asString) {
+	case "", GatewayBackendIngress:
+		return GatewayBackendIngress, nil
+	case GatewayBackendIngressPerEnv, GatewayBackendGatewayAPI, GatewayBackendProxy:
+		return GatewayBackend(asString), nil
+	}
+	return "", fmt.Errorf("Reading EPH_GATEWAY_BACKEND: unrecognized backend %q", asString)
+}
+
+// The Gateway that env HTTPRoutes attach to.
+type GatewayParent struct {
+	Namespace string
+
+	Name string
+
+	// The listener name on the Gateway. Optional.
+	SectionName string
+}
+
+// Reads the Gateway as "namespace/name" or "namespace/name/listener".
+func ReadGatewayParent() (GatewayParent, error) {
+	asString := os.Getenv("EPH_GATEWAY_PARENT")
+	if asString == "" {
+		return GatewayParent{}, fmt.Errorf("Missing env var EPH_GATEWAY_PARENT")
+	}
+
+	parts := strings.Split(asString, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return GatewayParent{}, fmt.Errorf("Reading EPH_GATEWAY_PARENT: expected namespace/name[/listener], got %q", asString)
+	}
+
+	parent := GatewayParent{Namespace: parts[0], Name: parts[1]}
+	if len(parts) == 3 {
+		parent.SectionName = parts[2]
+	}
+	return parent, nil
+}
+
+// How the gateway serves env hosts over TLS.
+//
+// At most one of the fields should be set. If neither is set,
+// the gateway serves env hosts over plain HTTP.
+type GatewayTLS struct {
+	// A secret with a wildcard certificate for *.<gatewayHost>,
+	// shared by all envs.
+	WildcardSecretName string
+
+	// A cert-manager ClusterIssuer that issues a certificate for each env.
+	CertIssuer string
+}
+
+func (t GatewayTLS) Enabled() bool {
+	return t.WildcardSecretName != "" || t.CertIssuer != ""
+}
+
+// The URL scheme of links to gateway hosts.
+func (t GatewayTLS) Scheme() string {
+	if t.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func ReadGatewayTLS() (GatewayTLS, error) {
+	tls := GatewayTLS{
+		WildcardSecretName: os.Getenv("EPH_GATEWAY_TLS_SECRET"),
+		CertIssuer:         os.Getenv("EPH_GATEWAY_CERT_ISSUER"),
+	}
+	if tls.WildcardSecretName != "" && tls.CertIssuer != "" {
+		return GatewayTLS{}, fmt.Errorf("Cannot specify both EPH_GATEWAY_TLS_SECRET and EPH_GATEWAY_CERT_ISSUER")
+	}
+	return tls, nil
+}
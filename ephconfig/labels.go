@@ -6,3 +6,6 @@ const (
 	LabelNameKey             = "app.kubernetes.io/name"
 	LabelNameValueEphrunner  = "ephrunner"
 )
+
+// The component that ephctrl records events as.
+const EventComponent = "ephctrl"
@@ -0,0 +1,172 @@
+package ephconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The ConfigMap with the allowlist and gateway host, shared by ephctrl and ephdash.
+const ConfigMapName = "ephconfig"
+
+// The settings in the ephconfig ConfigMap that we reload without a restart.
+type Config struct {
+	Allowlist   *Allowlist
+	GatewayHost string
+
+	// A hash of the settings, so operators can check that every
+	// replica of every binary has picked up an edit.
+	Version string
+}
+
+func configVersion(allowlist, gatewayHost string) string {
+	sum := sha256.Sum256([]byte(allowlist + "\x00" + gatewayHost))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Parses and validates the allowlist and gateway host from the
+// ephconfig ConfigMap data.
+func ParseConfig(data map[string]string) (*Config, error) {
+	if data["gatewayHost"] == "" {
+		return nil, fmt.Errorf("Missing gatewayHost")
+	}
+	if data["allowlist"] == "" {
+		return nil, fmt.Errorf("Missing allowlist")
+	}
+
+	allowlist := &Allowlist{}
+	err := yaml.Unmarshal([]byte(data["allowlist"]), allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("Reading allowlist: %v", err)
+	}
+	err = allowlist.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Reading allowlist: %v", err)
+	}
+
+	return &Config{
+		Allowlist:   allowlist,
+		GatewayHost: data["gatewayHost"],
+		Version:     configVersion(data["allowlist"], data["gatewayHost"]),
+	}, nil
+}
+
+// Reads the config we start with from EPH_ALLOWLIST and EPH_GATEWAY_HOST,
+// which the charts fill in from the ephconfig ConfigMap.
+func ReadConfig() (*Config, error) {
+	allowlist, err := ReadAllowlist()
+	if err != nil {
+		return nil, err
+	}
+	gatewayHost, err := ReadGatewayHost()
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Allowlist:   allowlist,
+		GatewayHost: gatewayHost,
+		Version:     configVersion(os.Getenv("EPH_ALLOWLIST"), gatewayHost),
+	}, nil
+}
+
+// Holds the current config, and swaps it when the ephconfig ConfigMap changes.
+// The live package watches the ConfigMap.
+//
+// Readers get a consistent snapshot with Get(). If an edit doesn't parse,
+// we keep the last good config, so a typo can't lock everyone out.
+type LiveConfig struct {
+	current atomic.Value // *Config
+
+	mu           sync.Mutex
+	listeners    []func(old, new *Config)
+	lastError    string
+	reloads      int
+	reloadErrors int
+}
+
+func NewLiveConfig(config *Config) *LiveConfig {
+	c := &LiveConfig{}
+	c.current.Store(config)
+	return c
+}
+
+// A live config that never changes, e.g., for tests.
+func StaticConfig(allowlist *Allowlist, gatewayHost string) *LiveConfig {
+	return NewLiveConfig(&Config{Allowlist: allowlist, GatewayHost: gatewayHost, Version: "static"})
+}
+
+// The current config. Callers should hold on to the result for the
+// length of a request or reconcile, so they see one version throughout.
+func (c *LiveConfig) Get() *Config {
+	return c.current.Load().(*Config)
+}
+
+func (c *LiveConfig) Allowlist() *Allowlist {
+	return c.Get().Allowlist
+}
+
+func (c *LiveConfig) GatewayHost() string {
+	return c.Get().GatewayHost
+}
+
+func (c *LiveConfig) Version() string {
+	return c.Get().Version
+}
+
+// Why the most recent edit didn't apply, if it didn't.
+func (c *LiveConfig) LastError() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastError
+}
+
+// How many edits we applied, and how many didn't parse.
+func (c *LiveConfig) Reloads() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reloads, c.reloadErrors
+}
+
+// Calls fn after every change to the config. fn must not block.
+func (c *LiveConfig) OnChange(fn func(old, new *Config)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, fn)
+}
+
+// Applies the ConfigMap data, if it parses.
+//
+// On error, keeps the last good config and returns the error.
+func (c *LiveConfig) Apply(data map[string]string) error {
+	next, err := ParseConfig(data)
+
+	c.mu.Lock()
+	if err != nil {
+		c.reloadErrors++
+		c.lastError = err.Error()
+		c.mu.Unlock()
+		return err
+	}
+	c.lastError = ""
+
+	old := c.Get()
+	if old.Version == next.Version {
+		c.mu.Unlock()
+		return nil
+	}
+	c.current.Store(next)
+	c.reloads++
+	listeners := append([]func(old, new *Config){}, c.listeners...)
+	c.mu.Unlock()
+
+	// Call the listeners without the lock, so they can read the config.
+	for _, fn := range listeners {
+		fn(old, next)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package live keeps an ephconfig.LiveConfig in sync with the
+// ephconfig ConfigMap, and reports on it as metrics.
+package live
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Watches the ephconfig ConfigMap in the namespace, and applies every edit,
+// until the context is done.
+//
+// If the ConfigMap is deleted, we keep the last good config.
+func Watch(ctx context.Context, config *ephconfig.LiveConfig, clientset kubernetes.Interface, namespace string) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, time.Hour,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ephconfig.ConfigMapName).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			apply(ctx, config, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			apply(ctx, config, obj)
+		},
+	})
+	informer.Run(ctx.Done())
+}
+
+func apply(ctx context.Context, config *ephconfig.LiveConfig, obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok || cm.Name != ephconfig.ConfigMapName {
+		return
+	}
+	log := log.FromContext(ctx).WithValues("configmap", cm.Namespace+"/"+cm.Name)
+	old := config.Version()
+	err := config.Apply(cm.Data)
+	if err != nil {
+		log.Error(err, "ignoring invalid config", "version", old)
+		return
+	}
+	if config.Version() != old {
+		log.Info("applied config", "version", config.Version(), "previous", old)
+	}
+}
+
+// Metrics for the config: the version we're running, and how reloads went.
+//
+// The prefix names the binary, e.g., "ephctrl".
+func NewCollector(config *ephconfig.LiveConfig, prefix string) prometheus.Collector {
+	return &collector{
+		config: config,
+		info: prometheus.NewDesc(prefix+"_config_info",
+			"Always 1. The version label is a hash of the active allowlist and gateway host.",
+			[]string{"version"}, nil),
+		reloads: prometheus.NewDesc(prefix+"_config_reloads_total",
+			"Number of edits to the ephconfig ConfigMap that we applied.", nil, nil),
+		reloadErrors: prometheus.NewDesc(prefix+"_config_reload_errors_total",
+			"Number of edits to the ephconfig ConfigMap that didn't parse, so we kept the last good config.", nil, nil),
+	}
+}
+
+type collector struct {
+	config       *ephconfig.LiveConfig
+	info         *prometheus.Desc
+	reloads      *prometheus.Desc
+	reloadErrors *prometheus.Desc
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.reloads
+	ch <- c.reloadErrors
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	reloads, reloadErrors := c.config.Reloads()
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, c.config.Version())
+	ch <- prometheus.MustNewConstMetric(c.reloads, prometheus.CounterValue, float64(reloads))
+	ch <- prometheus.MustNewConstMetric(c.reloadErrors, prometheus.CounterValue, float64(reloadErrors))
+}
@@ -0,0 +1,65 @@
+package live
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testAllowlist = `
+repoBase: https://github.com/tilt-dev
+repoNames:
+- tilt-avatars
+`
+
+func TestWatch(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ephconfig.ConfigMapName, Namespace: "default"},
+		Data:       map[string]string{"allowlist": testAllowlist, "gatewayHost": "preview.tilt.build"},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+
+	live := ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, live, clientset, "default")
+
+	assert.Eventually(t, func() bool {
+		return live.GatewayHost() == "preview.tilt.build"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cm = cm.DeepCopy()
+	cm.Data["allowlist"] = "repos: ["
+	_, err := clientset.CoreV1().ConfigMaps("default").Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return live.LastError() != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "preview.tilt.build", live.GatewayHost())
+}
+
+func TestCollector(t *testing.T) {
+	config := ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost")
+	require.NoError(t, config.Apply(map[string]string{"allowlist": testAllowlist, "gatewayHost": "preview.tilt.build"}))
+	assert.Error(t, config.Apply(map[string]string{"allowlist": "repos: [", "gatewayHost": "preview.tilt.build"}))
+
+	err := testutil.CollectAndCompare(NewCollector(config, "ephtest"), strings.NewReader(`
+# HELP ephtest_config_reload_errors_total Number of edits to the ephconfig ConfigMap that didn't parse, so we kept the last good config.
+# TYPE ephtest_config_reload_errors_total counter
+ephtest_config_reload_errors_total 1
+# HELP ephtest_config_reloads_total Number of edits to the ephconfig ConfigMap that we applied.
+# TYPE ephtest_config_reloads_total counter
+ephtest_config_reloads_total 1
+`), "ephtest_config_reloads_total", "ephtest_config_reload_errors_total")
+	assert.NoError(t, err)
+}
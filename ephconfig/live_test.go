@@ -0,0 +1,69 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const liveAllowlist = `
+repoBase: https://github.com/tilt-dev
+repoNames:
+- tilt-avatars
+`
+
+func TestLiveConfigApply(t *testing.T) {
+	c, err := ParseConfig(map[string]string{"allowlist": liveAllowlist, "gatewayHost": "preview.localhost"})
+	require.NoError(t, err)
+	live := NewLiveConfig(c)
+	version := live.Version()
+
+	var changes []string
+	live.OnChange(func(old, new *Config) {
+		changes = append(changes, old.GatewayHost+" -> "+new.GatewayHost)
+	})
+
+	// Re-applying the same data is a no-op.
+	assert.NoError(t, live.Apply(map[string]string{"allowlist": liveAllowlist, "gatewayHost": "preview.localhost"}))
+	assert.Equal(t, version, live.Version())
+	assert.Empty(t, changes)
+
+	assert.NoError(t, live.Apply(map[string]string{"allowlist": liveAllowlist, "gatewayHost": "preview.tilt.build"}))
+	assert.Equal(t, "preview.tilt.build", live.GatewayHost())
+	assert.NotEqual(t, version, live.Version())
+	assert.Equal(t, []string{"preview.localhost -> preview.tilt.build"}, changes)
+	version = live.Version()
+
+	// Bad edits keep the last good config.
+	bad := []map[string]string{
+		{"allowlist": liveAllowlist},
+		{"allowlist": "repos: [", "gatewayHost": "preview.localhost"},
+		{"allowlist": "repos:\n- names: [x]\n", "gatewayHost": "preview.localhost"},
+	}
+	for _, data := range bad {
+		assert.Error(t, live.Apply(data))
+		assert.Equal(t, version, live.Version())
+		assert.Equal(t, "preview.tilt.build", live.GatewayHost())
+		assert.NotEmpty(t, live.LastError())
+	}
+	assert.Len(t, changes, 1)
+
+	assert.NoError(t, live.Apply(map[string]string{"allowlist": liveAllowlist, "gatewayHost": "preview.localhost"}))
+	assert.Empty(t, live.LastError())
+	assert.NoError(t, live.Allowlist().IsRepoAllowed("https://github.com/tilt-dev/tilt-avatars"))
+}
+
+func TestLiveConfigListenerReads(t *testing.T) {
+	live := StaticConfig(&Allowlist{}, "preview.localhost")
+
+	// Listeners may read the config, including the parts behind the lock.
+	var seen []string
+	live.OnChange(func(old, new *Config) {
+		reloads, _ := live.Reloads()
+		seen = append(seen, fmt.Sprintf("%s %d %q", live.GatewayHost(), reloads, live.LastError()))
+	})
+	require.NoError(t, live.Apply(map[string]string{"allowlist": liveAllowlist, "gatewayHost": "preview.tilt.build"}))
+	assert.Equal(t, []string{`preview.tilt.build 1 ""`}, seen)
+}
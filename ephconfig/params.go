@@ -0,0 +1,276 @@
+package ephconfig
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where a param's value goes.
+type ParamKind string
+
+const (
+	// Passed to the Tiltfile as --<name>=<value>, after `--` on the
+	// `tilt up` command line, for Tiltfiles that read it with config.parse().
+	ParamKindArg ParamKind = "arg"
+
+	// Set as an environment variable for `tilt up`.
+	ParamKindEnv ParamKind = "env"
+)
+
+type ParamType string
+
+const (
+	ParamTypeString ParamType = "string"
+	ParamTypeInt    ParamType = "int"
+	ParamTypeBool   ParamType = "bool"
+)
+
+// The longest value users may give a param.
+const maxParamValueLength = 256
+
+// A Tiltfile arg or env var that users may set when they create an env.
+type Param struct {
+	Name string `json:"name" yaml:"name"`
+
+	// arg or env. Defaults to arg.
+	Kind ParamKind `json:"kind,omitempty" yaml:"kind,omitempty"`
+
+	// string, int or bool. Defaults to string.
+	Type ParamType `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// If set, the value must be one of these.
+	Enum []string `json:"enum,omitempty" yaml:"enum,omitempty"`
+
+	// If set, the value must match this regular expression, in full.
+	Pattern string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+
+	// The value if the user doesn't give one. Empty means we don't pass the param.
+	Default string `json:"default,omitempty" yaml:"default,omitempty"`
+
+	// If true, users must give a value, unless there's a default.
+	Required bool `json:"required,omitempty" yaml:"required,omitempty"`
+
+	// Shown next to the field on the dashboard.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// Where the param's value goes, applying the default. Use this
+// instead of the Kind field, which may be empty.
+func (p Param) EffectiveKind() ParamKind {
+	if p.Kind == "" {
+		return ParamKindArg
+	}
+	return p.Kind
+}
+
+func (p Param) typ() ParamType {
+	if p.Type == "" {
+		return ParamTypeString
+	}
+	return p.Type
+}
+
+// The options the dashboard offers, if the param only takes a few values.
+func (p Param) Options() []string {
+	if len(p.Enum) > 0 {
+		return p.Enum
+	}
+	if p.typ() == ParamTypeBool {
+		return []string{"true", "false"}
+	}
+	return nil
+}
+
+// The name of the form field, and of the ConfigMap key, with the param's value.
+func (p Param) Key() string {
+	return fmt.Sprintf("%s.%s", p.EffectiveKind(), p.Name)
+}
+
+var argNameRe = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_-]*$")
+
+// Check that the schema is well-formed.
+func (p Param) validateSchema() error {
+	switch p.EffectiveKind() {
+	case ParamKindArg:
+		if !argNameRe.MatchString(p.Name) {
+			return fmt.Errorf("invalid arg name %q", p.Name)
+		}
+	case ParamKindEnv:
+		err := validateEnvVar(EnvVar{Name: p.Name})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("kind of %s must be arg or env, got %q", p.Name, p.Kind)
+	}
+
+	switch p.typ() {
+	case ParamTypeString, ParamTypeInt, ParamTypeBool:
+	default:
+		return fmt.Errorf("type of %s must be string, int or bool, got %q", p.Name, p.Type)
+	}
+
+	if p.Pattern != "" {
+		_, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for %s: %v", p.Name, err)
+		}
+	}
+	for _, v := range p.Enum {
+		err := p.checkType(v)
+		if err != nil {
+			return fmt.Errorf("invalid enum value for %s: %v", p.Name, err)
+		}
+	}
+	if p.Default != "" {
+		err := p.ValidateValue(p.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default for %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p Param) checkType(v string) error {
+	if len(v) > maxParamValueLength {
+		return fmt.Errorf("longer than %d characters", maxParamValueLength)
+	}
+	if strings.ContainsAny(v, "\n\r\x00") {
+		return fmt.Errorf("contains a line break")
+	}
+	switch p.typ() {
+	case ParamTypeInt:
+		_, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", v)
+		}
+	case ParamTypeBool:
+		if v != "true" && v != "false" {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+	}
+	return nil
+}
+
+// Check the value against the param's type, enum and pattern.
+func (p Param) ValidateValue(v string) error {
+	err := p.checkType(v)
+	if err != nil {
+		return err
+	}
+	if len(p.Enum) > 0 && !contains(p.Enum, v) {
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(p.Enum, ", "))
+	}
+	if p.Pattern != "" {
+		re := regexp.MustCompile(fmt.Sprintf("^(?:%s)$", p.Pattern))
+		if !re.MatchString(v) {
+			return fmt.Errorf("%q does not match %s", v, p.Pattern)
+		}
+	}
+	return nil
+}
+
+// Check that the params are well-formed, and don't clash
+// with the settings' own args and env vars.
+func (s RepoSettings) validateParams() error {
+	seen := map[string]bool{}
+	for _, p := range s.Params {
+		err := p.validateSchema()
+		if err != nil {
+			return fmt.Errorf("params: %v", err)
+		}
+		if seen[p.Key()] {
+			return fmt.Errorf("params: duplicate %s %s", p.EffectiveKind(), p.Name)
+		}
+		seen[p.Key()] = true
+
+		if p.EffectiveKind() == ParamKindArg && len(s.Resources) > 0 {
+			return fmt.Errorf("params: can't set both resources and arg %s", p.Name)
+		}
+		for _, v := range s.Env {
+			if p.EffectiveKind() == ParamKindEnv && v.Name == p.Name {
+				return fmt.Errorf("params: env var %s is already set", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Finds the param with the given key, e.g., "arg.profile".
+func (s RepoSettings) param(key string) (Param, bool) {
+	for _, p := range s.Params {
+		if p.Key() == key {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// The value of the param in the spec, or its default.
+func (spec EnvSpec) paramValue(p Param) string {
+	values := spec.Args
+	if p.EffectiveKind() == ParamKindEnv {
+		values = spec.Env
+	}
+	if v := values[p.Name]; v != "" {
+		return v
+	}
+	return p.Default
+}
+
+// Check the spec's args and env vars against the params of the repo:
+// each must be declared, and valid, and required params must have values.
+func isParamsAllowed(allowlist *Allowlist, spec EnvSpec) error {
+	settings := allowlist.RepoSettings(spec.Repo)
+	var errs FieldErrors
+	check := func(kind ParamKind, values map[string]string) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key := fmt.Sprintf("%s.%s", kind, name)
+			p, ok := settings.param(key)
+			if !ok {
+				errs = append(errs, forbidden(key, ReasonUnknown, "unknown %s %s for repo: %s", kind, name, spec.Repo))
+				continue
+			}
+			err := p.ValidateValue(values[name])
+			if err != nil {
+				errs = append(errs, forbidden(key, ReasonInvalid, "invalid %s %s: %v", kind, name, err))
+			}
+		}
+	}
+	check(ParamKindArg, spec.Args)
+	check(ParamKindEnv, spec.Env)
+
+	for _, p := range settings.Params {
+		if p.Required && spec.paramValue(p) == "" {
+			errs = append(errs, forbidden(p.Key(), ReasonRequired, "missing %s %s", p.EffectiveKind(), p.Name))
+		}
+	}
+	return errs.toError()
+}
+
+// The Tiltfile args and env vars for `tilt up` from the params,
+// in the order the allowlist declares them. Params without a value are left out.
+func (s RepoSettings) ParamValues(spec EnvSpec) ([]string, []EnvVar) {
+	var args []string
+	var env []EnvVar
+	for _, p := range s.Params {
+		v := spec.paramValue(p)
+		if v == "" {
+			continue
+		}
+		if p.EffectiveKind() == ParamKindEnv {
+			env = append(env, EnvVar{Name: p.Name, Value: v})
+		} else {
+			args = append(args, fmt.Sprintf("--%s=%s", p.Name, v))
+		}
+	}
+	return args, env
+}
@@ -0,0 +1,111 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamsValidate(t *testing.T) {
+	cases := []struct {
+		settings RepoSettings
+		msg      string
+	}{
+		{settings: RepoSettings{Params: []Param{{Name: "profile", Enum: []string{"dev", "full"}, Default: "dev"}}}, msg: ""},
+		{settings: RepoSettings{Params: []Param{{Name: "LOG_LEVEL", Kind: ParamKindEnv}}}, msg: ""},
+		{settings: RepoSettings{Params: []Param{{Name: "--profile"}}}, msg: "invalid arg name"},
+		{settings: RepoSettings{Params: []Param{{Name: "TILT_UPPER_REPO", Kind: ParamKindEnv}}}, msg: "reserved"},
+		{settings: RepoSettings{Params: []Param{{Name: "x", Kind: "file"}}}, msg: "must be arg or env"},
+		{settings: RepoSettings{Params: []Param{{Name: "x", Type: "float"}}}, msg: "must be string, int or bool"},
+		{settings: RepoSettings{Params: []Param{{Name: "x", Pattern: "("}}}, msg: "invalid pattern"},
+		{settings: RepoSettings{Params: []Param{{Name: "x", Type: ParamTypeInt, Enum: []string{"1", "two"}}}}, msg: "invalid enum value"},
+		{settings: RepoSettings{Params: []Param{{Name: "x", Pattern: "[a-z]+", Default: "A"}}}, msg: "invalid default"},
+		{settings: RepoSettings{Params: []Param{{Name: "x"}, {Name: "x"}}}, msg: "duplicate arg x"},
+		{settings: RepoSettings{Params: []Param{{Name: "x"}, {Name: "x", Kind: ParamKindEnv}}}, msg: ""},
+		{settings: RepoSettings{Resources: []string{"api"}, Params: []Param{{Name: "x"}}}, msg: "resources"},
+		{settings: RepoSettings{Env: []EnvVar{{Name: "X"}}, Params: []Param{{Name: "X", Kind: ParamKindEnv}}}, msg: "already set"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestParamsValidate%d", i), func(t *testing.T) {
+			err := c.settings.Validate()
+			if c.msg == "" {
+				assert.NoError(t, err)
+			} else {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.msg)
+				}
+			}
+		})
+	}
+}
+
+func TestParamsAllowed(t *testing.T) {
+	allowlist := &Allowlist{Repos: []RepoRule{{
+		Base:  "https://github.com/acme",
+		Names: []string{"web"},
+		Settings: RepoSettings{Params: []Param{
+			{Name: "profile", Enum: []string{"dev", "full"}, Default: "dev"},
+			{Name: "replicas", Type: ParamTypeInt},
+			{Name: "ticket", Pattern: "[A-Z]+-[0-9]+", Required: true},
+			{Name: "DEBUG", Kind: ParamKindEnv, Type: ParamTypeBool},
+		}},
+	}}}
+	spec := func(args, env map[string]string) EnvSpec {
+		return EnvSpec{Repo: "https://github.com/acme/web", Branch: "main", Path: "Tiltfile", Args: args, Env: env}
+	}
+
+	cases := []allowedCase{
+		{spec: spec(map[string]string{"ticket": "ENG-1"}, nil), msg: ""},
+		{spec: spec(map[string]string{"ticket": "ENG-1", "profile": "full", "replicas": "3"}, map[string]string{"DEBUG": "true"}), msg: ""},
+		{spec: spec(nil, nil), msg: "Forbidden: missing arg ticket", field: "arg.ticket", reason: ReasonRequired},
+		{spec: spec(map[string]string{"ticket": "eng-1"}, nil), msg: "Forbidden: invalid arg ticket", field: "arg.ticket", reason: ReasonInvalid},
+		{spec: spec(map[string]string{"ticket": "ENG-1", "profile": "prod"}, nil), msg: "Forbidden: invalid arg profile", field: "arg.profile", reason: ReasonInvalid},
+		{spec: spec(map[string]string{"ticket": "ENG-1", "replicas": "many"}, nil), msg: "Forbidden: invalid arg replicas", field: "arg.replicas", reason: ReasonInvalid},
+		{spec: spec(map[string]string{"ticket": "ENG-1"}, map[string]string{"DEBUG": "yes"}), msg: "Forbidden: invalid env DEBUG", field: "env.DEBUG", reason: ReasonInvalid},
+		{spec: spec(map[string]string{"ticket": "ENG-1", "host": "evil"}, nil), msg: "Forbidden: unknown arg host", field: "arg.host", reason: ReasonUnknown},
+		{spec: spec(map[string]string{"ticket": "ENG-1"}, map[string]string{"profile": "dev"}), msg: "Forbidden: unknown env profile", field: "env.profile", reason: ReasonUnknown},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestParamsAllowed%d", i), func(t *testing.T) {
+			assertAllowed(t, allowlist, c)
+		})
+	}
+
+	// Every bad param is reported.
+	errs := AsFieldErrors(IsAllowed(allowlist, spec(map[string]string{"profile": "prod", "host": "evil"}, nil)))
+	assert.Equal(t, map[string]string{
+		"arg.host":    "unknown arg host for repo: https://github.com/acme/web",
+		"arg.profile": `invalid arg profile: "prod" is not one of dev, full`,
+		"arg.ticket":  "missing arg ticket",
+	}, errs.ByField())
+}
+
+func TestParamEffectiveKind(t *testing.T) {
+	assert.Equal(t, ParamKindArg, Param{Name: "profile"}.EffectiveKind())
+	assert.Equal(t, ParamKindArg, Param{Name: "profile", Kind: ParamKindArg}.EffectiveKind())
+	assert.Equal(t, ParamKindEnv, Param{Name: "DEBUG", Kind: ParamKindEnv}.EffectiveKind())
+}
+
+func TestParamValues(t *testing.T) {
+	settings := RepoSettings{Params: []Param{
+		{Name: "profile", Default: "dev"},
+		{Name: "replicas"},
+		{Name: "DEBUG", Kind: ParamKindEnv},
+	}}
+	spec := EnvSpec{Env: map[string]string{"DEBUG": "true"}}
+	args, env := settings.ParamValues(spec)
+	assert.Equal(t, []string{"--profile=dev"}, args)
+	assert.Equal(t, []EnvVar{{Name: "DEBUG", Value: "true"}}, env)
+
+	data := EnvSpec{Repo: "r", Branch: "b", Path: "p", Args: map[string]string{"profile": "full"}, Env: spec.Env}.Data()
+	assert.Equal(t, "full", data["arg.profile"])
+	assert.Equal(t, "true", data["env.DEBUG"])
+	parsed := SpecFromData(data)
+	assert.Equal(t, map[string]string{"profile": "full"}, parsed.Args)
+	assert.Equal(t, spec.Env, parsed.Env)
+}
@@ -0,0 +1,271 @@
+package ephconfig
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A rule for which repos users may create envs for.
+//
+// Names, denies and branches are patterns: exact names, globs
+// (like "tilt-example-*"), or regular expressions between slashes
+// (like "/svc-[a-z]+/"). Patterns must match the whole name.
+// In branch globs, "*" also matches "/", so "feature-*" matches
+// "feature-x/y".
+type RepoRule struct {
+	// The repo URL up to the repo name, on any host,
+	// e.g., https://github.com/tilt-dev or https://gitea.internal/team.
+	Base string `json:"base" yaml:"base"`
+
+	// Repo names under the base that users may create envs for.
+	Names []string `json:"names" yaml:"names"`
+
+	// Repo names under the base that users may not create envs for,
+	// even if they match Names or another rule.
+	Deny []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+
+	// Branches that users may create envs for. Empty means any branch.
+	Branches []string `json:"branches,omitempty" yaml:"branches,omitempty"`
+
+	// How to run envs for the repos this rule allows.
+	Settings RepoSettings `json:"settings,omitempty" yaml:"settings,omitempty"`
+}
+
+// The rules for which repos users may create envs for.
+//
+// The top-level repoBase and repoNames, if any, are the first rule.
+func (a *Allowlist) Rules() []RepoRule {
+	if a.RepoBase == "" && len(a.RepoNames) == 0 {
+		return a.Repos
+	}
+	legacy := RepoRule{Base: a.RepoBase, Names: a.RepoNames}
+	return append([]RepoRule{legacy}, a.Repos...)
+}
+
+func isRegexPattern(p string) bool {
+	return len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/")
+}
+
+func isLiteralPattern(p string) bool {
+	return !isRegexPattern(p) && !strings.ContainsAny(p, `*?[\`)
+}
+
+func validatePattern(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	if isRegexPattern(p) {
+		_, err := regexp.Compile(p[1 : len(p)-1])
+		return err
+	}
+	_, err := path.Match(p, "")
+	return err
+}
+
+func matchPattern(p, s string) bool {
+	if isRegexPattern(p) {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", p[1:len(p)-1]))
+		return err == nil && re.MatchString(s)
+	}
+	ok, err := path.Match(p, s)
+	return err == nil && ok
+}
+
+// Branch names can't contain NUL, so it stands in for "/", which
+// path.Match wouldn't let "*" match.
+func matchBranchPattern(p, branch string) bool {
+	if isRegexPattern(p) {
+		return matchPattern(p, branch)
+	}
+	return matchPattern(strings.ReplaceAll(p, "/", "\x00"), strings.ReplaceAll(branch, "/", "\x00"))
+}
+
+func matchAnyBranch(patterns []string, branch string) bool {
+	for _, p := range patterns {
+		if matchBranchPattern(p, branch) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the repo rules are well-formed.
+func (a *Allowlist) validateRepos() error {
+	for i, rule := range a.Repos {
+		if rule.Base == "" {
+			return fmt.Errorf("repos: missing base for rule %d", i)
+		}
+		if len(rule.Names) == 0 {
+			return fmt.Errorf("repos: missing names for %s", rule.Base)
+		}
+		err := rule.Settings.Validate()
+		if err != nil {
+			return fmt.Errorf("repos: invalid settings for %s: %v", rule.Base, err)
+		}
+	}
+	for _, rule := range a.Rules() {
+		for _, list := range [][]string{rule.Names, rule.Deny, rule.Branches} {
+			for _, p := range list {
+				err := validatePattern(p)
+				if err != nil {
+					return fmt.Errorf("repos: invalid pattern for %s: %q: %v", rule.Base, p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Splits a repo URL into its base and name.
+func splitRepo(repo string) (string, string, error) {
+	parts := strings.Split(repo, "/")
+	if len(parts) < 2 {
+		return "", "", forbidden("repo", ReasonMalformed, "malformed repo: %s", repo)
+	}
+	name := parts[len(parts)-1]
+	if name == "" || name == "." || name == ".." {
+		// Globs like "*" would match these.
+		return "", "", forbidden("repo", ReasonMalformed, "malformed repo: %s", repo)
+	}
+	return strings.Join(parts[:len(parts)-1], "/"), name, nil
+}
+
+// Finds the rules that allow the repo.
+func (a *Allowlist) repoRules(repo string) ([]RepoRule, error) {
+	base, name, err := splitRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []RepoRule
+	knownBase := false
+	for _, rule := range a.Rules() {
+		if strings.TrimSuffix(rule.Base, "/") != base {
+			continue
+		}
+		knownBase = true
+		if matchAny(rule.Deny, name) {
+			return nil, forbidden("repo", ReasonNotAllowed, "denied repo: %s", repo)
+		}
+		if matchAny(rule.Names, name) {
+			matches = append(matches, rule)
+		}
+	}
+
+	if !knownBase {
+		return nil, forbidden("repo", ReasonNotAllowed, "unrecognized base: %s", repo)
+	}
+	if len(matches) == 0 {
+		return nil, forbidden("repo", ReasonNotAllowed, "unrecognized repo name: %s", repo)
+	}
+	return matches, nil
+}
+
+func isRepoAllowed(allowlist *Allowlist, repo string) error {
+	_, err := allowlist.repoRules(repo)
+	return err
+}
+
+// Checks whether users may create envs for the repo, on some branch.
+func (a *Allowlist) IsRepoAllowed(repo string) error {
+	return isRepoAllowed(a, repo)
+}
+
+// Checks that some rule that allows the repo also allows the branch.
+func isBranchAllowedForRepo(allowlist *Allowlist, repo, branch string) error {
+	rules, err := allowlist.repoRules(repo)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if len(rule.Branches) == 0 || matchAnyBranch(rule.Branches, branch) {
+			return nil
+		}
+	}
+	return forbidden("branch", ReasonNotAllowed, "branch %s not allowed for repo: %s", branch, repo)
+}
+
+// Whether users may create envs for the branch of the repo.
+func (a *Allowlist) IsBranchAllowed(repo, branch string) bool {
+	return isBranchAllowed(branch) == nil && isBranchAllowedForRepo(a, repo, branch) == nil
+}
+
+// The branches that the rules for the repo list by name, for the dashboard
+// to offer when it can't list the repo's branches itself.
+func (a *Allowlist) ListedBranches(repo string) []string {
+	rules, err := a.repoRules(repo)
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, rule := range rules {
+		for _, b := range rule.Branches {
+			if isLiteralPattern(b) && !contains(result, b) {
+				result = append(result, b)
+			}
+		}
+	}
+	return result
+}
+
+// The repos that the rules list by name, for the dashboard to offer.
+//
+// Globs and regular expressions can match repos we don't know about,
+// so users have to type those in (see HasRepoPatterns).
+func (a *Allowlist) ListedRepos() []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, rule := range a.Rules() {
+		for _, name := range rule.Names {
+			repo := fmt.Sprintf("%s/%s", strings.TrimSuffix(rule.Base, "/"), name)
+			if !isLiteralPattern(name) || seen[repo] || isRepoAllowed(a, repo) != nil {
+				continue
+			}
+			seen[repo] = true
+			result = append(result, repo)
+		}
+	}
+	return result
+}
+
+// Whether any rule allows repo names by glob or regular expression.
+func (a *Allowlist) HasRepoPatterns() bool {
+	for _, rule := range a.Rules() {
+		for _, name := range rule.Names {
+			if !isLiteralPattern(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the group may create envs for the repo. Doesn't check the allowlist.
+func (p *GroupPolicy) AllowsRepo(repo string) bool {
+	if p == nil || len(p.RepoNames) == 0 {
+		return true
+	}
+	_, name, err := splitRepo(repo)
+	return err == nil && matchAny(p.RepoNames, name)
+}
+
+// Whether any rule allows a repo with this name, under any base.
+func (a *Allowlist) allowsRepoName(name string) bool {
+	for _, rule := range a.Rules() {
+		if matchAny(rule.Names, name) && !matchAny(rule.Deny, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+var rulesAllowlist = &Allowlist{
+	RepoBase:  "https://github.com/tilt-dev",
+	RepoNames: []string{"tilt-avatars"},
+	Repos: []RepoRule{
+		{Base: "https://github.com/tilt-dev", Names: []string{"tilt-example-*"}, Deny: []string{"tilt-example-secret"}},
+		{Base: "https://github.com/acme", Names: []string{"/svc-[a-z]+/"}, Branches: []string{"main", "release/*"}},
+		{Base: "https://gitea.internal/team/", Names: []string{"app"}},
+	},
+}
+
+func TestRepoRules(t *testing.T) {
+	cases := []allowedCase{
+		{spec: EnvSpec{Repo: "https://github.com/tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/tilt-dev/tilt-example-html", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/tilt-dev/tilt-example-secret", Branch: "main", Path: "Tiltfile"}, msg: "denied repo", field: "repo", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "https://github.com/tilt-dev/tilt", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized repo name", field: "repo", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "https://github.com/acme/svc-billing", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/acme/svc-billing", Branch: "release/1-2", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/acme/svc-billing", Branch: "feature", Path: "Tiltfile"}, msg: "branch feature not allowed", field: "branch", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "https://github.com/acme/svc-Billing2", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized repo name", field: "repo", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "https://gitea.internal/team/app", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://gitea.internal/other/app", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized base", field: "repo", reason: ReasonNotAllowed},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestRepoRules%d", i), func(t *testing.T) {
+			assertAllowed(t, rulesAllowlist, c)
+		})
+	}
+}
+
+func TestRepoGlobs(t *testing.T) {
+	a := &Allowlist{Repos: []RepoRule{
+		{Base: "https://github.com/acme", Names: []string{"*"}, Branches: []string{"main", "feature-*", "release/*"}},
+	}}
+	cases := []allowedCase{
+		{spec: EnvSpec{Repo: "https://github.com/acme/app", Branch: "feature-x", Path: "Tiltfile"}, msg: ""},
+
+		// In branch globs, "*" spans slashes.
+		{spec: EnvSpec{Repo: "https://github.com/acme/app", Branch: "feature-x/y", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/acme/app", Branch: "release/1/2", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "https://github.com/acme/app", Branch: "main/x", Path: "Tiltfile"}, msg: "branch main/x not allowed", field: "branch", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "https://github.com/acme/app", Branch: "hotfix/feature-x", Path: "Tiltfile"}, msg: "not allowed", field: "branch", reason: ReasonNotAllowed},
+
+		// "*" doesn't open up paths outside the base.
+		{spec: EnvSpec{Repo: "https://github.com/acme/..", Branch: "main", Path: "Tiltfile"}, msg: "malformed repo", field: "repo", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "https://github.com/acme/.", Branch: "main", Path: "Tiltfile"}, msg: "malformed repo", field: "repo", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "https://github.com/acme/", Branch: "main", Path: "Tiltfile"}, msg: "malformed repo", field: "repo", reason: ReasonMalformed},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestRepoGlobs%d", i), func(t *testing.T) {
+			assertAllowed(t, a, c)
+		})
+	}
+
+	a.Repos[0].Branches = []string{"*"}
+	assert.True(t, a.IsBranchAllowed("https://github.com/acme/app", "feature/foo"))
+}
+
+func TestListedRepos(t *testing.T) {
+	assert.Equal(t, []string{
+		"https://github.com/tilt-dev/tilt-avatars",
+		"https://gitea.internal/team/app",
+	}, rulesAllowlist.ListedRepos())
+	assert.True(t, rulesAllowlist.HasRepoPatterns())
+	assert.False(t, allowlist.HasRepoPatterns())
+}
+
+func TestLegacyAllowlistYAML(t *testing.T) {
+	a := &Allowlist{}
+	err := yaml.Unmarshal([]byte(`
+repoBase: https://github.com/tilt-dev
+repoNames:
+- tilt-example-html
+repos:
+- base: https://gitea.internal/team
+  names: [app]
+`), a)
+	require.NoError(t, err)
+	require.NoError(t, a.Validate())
+	assert.Equal(t, []RepoRule{
+		{Base: "https://github.com/tilt-dev", Names: []string{"tilt-example-html"}},
+		{Base: "https://gitea.internal/team", Names: []string{"app"}},
+	}, a.Rules())
+	assert.NoError(t, IsAllowed(a, EnvSpec{Repo: "https://github.com/tilt-dev/tilt-example-html", Branch: "main", Path: "Tiltfile"}))
+}
+
+func TestRepoRulesValidate(t *testing.T) {
+	cases := []struct {
+		rule RepoRule
+		msg  string
+	}{
+		{rule: RepoRule{Base: "https://github.com/acme", Names: []string{"*"}}, msg: ""},
+		{rule: RepoRule{Names: []string{"app"}}, msg: "missing base"},
+		{rule: RepoRule{Base: "https://github.com/acme"}, msg: "missing names"},
+		{rule: RepoRule{Base: "https://github.com/acme", Names: []string{"app["}}, msg: "invalid pattern"},
+		{rule: RepoRule{Base: "https://github.com/acme", Names: []string{"/app(/"}}, msg: "invalid pattern"},
+		{rule: RepoRule{Base: "https://github.com/acme", Names: []string{"app"}, Branches: []string{""}}, msg: "invalid pattern"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestRepoRulesValidate%d", i), func(t *testing.T) {
+			err := (&Allowlist{Repos: []RepoRule{c.rule}}).Validate()
+			if c.msg == "" {
+				assert.NoError(t, err)
+			} else {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.msg)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupRepoPatterns(t *testing.T) {
+	a := &Allowlist{
+		Repos:  rulesAllowlist.Repos,
+		Groups: []GroupPolicy{{Name: "acme", RepoNames: []string{"svc-*"}}},
+	}
+	require.NoError(t, a.Validate())
+
+	policy := &a.Groups[0]
+	assert.NoError(t, IsAllowedForGroup(a, policy, EnvSpec{Repo: "https://github.com/acme/svc-billing", Branch: "main", Path: "Tiltfile"}))
+	err := IsAllowedForGroup(a, policy, EnvSpec{Repo: "https://gitea.internal/team/app", Branch: "main", Path: "Tiltfile"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "may not create envs for repo")
+	}
+}
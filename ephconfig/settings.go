@@ -0,0 +1,173 @@
+package ephconfig
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Settings for the envs of the repos that a rule allows.
+//
+// If several rules allow a repo, each setting comes from the first rule that sets it.
+type RepoSettings struct {
+	// Extra flags for `tilt up`, e.g., ["--legacy=false"].
+	TiltArgs []string `json:"tiltArgs,omitempty" yaml:"tiltArgs,omitempty"`
+
+	// Arguments for the Tiltfile, passed after `--` on the `tilt up` command line,
+	// for Tiltfiles that read them with config.parse().
+	TiltfileArgs []string `json:"tiltfileArgs,omitempty" yaml:"tiltfileArgs,omitempty"`
+
+	// Environment variables for `tilt up`.
+	Env []EnvVar `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// The branch the dashboard picks for new envs.
+	DefaultBranch string `json:"defaultBranch,omitempty" yaml:"defaultBranch,omitempty"`
+
+	// The Tiltfile the dashboard picks for new envs.
+	DefaultPath string `json:"defaultPath,omitempty" yaml:"defaultPath,omitempty"`
+
+	// The Tilt resources to run. Empty runs every resource.
+	//
+	// Tilt reads resource names from the same place as Tiltfile args,
+	// so a rule can't set both.
+	Resources []string `json:"resources,omitempty" yaml:"resources,omitempty"`
+
+	// The image that runs `tilt up`, instead of the default tilt-upper image.
+	// Build it from the tilt-upper image, so it keeps the entrypoint.
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+
+	// Tiltfile args and env vars that users may set when they create an env.
+	Params []Param `json:"params,omitempty" yaml:"params,omitempty"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+var envVarNameRe = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Env vars that the tilt-upper entrypoint reads, which settings may not override.
+var reservedEnvPrefixes = []string{"TILT_UPPER_", "K3D_IMAGE_", "DO_NOT_TRACK"}
+
+func validateEnvVar(v EnvVar) error {
+	if !envVarNameRe.MatchString(v.Name) {
+		return fmt.Errorf("invalid env var name %q", v.Name)
+	}
+	for _, prefix := range reservedEnvPrefixes {
+		if strings.HasPrefix(v.Name, prefix) {
+			return fmt.Errorf("env var %s is reserved", v.Name)
+		}
+	}
+	return nil
+}
+
+// Args are passed to the pod one per line.
+func validateArg(arg string) error {
+	if arg == "" || strings.ContainsAny(arg, "\n\r") {
+		return fmt.Errorf("invalid arg %q", arg)
+	}
+	return nil
+}
+
+// The entrypoint sets the Tiltfile and host itself.
+func validateTiltArg(arg string) error {
+	err := validateArg(arg)
+	if err != nil {
+		return err
+	}
+	for _, flag := range []string{"-f", "--file", "--host", "--"} {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return fmt.Errorf("tilt arg %s is set by ephctrl", arg)
+		}
+	}
+	return nil
+}
+
+// Check that the settings are well-formed.
+func (s RepoSettings) Validate() error {
+	for _, arg := range s.TiltArgs {
+		err := validateTiltArg(arg)
+		if err != nil {
+			return err
+		}
+	}
+	for _, arg := range append(append([]string{}, s.TiltfileArgs...), s.Resources...) {
+		err := validateArg(arg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.TiltfileArgs) > 0 && len(s.Resources) > 0 {
+		return fmt.Errorf("can't set both tiltfileArgs and resources")
+	}
+	for _, v := range s.Env {
+		err := validateEnvVar(v)
+		if err != nil {
+			return err
+		}
+	}
+	if s.DefaultBranch != "" {
+		err := isBranchAllowed(s.DefaultBranch)
+		if err != nil {
+			return fmt.Errorf("defaultBranch: %v", err)
+		}
+	}
+	if s.DefaultPath != "" {
+		err := isPathAllowed(s.DefaultPath)
+		if err != nil {
+			return fmt.Errorf("defaultPath: %v", err)
+		}
+	}
+	if strings.ContainsAny(s.Image, " \t\n") {
+		return fmt.Errorf("invalid image %q", s.Image)
+	}
+	return s.validateParams()
+}
+
+// The settings for envs of the repo, merged from the rules that allow it.
+//
+// Returns empty settings if no rule allows the repo.
+func (a *Allowlist) RepoSettings(repo string) RepoSettings {
+	rules, err := a.repoRules(repo)
+	if err != nil {
+		return RepoSettings{}
+	}
+
+	var result RepoSettings
+	for _, rule := range rules {
+		s := rule.Settings
+		if result.TiltArgs == nil {
+			result.TiltArgs = s.TiltArgs
+		}
+		if result.TiltfileArgs == nil && result.Resources == nil {
+			result.TiltfileArgs = s.TiltfileArgs
+			result.Resources = s.Resources
+		}
+		if result.Env == nil {
+			result.Env = s.Env
+		}
+		if result.DefaultBranch == "" {
+			result.DefaultBranch = s.DefaultBranch
+		}
+		if result.DefaultPath == "" {
+			result.DefaultPath = s.DefaultPath
+		}
+		if result.Image == "" {
+			result.Image = s.Image
+		}
+		if result.Params == nil {
+			result.Params = s.Params
+		}
+	}
+	return result
+}
+
+// The args after `--` on the `tilt up` command line: the Tiltfile args,
+// or the resources to run.
+func (s RepoSettings) TiltUpTrailingArgs() []string {
+	if len(s.Resources) > 0 {
+		return s.Resources
+	}
+	return s.TiltfileArgs
+}
@@ -0,0 +1,84 @@
+package ephconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRepoSettingsYAML(t *testing.T) {
+	a := &Allowlist{}
+	err := yaml.Unmarshal([]byte(`
+repos:
+- base: https://github.com/acme
+  names: [web]
+  settings:
+    defaultBranch: develop
+    defaultPath: deploy/Tiltfile
+    tiltArgs: ["--legacy=false"]
+    tiltfileArgs: ["--env", "preview"]
+    env:
+    - name: NODE_ENV
+      value: development
+    image: registry.acme.dev/tilt-upper:node18
+- base: https://github.com/acme
+  names: ["*"]
+  settings:
+    defaultBranch: main
+    resources: [api]
+`), a)
+	require.NoError(t, err)
+	require.NoError(t, a.Validate())
+
+	web := a.RepoSettings("https://github.com/acme/web")
+	assert.Equal(t, "develop", web.DefaultBranch)
+	assert.Equal(t, "deploy/Tiltfile", web.DefaultPath)
+	assert.Equal(t, []string{"--legacy=false"}, web.TiltArgs)
+	assert.Equal(t, []string{"--env", "preview"}, web.TiltUpTrailingArgs())
+	assert.Equal(t, []EnvVar{{Name: "NODE_ENV", Value: "development"}}, web.Env)
+	assert.Equal(t, "registry.acme.dev/tilt-upper:node18", web.Image)
+
+	api := a.RepoSettings("https://github.com/acme/api")
+	assert.Equal(t, "main", api.DefaultBranch)
+	assert.Equal(t, []string{"api"}, api.TiltUpTrailingArgs())
+	assert.Equal(t, "", api.Image)
+
+	assert.Equal(t, RepoSettings{}, a.RepoSettings("https://github.com/evil/web"))
+}
+
+func TestRepoSettingsValidate(t *testing.T) {
+	cases := []struct {
+		settings RepoSettings
+		msg      string
+	}{
+		{settings: RepoSettings{TiltArgs: []string{"--legacy=false"}}, msg: ""},
+		{settings: RepoSettings{TiltArgs: []string{"--file=other"}}, msg: "set by ephctrl"},
+		{settings: RepoSettings{TiltArgs: []string{"--host"}}, msg: "set by ephctrl"},
+		{settings: RepoSettings{TiltfileArgs: []string{"a\nb"}}, msg: "invalid arg"},
+		{settings: RepoSettings{TiltfileArgs: []string{"a"}, Resources: []string{"b"}}, msg: "both tiltfileArgs and resources"},
+		{settings: RepoSettings{Env: []EnvVar{{Name: "FOO", Value: "bar"}}}, msg: ""},
+		{settings: RepoSettings{Env: []EnvVar{{Name: "FOO-BAR"}}}, msg: "invalid env var name"},
+		{settings: RepoSettings{Env: []EnvVar{{Name: "TILT_UPPER_REPO"}}}, msg: "reserved"},
+		{settings: RepoSettings{DefaultBranch: "m x"}, msg: "defaultBranch"},
+		{settings: RepoSettings{DefaultPath: "../Tiltfile"}, msg: "defaultPath"},
+		{settings: RepoSettings{Image: "a b"}, msg: "invalid image"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestRepoSettingsValidate%d", i), func(t *testing.T) {
+			a := &Allowlist{Repos: []RepoRule{{Base: "https://github.com/acme", Names: []string{"web"}, Settings: c.settings}}}
+			err := a.Validate()
+			if c.msg == "" {
+				assert.NoError(t, err)
+			} else {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.msg)
+				}
+			}
+		})
+	}
+}
@@ -9,66 +9,157 @@ import (
 
 // Format of the Allowlist key in ephctrl-allowlist ConfigMap
 type Allowlist struct {
-	RepoBase string `json:"repoBase" yaml:"repoBase"`
+	// A single base and exact repo names. Kept for older allowlists:
+	// the same as the first rule in Repos.
+	RepoBase string `json:"repoBase,omitempty" yaml:"repoBase,omitempty"`
 
-	RepoNames []string `json:"repoNames" yaml:"repoNames"`
+	RepoNames []string `json:"repoNames,omitempty" yaml:"repoNames,omitempty"`
+
+	// Rules for which repos users may create envs for, across any number
+	// of hosts and orgs. A repo is allowed if any rule allows it,
+	// and no rule for its base denies it.
+	Repos []RepoRule `json:"repos,omitempty" yaml:"repos,omitempty"`
+
+	// Ports to expose from every env, in addition to the ports that Tilt links to.
+	// Useful for servers that Tilt port-forwards without a link, like databases.
+	ExtraPorts []ExtraPort `json:"extraPorts,omitempty" yaml:"extraPorts,omitempty"`
+
+	// Sizes that users can pick for their envs. The first is the default.
+	// If empty, envs don't request any resources.
+	Sizes []SizeClass `json:"sizes,omitempty" yaml:"sizes,omitempty"`
+
+	// If set, users must belong to one of these groups to create envs,
+	// and can only create the envs that their group allows.
+	Groups []GroupPolicy `json:"groups,omitempty" yaml:"groups,omitempty"`
 }
 
-type EnvSpec struct {
-	Repo   string
-	Branch string
-	Path   string
+// A port exposed from every env as a raw TCP or UDP endpoint.
+type ExtraPort struct {
+	Name string `json:"name" yaml:"name"`
+
+	Port int32 `json:"port" yaml:"port"`
+
+	// TCP or UDP. Defaults to TCP.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
 }
 
-// Validate the environment spec for anything that looks suspicious:
-// - The repo must match our allow list.
-// - The path must be a valid relative path.
-// - The branch must look like a reasonable branch name.
-func IsAllowed(allowlist *Allowlist, spec EnvSpec) error {
-	err := isRepoAllowed(allowlist, spec.Repo)
-	if err != nil {
-		return err
+// Check that the allowlist is well-formed.
+func (a *Allowlist) Validate() error {
+	for _, p := range a.ExtraPorts {
+		if p.Name == "" {
+			return fmt.Errorf("extraPorts: missing name for port %d", p.Port)
+		}
+		if p.Port <= 0 || p.Port > 65535 {
+			return fmt.Errorf("extraPorts: invalid port for %s: %d", p.Name, p.Port)
+		}
+		if p.Protocol != "" && p.Protocol != "TCP" && p.Protocol != "UDP" {
+			return fmt.Errorf("extraPorts: protocol for %s must be TCP or UDP, got %q", p.Name, p.Protocol)
+		}
 	}
-
-	err = isBranchAllowed(spec.Branch)
+	err := a.validateRepos()
 	if err != nil {
 		return err
 	}
+	return a.validateGroups()
+}
+
+type EnvSpec struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	Path   string `json:"path"`
+
+	// The size class of the env. Empty means the default size.
+	Size string `json:"size,omitempty"`
+
+	// Values for the Tiltfile args that the repo's params declare, by name.
+	Args map[string]string `json:"args,omitempty"`
 
-	return isPathAllowed(spec.Path)
+	// Values for the env vars that the repo's params declare, by name.
+	Env map[string]string `json:"env,omitempty"`
 }
 
-func isRepoAllowed(allowlist *Allowlist, repo string) error {
-	parts := strings.Split(repo, "/")
-	if len(parts) < 2 {
-		return fmt.Errorf("Forbidden: malformed repo: %s", repo)
+// Reads the spec from the env ConfigMap data.
+//
+// Args and env vars are stored one per key, like "arg.profile" and "env.NODE_ENV".
+func SpecFromData(data map[string]string) EnvSpec {
+	spec := EnvSpec{
+		Repo:   data["repo"],
+		Branch: data["branch"],
+		Path:   data["path"],
+		Size:   data["size"],
 	}
-
-	repoBase := strings.Join(parts[:len(parts)-1], "/")
-	repoName := parts[len(parts)-1]
-	if repoBase != allowlist.RepoBase {
-		return fmt.Errorf("Forbidden: unrecognized base: %s", repo)
+	for k, v := range data {
+		if name := strings.TrimPrefix(k, string(ParamKindArg)+"."); name != k {
+			if spec.Args == nil {
+				spec.Args = map[string]string{}
+			}
+			spec.Args[name] = v
+		} else if name := strings.TrimPrefix(k, string(ParamKindEnv)+"."); name != k {
+			if spec.Env == nil {
+				spec.Env = map[string]string{}
+			}
+			spec.Env[name] = v
+		}
 	}
+	return spec
+}
 
-	isAllowed := false
-	for _, n := range allowlist.RepoNames {
-		if n == repoName {
-			isAllowed = true
-		}
+// The env ConfigMap data for the spec. The inverse of SpecFromData.
+func (s EnvSpec) Data() map[string]string {
+	data := map[string]string{
+		"repo":   s.Repo,
+		"path":   s.Path,
+		"branch": s.Branch,
+	}
+	if s.Size != "" {
+		data["size"] = s.Size
+	}
+	for name, v := range s.Args {
+		data[fmt.Sprintf("%s.%s", ParamKindArg, name)] = v
 	}
+	for name, v := range s.Env {
+		data[fmt.Sprintf("%s.%s", ParamKindEnv, name)] = v
+	}
+	return data
+}
 
-	if !isAllowed {
-		return fmt.Errorf("Forbidden: unrecognized repo name: %s", repo)
+// Validate the environment spec for anything that looks suspicious:
+//   - The repo must match our allow list.
+//   - The path must be a valid relative path.
+//   - The branch must look like a reasonable branch name,
+//     and match the branches of a rule that allows the repo.
+//   - The size, if any, must be one of the allowlist sizes.
+//   - The args and env vars must match the params of the repo.
+//
+// Returns FieldErrors with every problem we find. Checks that depend on the repo,
+// or on a well-formed branch, are skipped if those are wrong.
+func IsAllowed(allowlist *Allowlist, spec EnvSpec) error {
+	var errs FieldErrors
+	repoErr := isRepoAllowed(allowlist, spec.Repo)
+	errs.add(repoErr)
+
+	branchErr := isBranchAllowed(spec.Branch)
+	errs.add(branchErr)
+	if repoErr == nil && branchErr == nil {
+		errs.add(isBranchAllowedForRepo(allowlist, spec.Repo, spec.Branch))
 	}
 
-	return nil
+	errs.add(isPathAllowed(spec.Path))
+
+	_, err := allowlist.Size(spec.Size)
+	errs.add(err)
+
+	if repoErr == nil {
+		errs.add(isParamsAllowed(allowlist, spec))
+	}
+	return errs.toError()
 }
 
 var branchRe = regexp.MustCompile("^[a-zA-Z][a-zA-Z_/0-9-]*$")
 
 func isBranchAllowed(branch string) error {
 	if !branchRe.MatchString(branch) {
-		return fmt.Errorf("Forbidden: malformed branch name")
+		return forbidden("branch", ReasonMalformed, "malformed branch name")
 	}
 	return nil
 }
@@ -77,13 +168,13 @@ var pathRe = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z_/0-9.-]*$")
 
 func isPathAllowed(path string) error {
 	if filepath.IsAbs(path) {
-		return fmt.Errorf("Forbidden: path must be relative")
+		return forbidden("path", ReasonMalformed, "path must be relative")
 	}
 	if strings.Contains(path, "..") {
-		return fmt.Errorf("Forbidden: no '..' references allowed in path")
+		return forbidden("path", ReasonMalformed, "no '..' references allowed in path")
 	}
 	if !pathRe.MatchString(path) {
-		return fmt.Errorf("Forbidden: malformed path")
+		return forbidden("path", ReasonMalformed, "malformed path")
 	}
 	return nil
 }
@@ -13,25 +13,82 @@ var allowlist = &Allowlist{
 }
 
 type allowedCase struct {
-	spec EnvSpec
-	msg  string
+	spec   EnvSpec
+	msg    string
+	field  string
+	reason Reason
+}
+
+// Checks the message of the error, and the field and reason of its first field error.
+func assertAllowed(t *testing.T, allowlist *Allowlist, c allowedCase) {
+	err := IsAllowed(allowlist, c.spec)
+	if c.msg == "" {
+		assert.NoError(t, err)
+		return
+	}
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), c.msg)
+		errs := AsFieldErrors(err)
+		if assert.NotEmpty(t, errs) {
+			assert.Equal(t, c.field, errs[0].Field)
+			assert.Equal(t, c.reason, errs[0].Reason)
+		}
+	}
 }
 
 func TestAllowed(t *testing.T) {
 	cases := []allowedCase{
-		{spec: EnvSpec{"tilt-dev/tilt-avatars", "main", "Tiltfile"}, msg: ""},
-		{spec: EnvSpec{"tilt-dev/tilt-avatars2", "main", "Tiltfile"}, msg: "unrecognized repo name"},
-		{spec: EnvSpec{"tilt-dev2/tilt-avatars", "main", "Tiltfile"}, msg: "unrecognized base"},
-		{spec: EnvSpec{"tilt-dev/tilt-avatars", "main", "/Tiltfile"}, msg: "path must be relative"},
-		{spec: EnvSpec{"tilt-dev/tilt-avatars", "main", "x/../../Tiltfile"}, msg: "no '..' references"},
-		{spec: EnvSpec{"tilt-dev/tilt-avatars", "m x", "Tiltfile"}, msg: "malformed branch"},
-		{spec: EnvSpec{"tilt-dev/tilt-avatars", "main", "Tilt file"}, msg: "malformed path"},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile"}, msg: ""},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars2", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized repo name", field: "repo", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "tilt-dev2/tilt-avatars", Branch: "main", Path: "Tiltfile"}, msg: "unrecognized base", field: "repo", reason: ReasonNotAllowed},
+		{spec: EnvSpec{Repo: "tilt-avatars", Branch: "main", Path: "Tiltfile"}, msg: "malformed repo", field: "repo", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "/Tiltfile"}, msg: "path must be relative", field: "path", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "x/../../Tiltfile"}, msg: "no '..' references", field: "path", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "m x", Path: "Tiltfile"}, msg: "malformed branch", field: "branch", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tilt file"}, msg: "malformed path", field: "path", reason: ReasonMalformed},
+		{spec: EnvSpec{Repo: "tilt-dev/tilt-avatars", Branch: "main", Path: "Tiltfile", Size: "huge"}, msg: "unrecognized size", field: "size", reason: ReasonUnknown},
 	}
 
 	for i, c := range cases {
 		c := c
 		t.Run(fmt.Sprintf("TestAllowed%d", i), func(t *testing.T) {
-			err := IsAllowed(allowlist, c.spec)
+			assertAllowed(t, allowlist, c)
+		})
+	}
+}
+
+func TestAllowedReportsEveryField(t *testing.T) {
+	err := IsAllowed(allowlist, EnvSpec{Repo: "tilt-dev/tilt", Branch: "m x", Path: "../Tiltfile", Size: "huge"})
+	assert.Equal(t, FieldErrors{
+		{Field: "repo", Reason: ReasonNotAllowed, Message: "unrecognized repo name: tilt-dev/tilt"},
+		{Field: "branch", Reason: ReasonMalformed, Message: "malformed branch name"},
+		{Field: "path", Reason: ReasonMalformed, Message: "no '..' references allowed in path"},
+		{Field: "size", Reason: ReasonUnknown, Message: "unrecognized size: huge"},
+	}, AsFieldErrors(err))
+	assert.Equal(t, "Forbidden: unrecognized repo name: tilt-dev/tilt; malformed branch name; "+
+		"no '..' references allowed in path; unrecognized size: huge", err.Error())
+	assert.Equal(t, "malformed branch name", AsFieldErrors(err).ByField()["branch"])
+
+	// Errors that aren't about the spec's fields have no field errors.
+	assert.Nil(t, AsFieldErrors(fmt.Errorf("Creating env: timeout")))
+}
+
+func TestAllowlistValidate(t *testing.T) {
+	cases := []struct {
+		port ExtraPort
+		msg  string
+	}{
+		{port: ExtraPort{Name: "db", Port: 5432}, msg: ""},
+		{port: ExtraPort{Name: "statsd", Port: 8125, Protocol: "UDP"}, msg: ""},
+		{port: ExtraPort{Port: 5432}, msg: "missing name"},
+		{port: ExtraPort{Name: "db", Port: 70000}, msg: "invalid port"},
+		{port: ExtraPort{Name: "db", Port: 5432, Protocol: "SCTP"}, msg: "must be TCP or UDP"},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestAllowlistValidate%d", i), func(t *testing.T) {
+			err := (&Allowlist{ExtraPorts: []ExtraPort{c.port}}).Validate()
 			if c.msg == "" {
 				assert.NoError(t, err)
 			} else {
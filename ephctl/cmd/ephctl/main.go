@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephctl/pkg/tunnel"
+)
+
+var namespace = flag.String(
+	"namespace", "",
+	"Namespace where the ephemerator runs. Defaults to the namespace of the current kubeconfig context.")
+
+var kubeconfig = flag.String(
+	"kubeconfig", "",
+	"Path to the kubeconfig file. Defaults to the usual kubectl lookup.")
+
+const usage = `ephctl - command-line access to ephemeral environments
+
+Usage:
+  ephctl [flags] ports ENV
+      List the ports of an env.
+  ephctl [flags] port-forward ENV PORT [LOCAL_PORT]
+      Forward a local port to an env port, by name or number.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		fatalf("kubernetes connection setup failed: %v", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fatalf("kubernetes connection setup failed: %v", err)
+	}
+
+	ns := *namespace
+	if ns == "" {
+		ns, _, err = clientConfig.Namespace()
+		if err != nil {
+			fatalf("kubernetes connection setup failed: %v", err)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	client := tunnel.NewClient(config, clientset, ns)
+	switch args[0] {
+	case "ports":
+		err = ports(ctx, client, args[1])
+	case "port-forward":
+		err = portForward(ctx, client, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func ports(ctx context.Context, client *tunnel.Client, envName string) error {
+	svc, err := client.Service(ctx, envName)
+	if err != nil {
+		return err
+	}
+
+	for _, port := range svc.Spec.Ports {
+		protocol := "http"
+		if port.AppProtocol != nil {
+			protocol = *port.AppProtocol
+		}
+		via := "gateway"
+		if !ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) {
+			via = "port-forward"
+			if port.Protocol == v1.ProtocolUDP {
+				via = "unavailable (UDP)"
+			}
+		}
+		fmt.Printf("%-16s %-6d %-10s %s\n", port.Name, port.Port, protocol, via)
+	}
+	return nil
+}
+
+func portForward(ctx context.Context, client *tunnel.Client, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	localPort := 0
+	if len(args) == 3 {
+		var err error
+		localPort, err = strconv.Atoi(args[2])
+		if err != nil || localPort <= 0 || localPort > 65535 {
+			return fmt.Errorf("invalid local port: %s", args[2])
+		}
+	}
+
+	ready := make(chan struct{})
+	go func() {
+		select {
+		case <-ready:
+			fmt.Printf("Forwarding to env %s port %s. Press Ctrl-C to stop.\n", args[0], args[1])
+		case <-ctx.Done():
+		}
+	}()
+	return client.PortForward(ctx, args[0], args[1], int32(localPort), ready, os.Stdout, os.Stderr)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ephctl: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Opens local tunnels to env ports with the Kubernetes port-forward API.
+//
+// This is how users reach ports that the gateway can't route,
+// like databases or gRPC servers.
+type Client struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+	namespace string
+}
+
+func NewClient(config *rest.Config, clientset kubernetes.Interface, namespace string) *Client {
+	return &Client{
+		config:    config,
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+// Fetch the Service for an env.
+func (c *Client) Service(ctx context.Context, envName string) (*v1.Service, error) {
+	svc, err := c.clientset.CoreV1().Services(c.namespace).Get(ctx, envName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fetching env %s: %v", envName, err)
+	}
+	if svc.Labels[ephconfig.LabelAppKey] != ephconfig.LabelAppValueEphemerator ||
+		svc.Labels[ephconfig.LabelNameKey] != ephconfig.LabelNameValueEphrunner {
+		return nil, fmt.Errorf("fetching env %s: not an env service", envName)
+	}
+	return svc, nil
+}
+
+// Find a Service port by name or number.
+//
+// Only TCP ports can be forwarded.
+func ResolvePort(svc *v1.Service, portSpec string) (v1.ServicePort, error) {
+	number, err := strconv.Atoi(portSpec)
+	isNumber := err == nil
+
+	for _, port := range svc.Spec.Ports {
+		if port.Name != portSpec && (!isNumber || int(port.Port) != number) {
+			continue
+		}
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			// A service may serve the same port number over TCP and UDP.
+			if isNumber {
+				continue
+			}
+			return v1.ServicePort{}, fmt.Errorf("port %s is %s, but only TCP ports can be forwarded", portSpec, port.Protocol)
+		}
+		return port, nil
+	}
+	return v1.ServicePort{}, fmt.Errorf("env %s has no TCP port %s", svc.Name, portSpec)
+}
+
+// The port on the env pod that serves a Service port.
+func targetPort(port v1.ServicePort) int32 {
+	if port.TargetPort.IntVal != 0 {
+		return port.TargetPort.IntVal
+	}
+	return port.Port
+}
+
+// Forward a local port to an env port, until the context is done.
+//
+// If localPort is 0, uses the same port number as the env.
+// Closes ready once the tunnel is listening.
+func (c *Client) PortForward(ctx context.Context, envName, portSpec string, localPort int32, ready chan struct{}, out, errOut io.Writer) error {
+	svc, err := c.Service(ctx, envName)
+	if err != nil {
+		return err
+	}
+
+	port, err := ResolvePort(svc, portSpec)
+	if err != nil {
+		return err
+	}
+	if localPort == 0 {
+		localPort = port.Port
+	}
+
+	// The env pod has the same name as the env.
+	pod, err := c.clientset.CoreV1().Pods(c.namespace).Get(ctx, envName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("fetching env %s: %v", envName, err)
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return fmt.Errorf("env %s is not running (phase: %s)", envName, pod.Status.Phase)
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(c.config)
+	if err != nil {
+		return err
+	}
+
+	url := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
+
+	fw, err := portforward.NewOnAddresses(dialer,
+		[]string{"127.0.0.1"},
+		[]string{fmt.Sprintf("%d:%d", localPort, targetPort(port))},
+		ctx.Done(), ready, out, errOut)
+	if err != nil {
+		return err
+	}
+	return fw.ForwardPorts()
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolvePort(t *testing.T) {
+	postgres := "postgres"
+	udp := "udp"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nick"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000},
+				{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432, AppProtocol: &postgres},
+				{Name: "dns", Protocol: v1.ProtocolUDP, Port: 53, AppProtocol: &udp},
+				{Name: "dns-tcp", Protocol: v1.ProtocolTCP, Port: 53},
+			},
+		},
+	}
+
+	cases := []struct {
+		spec string
+		name string
+		msg  string
+	}{
+		{spec: "db", name: "db"},
+		{spec: "5432", name: "db"},
+		{spec: "web", name: "web"},
+		{spec: "53", name: "dns-tcp"},
+		{spec: "dns", msg: "only TCP ports can be forwarded"},
+		{spec: "9000", msg: "env nick has no TCP port 9000"},
+		{spec: "cache", msg: "env nick has no TCP port cache"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			port, err := ResolvePort(svc, c.spec)
+			if c.msg == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, c.name, port.Name)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.msg)
+			}
+		})
+	}
+}
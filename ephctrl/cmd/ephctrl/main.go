@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephconfig/live"
 	"github.com/tilt-dev/ephemerator/ephctrl/pkg/env"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	gatewayv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
 )
 
 func init() {
@@ -28,6 +35,11 @@ func main() {
 		l.Error(err, "scheme setup failed")
 		os.Exit(1)
 	}
+	err = gatewayv1alpha2.AddToScheme(s)
+	if err != nil {
+		l.Error(err, "scheme setup failed")
+		os.Exit(1)
+	}
 
 	timeout := 15 * time.Second
 	mgr, err := ctrl.NewManager(config.GetConfigOrDie(), ctrl.Options{
@@ -46,19 +58,57 @@ func main() {
 		os.Exit(1)
 	}
 
-	allowlist, err := ephconfig.ReadAllowlist()
+	initialConfig, err := ephconfig.ReadConfig()
+	if err != nil {
+		l.Error(err, "controller setup failed")
+		os.Exit(1)
+	}
+
+	// Start with the config from env vars, then follow edits to the ConfigMap.
+	liveConfig := ephconfig.NewLiveConfig(initialConfig)
+	err = metrics.Registry.Register(live.NewCollector(liveConfig, "ephctrl"))
+	if err != nil {
+		l.Error(err, "controller setup failed")
+		os.Exit(1)
+	}
+
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		l.Error(err, "controller setup failed")
+		os.Exit(1)
+	}
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		live.Watch(log.IntoContext(ctx, l.WithName("config")), liveConfig, clientset, os.Getenv("NAMESPACE"))
+		return nil
+	}))
+	if err != nil {
+		l.Error(err, "controller setup failed")
+		os.Exit(1)
+	}
+	l.Info("loaded config", "version", liveConfig.Version())
+
+	gatewayTLS, err := ephconfig.ReadGatewayTLS()
 	if err != nil {
 		l.Error(err, "controller setup failed")
 		os.Exit(1)
 	}
 
-	gatewayHost, err := ephconfig.ReadGatewayHost()
+	notifiers, err := notify.ReadNotifiers()
+	if err != nil {
+		l.Error(err, "controller setup failed")
+		os.Exit(1)
+	}
+	notifier := notify.NewDispatcher(notifiers...)
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		notifier.Run(ctx)
+		return nil
+	}))
 	if err != nil {
 		l.Error(err, "controller setup failed")
 		os.Exit(1)
 	}
 
-	r, err := env.NewReconciler(mgr, allowlist)
+	r, err := env.NewReconciler(mgr, mgr.GetEventRecorderFor(ephconfig.EventComponent), liveConfig, notifier, gatewayTLS)
 	if err != nil {
 		l.Error(err, "controller setup failed")
 		os.Exit(1)
@@ -70,13 +120,44 @@ func main() {
 		os.Exit(1)
 	}
 
-	gr := env.NewGatewayReconciler(mgr, gatewayHost)
-	err = gr.AddToManager(mgr)
+	gatewayBackend, err := ephconfig.ReadGatewayBackend()
 	if err != nil {
 		l.Error(err, "controller setup failed")
 		os.Exit(1)
 	}
 
+	switch gatewayBackend {
+	case ephconfig.GatewayBackendGatewayAPI:
+		parent, err := ephconfig.ReadGatewayParent()
+		if err != nil {
+			l.Error(err, "controller setup failed")
+			os.Exit(1)
+		}
+
+		hr := env.NewHTTPRouteReconciler(mgr, liveConfig, parent)
+		err = hr.AddToManager(mgr)
+		if err != nil {
+			l.Error(err, "controller setup failed")
+			os.Exit(1)
+		}
+	case ephconfig.GatewayBackendProxy:
+		l.Info("gateway routing is handled by the ephgateway proxy")
+	case ephconfig.GatewayBackendIngressPerEnv:
+		er := env.NewEnvIngressReconciler(mgr, liveConfig, gatewayTLS)
+		err = er.AddToManager(mgr)
+		if err != nil {
+			l.Error(err, "controller setup failed")
+			os.Exit(1)
+		}
+	default:
+		gr := env.NewGatewayReconciler(mgr, mgr.GetEventRecorderFor(ephconfig.EventComponent), liveConfig, gatewayTLS)
+		err = gr.AddToManager(mgr)
+		if err != nil {
+			l.Error(err, "controller setup failed")
+			os.Exit(1)
+		}
+	}
+
 	l.Info("starting manager")
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
 		l.Error(err, "manager start failed")
@@ -0,0 +1,146 @@
+package env
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The tilt-upper entrypoint writes the pid of `tilt up` here,
+// and restarts `tilt up` whenever it exits.
+const tiltUpPidFile = "/tmp/tilt-up.pid"
+
+// The maximum length of command output we copy into the status annotation.
+const maxActionErrorLen = 512
+
+// Map an action request to the command we exec in the tilt-upper container.
+//
+// This is the complete list of commands that users can run in their env.
+// The request must already be validated by ephconfig.IsActionAllowed.
+func actionCommand(req ephconfig.ActionRequest) ([]string, error) {
+	switch req.Action {
+	case ephconfig.ActionTrigger:
+		return []string{"tilt", "trigger", req.Resource}, nil
+	case ephconfig.ActionEnable:
+		return []string{"tilt", "enable", req.Resource}, nil
+	case ephconfig.ActionDisable:
+		return []string{"tilt", "disable", req.Resource}, nil
+	case ephconfig.ActionRestart:
+		return []string{"sh", "-c", fmt.Sprintf(`kill "$(cat %s)"`, tiltUpPidFile)}, nil
+	}
+	return nil, fmt.Errorf("unrecognized action: %s", req.Action)
+}
+
+// If the configmap has an action request that we haven't run yet,
+// run it in the pod and record the result on the configmap.
+//
+// Actions like restart aren't idempotent, so we claim the request with a
+// running status before we run it. If we can't record the result afterwards,
+// the request stays claimed rather than running again.
+func (r *Reconciler) maybeRunAction(ctx context.Context, cm *v1.ConfigMap, pod *v1.Pod) error {
+	if cm.Name == "" || !isPodReady(pod) {
+		return nil
+	}
+
+	log := log.FromContext(ctx)
+	var req ephconfig.ActionRequest
+	ok, err := ephconfig.ParseAnnotation(cm.Annotations[ephconfig.AnnotationActionRequest], &req)
+	if err != nil {
+		log.Error(err, "ignoring malformed action request")
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	var current ephconfig.ActionStatus
+	_, _ = ephconfig.ParseAnnotation(cm.Annotations[ephconfig.AnnotationActionStatus], &current)
+	if current.ID == req.ID {
+		return nil
+	}
+
+	update := cm.DeepCopy()
+	err = r.setActionStatus(ctx, update, ephconfig.ActionStatus{
+		ID:       req.ID,
+		Action:   req.Action,
+		Resource: req.Resource,
+		Time:     time.Now().Format(time.RFC3339),
+		Running:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("claiming action: %w", err)
+	}
+
+	actionErr := r.runAction(ctx, pod, req)
+
+	// Every action leaves an audit trail in the controller logs.
+	auditLog := log.WithValues(
+		"env", cm.Name,
+		"user", req.User,
+		"action", req.Action,
+		"resource", req.Resource,
+		"id", req.ID)
+	status := ephconfig.ActionStatus{
+		ID:       req.ID,
+		Action:   req.Action,
+		Resource: req.Resource,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+	if actionErr != nil {
+		auditLog.Info("action failed", "error", actionErr.Error())
+		status.Error = actionErr.Error()
+	} else {
+		auditLog.Info("action succeeded")
+	}
+
+	return r.setActionStatus(ctx, update, status)
+}
+
+// Record the status of an action on the configmap.
+func (r *Reconciler) setActionStatus(ctx context.Context, cm *v1.ConfigMap, status ephconfig.ActionStatus) error {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[ephconfig.AnnotationActionStatus] = string(content)
+	return r.client().Update(ctx, cm)
+}
+
+// Run a single allowlisted action in the pod.
+func (r *Reconciler) runAction(ctx context.Context, pod *v1.Pod, req ephconfig.ActionRequest) error {
+	err := ephconfig.IsActionAllowed(req)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := actionCommand(req)
+	if err != nil {
+		return err
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	err = r.exec(ctx, pod, cmd, ioutil.Discard, stderr)
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxActionErrorLen {
+			msg = msg[:maxActionErrorLen]
+		}
+		if msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package env
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newActionFixture(t *testing.T, status string) (*Reconciler, *v1.ConfigMap, *v1.Pod) {
+	annotations := map[string]string{
+		ephconfig.AnnotationActionRequest: `{"id":"2","action":"restart"}`,
+	}
+	if status != "" {
+		annotations[ephconfig.AnnotationActionStatus] = status
+	}
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default", Annotations: annotations}}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+
+	// The reconciler has no clientset, so running the action would panic.
+	r := &Reconciler{cluster: fakeCluster{client: fake.NewClientBuilder().WithObjects(cm).Build()}}
+	current := &v1.ConfigMap{}
+	require.NoError(t, r.client().Get(context.Background(), client.ObjectKeyFromObject(cm), current))
+	return r, current, pod
+}
+
+func TestActionAlreadyClaimed(t *testing.T) {
+	for _, status := range []string{
+		`{"id":"2","action":"restart","time":"now","running":true}`,
+		`{"id":"2","action":"restart","time":"now"}`,
+	} {
+		r, cm, pod := newActionFixture(t, status)
+		assert.NoError(t, r.maybeRunAction(context.Background(), cm, pod))
+	}
+}
+
+func TestActionNotRunIfClaimFails(t *testing.T) {
+	r, cm, pod := newActionFixture(t, `{"id":"1","action":"restart","time":"now"}`)
+
+	// Someone else updated the configmap since we read it.
+	stale := cm.DeepCopy()
+	cm.Labels = map[string]string{"touched": "true"}
+	require.NoError(t, r.client().Update(context.Background(), cm))
+
+	err := r.maybeRunAction(context.Background(), stale, pod)
+	require.Error(t, err)
+	assert.True(t, apierrors.IsConflict(err), err.Error())
+
+	current := &v1.ConfigMap{}
+	require.NoError(t, r.client().Get(context.Background(), client.ObjectKeyFromObject(cm), current))
+	assert.Equal(t, `{"id":"1","action":"restart","time":"now"}`, current.Annotations[ephconfig.AnnotationActionStatus])
+}
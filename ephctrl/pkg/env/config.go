@@ -0,0 +1,54 @@
+package env
+
+import (
+	"context"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Whether the reconciler needs to look at its objects again after a config change.
+type configFilter func(old, new *ephconfig.Config) bool
+
+func anyConfigChange(old, new *ephconfig.Config) bool {
+	return true
+}
+
+func gatewayHostChange(old, new *ephconfig.Config) bool {
+	return old.GatewayHost != new.GatewayHost
+}
+
+// A source that re-reconciles the objects that match the labels
+// when the ephconfig ConfigMap changes, because what we made
+// from the old config (e.g., routes for the old gateway host) is stale.
+func configChangeSource(cluster Cluster, config *ephconfig.LiveConfig, filter configFilter,
+	newList func() client.ObjectList, labels client.MatchingLabels) source.Source {
+	ch := make(chan event.GenericEvent)
+	config.OnChange(func(old, new *ephconfig.Config) {
+		if !filter(old, new) {
+			return
+		}
+
+		// The controller may not have started yet, so don't block the watch.
+		go func() {
+			list := newList()
+			err := cluster.GetClient().List(context.Background(), list, labels)
+			if err != nil {
+				log.Log.Error(err, "listing objects after config change", "version", new.Version)
+				return
+			}
+			_ = meta.EachListItem(list, func(obj runtime.Object) error {
+				if cobj, ok := obj.(client.Object); ok {
+					ch <- event.GenericEvent{Object: cobj}
+				}
+				return nil
+			})
+		}()
+	})
+	return &source.Channel{Source: ch}
+}
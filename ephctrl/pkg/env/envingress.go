@@ -0,0 +1,273 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// The per-env Ingresses copy their settings from the gateway Ingress
+// with this name, in the same namespace as the env.
+const templateIngressName = "ephgateway"
+
+// Annotations on the template that only make sense on the template itself.
+//
+// cert-manager annotations would let cert-manager take over the template's
+// TLS secrets from env Ingresses, so we only set our own.
+var skipTemplateAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"meta.helm.sh/",
+	"cert-manager.io/",
+}
+
+// Makes sure that every environment has its own Ingress.
+//
+// An alternative to the GatewayReconciler, which rewrites a single shared Ingress.
+// Each env's Ingress is built from the env Service, and owned by the env ConfigMap,
+// like the env's Pod and Service. So updating one env doesn't touch any other env,
+// and it's cleaned up when the env is deleted.
+type EnvIngressReconciler struct {
+	cluster Cluster
+	config  *ephconfig.LiveConfig
+	tls     ephconfig.GatewayTLS
+}
+
+func NewEnvIngressReconciler(cluster Cluster, config *ephconfig.LiveConfig, tls ephconfig.GatewayTLS) *EnvIngressReconciler {
+	return &EnvIngressReconciler{
+		cluster: cluster,
+		config:  config,
+		tls:     tls,
+	}
+}
+
+func (r *EnvIngressReconciler) AddToManager(mgr ctrl.Manager) error {
+	svcLS := metav1.SetAsLabelSelector(labels.Set{appKey: appValue, nameKey: nameValue})
+	svcPred, err := predicate.LabelSelectorPredicate(*svcLS)
+	if err != nil {
+		return err
+	}
+
+	ingressLS := metav1.SetAsLabelSelector(labels.Set{appKey: appValue, nameKey: nameIngressValue})
+	ingressPred, err := predicate.LabelSelectorPredicate(*ingressLS)
+	if err != nil {
+		return err
+	}
+
+	templateLS := metav1.SetAsLabelSelector(labels.Set{appKey: appValue, nameKey: nameGatewayValue})
+	templatePred, err := predicate.LabelSelectorPredicate(*templateLS)
+	if err != nil {
+		return err
+	}
+
+	configChanges := configChangeSource(r.cluster, r.config, gatewayHostChange,
+		func() client.ObjectList { return &v1.ServiceList{} },
+		client.MatchingLabels{appKey: appValue, nameKey: nameValue})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1.Service{}, builder.WithPredicates(svcPred)).
+		Watches(&source.Kind{Type: &networkingv1.Ingress{}},
+			&handler.EnqueueRequestForOwner{OwnerType: &v1.ConfigMap{}, IsController: true},
+			builder.WithPredicates(ingressPred)).
+		Watches(&source.Kind{Type: &networkingv1.Ingress{}},
+			handler.EnqueueRequestsFromMapFunc(r.templateToServices),
+			builder.WithPredicates(templatePred)).
+		Watches(configChanges, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
+
+func (r *EnvIngressReconciler) client() client.Client {
+	return r.cluster.GetClient()
+}
+
+func (r *EnvIngressReconciler) gatewayHost() string {
+	return r.config.GatewayHost()
+}
+
+// When the template changes, re-sync every env in its namespace.
+func (r *EnvIngressReconciler) templateToServices(obj client.Object) []reconcile.Request {
+	if obj.GetName() != templateIngressName {
+		return nil
+	}
+
+	var list v1.ServiceList
+	err := r.client().List(context.Background(), &list,
+		client.InNamespace(obj.GetNamespace()),
+		client.MatchingLabels{appKey: appValue, nameKey: nameValue})
+	if err != nil {
+		return nil
+	}
+
+	reqs := []reconcile.Request{}
+	for _, svc := range list.Items {
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name},
+		})
+	}
+	return reqs
+}
+
+// Make sure the env's ingress matches its service.
+func (r *EnvIngressReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log := log.FromContext(ctx)
+	log.Info("reconciling env ingress")
+
+	nn := req.NamespacedName
+
+	svc := &v1.Service{}
+	err := r.client().Get(ctx, nn, svc)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) || svc.DeletionTimestamp != nil {
+		// The ingress is garbage-collected with the env.
+		return reconcile.Result{}, nil
+	}
+
+	if svc.Labels[appKey] != appValue || svc.Labels[nameKey] != nameValue {
+		// If the labels don't match, bail out.
+		return reconcile.Result{}, fmt.Errorf("Cannot touch conflicting service")
+	}
+
+	cm := &v1.ConfigMap{}
+	err = r.client().Get(ctx, nn, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	if apierrors.IsNotFound(err) || cm.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+
+	template := &networkingv1.Ingress{}
+	err = r.client().Get(ctx, types.NamespacedName{Namespace: svc.Namespace, Name: templateIngressName}, template)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("fetching template ingress: %v", err)
+	}
+
+	desired, err := r.desiredIngress(template, cm, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	current := &networkingv1.Ingress{}
+	err = r.client().Get(ctx, nn, current)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) {
+		log.Info("creating env ingress")
+		return reconcile.Result{}, r.client().Create(ctx, desired)
+	}
+
+	if !metav1.IsControlledBy(current, cm) {
+		return reconcile.Result{}, fmt.Errorf("Cannot touch conflicting ingress")
+	}
+
+	if equality.Semantic.DeepEqual(current.Spec, desired.Spec) &&
+		equality.Semantic.DeepEqual(current.Annotations, desired.Annotations) &&
+		equality.Semantic.DeepEqual(current.OwnerReferences, desired.OwnerReferences) {
+		return reconcile.Result{}, nil
+	}
+
+	log.Info(fmt.Sprintf("updating env ingress with %d hosts", len(desired.Spec.Rules)))
+	update := current.DeepCopy()
+	update.Annotations = desired.Annotations
+	update.OwnerReferences = desired.OwnerReferences
+	update.Spec = desired.Spec
+	return reconcile.Result{}, r.client().Update(ctx, update)
+}
+
+// Build the ingress for an env, copying the annotations and ingress class from the template.
+//
+// If the gateway TLS settings are empty, copies the TLS secrets from the template too.
+func (r *EnvIngressReconciler) desiredIngress(template *networkingv1.Ingress, cm *v1.ConfigMap, svc *v1.Service) (*networkingv1.Ingress, error) {
+	annotations := map[string]string{}
+	for k, v := range template.Annotations {
+		if shouldCopyTemplateAnnotation(k) {
+			annotations[k] = v
+		}
+	}
+
+	rules := []networkingv1.IngressRule{}
+	hosts := []string{}
+	seen := make(map[string]bool)
+	for _, port := range svc.Spec.Ports {
+		if !isRoutablePort(port) {
+			continue
+		}
+		for _, host := range ephconfig.PortHosts(port.Name, port.Port, svc.Name, r.gatewayHost()) {
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+			hosts = append(hosts, host)
+			rules = append(rules, serviceRule(host, svc.Name, port.Port))
+		}
+	}
+
+	var tls []networkingv1.IngressTLS
+	if r.tls.Enabled() {
+		tls = append(tls, *envTLS(r.tls, svc.Name, hosts))
+		if r.tls.CertIssuer != "" {
+			annotations[certIssuerKey] = r.tls.CertIssuer
+		}
+	} else {
+		for _, t := range template.Spec.TLS {
+			tls = append(tls, networkingv1.IngressTLS{
+				Hosts:      hosts,
+				SecretName: t.SecretName,
+			})
+		}
+	}
+
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+			Labels: map[string]string{
+				appKey:          appValue,
+				nameKey:         nameIngressValue,
+				ephOwnerNameKey: svc.Name,
+			},
+			Annotations: annotations,
+		},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: template.Spec.IngressClassName,
+			TLS:              tls,
+			Rules:            rules,
+		},
+	}
+
+	err := ctrl.SetControllerReference(cm, ing, r.cluster.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return ing, nil
+}
+
+func shouldCopyTemplateAnnotation(key string) bool {
+	for _, skip := range skipTemplateAnnotations {
+		if strings.HasPrefix(key, skip) {
+			return false
+		}
+	}
+	return true
+}
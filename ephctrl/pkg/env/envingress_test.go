@@ -0,0 +1,162 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func newEnvIngressFixture(tls ephconfig.GatewayTLS, objs ...client.Object) *EnvIngressReconciler {
+	c := fake.NewClientBuilder().WithObjects(objs...).Build()
+	return NewEnvIngressReconciler(fakeCluster{client: c}, ephconfig.StaticConfig(nil, "preview.localhost"), tls)
+}
+
+func envConfigMap(name string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID(name + "-cm-uid"),
+		},
+	}
+}
+
+func templateIngress(annotations map[string]string, tls ...networkingv1.IngressTLS) *networkingv1.Ingress {
+	class := "nginx"
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        templateIngressName,
+			Namespace:   "default",
+			Labels:      map[string]string{appKey: appValue, nameKey: nameGatewayValue},
+			Annotations: annotations,
+		},
+		Spec: networkingv1.IngressSpec{IngressClassName: &class, TLS: tls},
+	}
+}
+
+func TestEnvIngressAnnotations(t *testing.T) {
+	cases := []struct {
+		key  string
+		copy bool
+	}{
+		{key: "nginx.ingress.kubernetes.io/proxy-body-size", copy: true},
+		{key: "nginx.ingress.kubernetes.io/auth-url", copy: true},
+		{key: "kubectl.kubernetes.io/last-applied-configuration", copy: false},
+		{key: "meta.helm.sh/release-name", copy: false},
+		{key: "meta.helm.sh/release-namespace", copy: false},
+		{key: "cert-manager.io/cluster-issuer", copy: false},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestEnvIngressAnnotations%d", i), func(t *testing.T) {
+			r := newEnvIngressFixture(ephconfig.GatewayTLS{})
+			svc := envService("alice", v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000})
+			ing, err := r.desiredIngress(templateIngress(map[string]string{c.key: "x"}), envConfigMap("alice"), svc)
+			require.NoError(t, err)
+			_, ok := ing.Annotations[c.key]
+			assert.Equal(t, c.copy, ok)
+			assert.Equal(t, "nginx", *ing.Spec.IngressClassName)
+		})
+	}
+}
+
+func TestEnvIngressTLS(t *testing.T) {
+	hosts := []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"}
+	cases := []struct {
+		gatewayTLS  ephconfig.GatewayTLS
+		templateTLS []networkingv1.IngressTLS
+		expected    []networkingv1.IngressTLS
+	}{
+		{
+			gatewayTLS: ephconfig.GatewayTLS{},
+			expected:   nil,
+		},
+		{
+			// Without gateway TLS settings, each template secret covers the env hosts.
+			gatewayTLS:  ephconfig.GatewayTLS{},
+			templateTLS: []networkingv1.IngressTLS{{Hosts: []string{"preview.localhost"}, SecretName: "wildcard"}},
+			expected:    []networkingv1.IngressTLS{{Hosts: hosts, SecretName: "wildcard"}},
+		},
+		{
+			gatewayTLS:  ephconfig.GatewayTLS{WildcardSecretName: "preview-localhost"},
+			templateTLS: []networkingv1.IngressTLS{{Hosts: []string{"preview.localhost"}, SecretName: "other"}},
+			expected:    []networkingv1.IngressTLS{{Hosts: hosts, SecretName: "preview-localhost"}},
+		},
+		{
+			gatewayTLS: ephconfig.GatewayTLS{CertIssuer: "letsencrypt"},
+			expected:   []networkingv1.IngressTLS{{Hosts: hosts, SecretName: "alice-tls"}},
+		},
+	}
+
+	for i, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("TestEnvIngressTLS%d", i), func(t *testing.T) {
+			r := newEnvIngressFixture(c.gatewayTLS)
+			svc := envService("alice", v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000})
+			ing, err := r.desiredIngress(templateIngress(nil, c.templateTLS...), envConfigMap("alice"), svc)
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, ing.Spec.TLS)
+		})
+	}
+}
+
+func TestEnvIngressSkipsHTTPSPorts(t *testing.T) {
+	https := "https"
+	r := newEnvIngressFixture(ephconfig.GatewayTLS{})
+	svc := envService("alice",
+		v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000},
+		v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8443, AppProtocol: &https})
+	ing, err := r.desiredIngress(templateIngress(nil), envConfigMap("alice"), svc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(ing.Spec.Rules))
+}
+
+func TestEnvIngressReconcileOwner(t *testing.T) {
+	cm := envConfigMap("alice")
+	svc := envService("alice", v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000})
+
+	r := newEnvIngressFixture(ephconfig.GatewayTLS{}, cm, svc, templateIngress(nil))
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "alice"}}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	ing := &networkingv1.Ingress{}
+	require.NoError(t, r.client().Get(ctx, req.NamespacedName, ing))
+	assert.True(t, metav1.IsControlledBy(ing, cm))
+	assert.Equal(t, []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"}, ruleHosts(ing.Spec.Rules))
+
+	// A new port updates the ingress in place.
+	require.NoError(t, r.client().Get(ctx, req.NamespacedName, svc))
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8080})
+	require.NoError(t, r.client().Update(ctx, svc))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, r.client().Get(ctx, req.NamespacedName, ing))
+	assert.Len(t, ing.Spec.Rules, 4)
+
+	// Ingresses that ephctrl doesn't own are left alone.
+	other := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default", UID: "someone-else"}}
+	update := ing.DeepCopy()
+	require.NoError(t, ctrl.SetControllerReference(other, update, r.cluster.GetScheme()))
+	require.NoError(t, r.client().Update(ctx, update))
+	_, err = r.Reconcile(ctx, req)
+	assert.Error(t, err)
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/tilt-dev/ephemerator/ephconfig"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -24,19 +28,33 @@ import (
 )
 
 // Makes sure that the gateway has host mappings for every environment.
+//
+// Rules for hosts that look like env hosts (e.g., frontend---alice.preview.tilt.build)
+// are owned by ephctrl. All other rules are owned by the operator (e.g., the rule
+// for the dashboard), and are preserved in order. The operator can also claim
+// env-like hosts by listing them in the operator-hosts annotation.
 type GatewayReconciler struct {
-	cluster     Cluster
-	gatewayHost string
+	cluster  Cluster
+	recorder record.EventRecorder
+	config   *ephconfig.LiveConfig
+	tls      ephconfig.GatewayTLS
 
 	mu       sync.Mutex
 	gateways map[types.NamespacedName]bool
+
+	// The problems we've already warned about for each gateway, so that
+	// we only record events when they change, not on every reconcile.
+	warnings map[types.NamespacedName]map[string]bool
 }
 
-func NewGatewayReconciler(cluster Cluster, gatewayHost string) *GatewayReconciler {
+func NewGatewayReconciler(cluster Cluster, recorder record.EventRecorder, config *ephconfig.LiveConfig, tls ephconfig.GatewayTLS) *GatewayReconciler {
 	return &GatewayReconciler{
-		cluster:     cluster,
-		gatewayHost: gatewayHost,
-		gateways:    make(map[types.NamespacedName]bool),
+		cluster:  cluster,
+		recorder: recorder,
+		config:   config,
+		tls:      tls,
+		gateways: make(map[types.NamespacedName]bool),
+		warnings: make(map[types.NamespacedName]map[string]bool),
 	}
 }
 
@@ -64,9 +82,14 @@ func (r *GatewayReconciler) AddToManager(mgr ctrl.Manager) error {
 		return reqs
 	}
 
+	configChanges := configChangeSource(r.cluster, r.config, gatewayHostChange,
+		func() client.ObjectList { return &networkingv1.IngressList{} },
+		client.MatchingLabels{appKey: appValue, nameKey: nameGatewayValue})
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&networkingv1.Ingress{}, builder.WithPredicates(ingressPred)).
 		Watches(&source.Kind{Type: &v1.Service{}}, handler.EnqueueRequestsFromMapFunc(mapFunc), builder.WithPredicates(svcPred)).
+		Watches(configChanges, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
 
@@ -74,6 +97,10 @@ func (r *GatewayReconciler) client() client.Client {
 	return r.cluster.GetClient()
 }
 
+func (r *GatewayReconciler) gatewayHost() string {
+	return r.config.GatewayHost()
+}
+
 // Make sure the rules match
 func (r *GatewayReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	r.mu.Lock()
@@ -92,6 +119,7 @@ func (r *GatewayReconciler) Reconcile(ctx context.Context, req reconcile.Request
 
 	if apierrors.IsNotFound(err) {
 		delete(r.gateways, nn)
+		delete(r.warnings, nn)
 		return reconcile.Result{}, nil
 	}
 
@@ -107,11 +135,39 @@ func (r *GatewayReconciler) Reconcile(ctx context.Context, req reconcile.Request
 		return reconcile.Result{}, err
 	}
 
-	rules := r.desiredRules(ing, svcs)
+	warnings := make(map[string]bool)
+	if !r.hasDashboardRoute(ing) {
+		key := "MissingDashboardRule/" + r.gatewayHost()
+		warnings[key] = true
+		if !r.warnings[nn][key] {
+			r.recorder.Eventf(ing, v1.EventTypeWarning, "MissingDashboardRule",
+				"Gateway has no rule for host %s or default backend. The dashboard is unreachable.", r.gatewayHost())
+		}
+	}
+
+	rules, conflicts := r.desiredRules(ing, svcs)
+	gatewayRules.Set(float64(len(rules)))
+	for _, host := range conflicts {
+		key := "HostConflict/" + host
+		warnings[key] = true
+		if !r.warnings[nn][key] {
+			r.recorder.Eventf(ing, v1.EventTypeWarning, "HostConflict",
+				"Host %s is already routed by a rule that ephctrl doesn't own. Skipping env route.", host)
+		}
+	}
+	r.warnings[nn] = warnings
+
+	tls := r.desiredTLS(ing, rules)
+	err = r.syncCertificates(ctx, ing, tls)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("syncing certificates: %v", err)
+	}
 
-	if !equality.Semantic.DeepEqual(ing.Spec.Rules, rules) {
+	if !equality.Semantic.DeepEqual(ing.Spec.Rules, rules) ||
+		!equality.Semantic.DeepEqual(ing.Spec.TLS, tls) {
 		update := ing.DeepCopy()
 		update.Spec.Rules = rules
+		update.Spec.TLS = tls
 		err := r.client().Update(ctx, update)
 		if err != nil {
 			return reconcile.Result{}, err
@@ -122,40 +178,221 @@ func (r *GatewayReconciler) Reconcile(ctx context.Context, req reconcile.Request
 	return reconcile.Result{}, nil
 }
 
+// Returns true if the rule routes to an env, and so is owned by ephctrl.
+func (r *GatewayReconciler) isEnvRule(ingress *networkingv1.Ingress, rule networkingv1.IngressRule) bool {
+	for _, host := range strings.Split(ingress.Annotations[operatorHostsKey], ",") {
+		if strings.TrimSpace(host) == rule.Host {
+			return false
+		}
+	}
+	_, _, ok := ephconfig.ParseEndpointHost(rule.Host, r.gatewayHost())
+	return ok
+}
+
+// Returns true if the TLS entry covers env hosts, and so is owned by ephctrl.
+func (r *GatewayReconciler) isEnvTLS(ingress *networkingv1.Ingress, tls networkingv1.IngressTLS) bool {
+	for _, host := range tls.Hosts {
+		if r.isEnvRule(ingress, networkingv1.IngressRule{Host: host}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert the env rules into TLS entries, one per env.
+//
+// Preserves all the TLS entries owned by the operator.
+func (r *GatewayReconciler) desiredTLS(ingress *networkingv1.Ingress, rules []networkingv1.IngressRule) []networkingv1.IngressTLS {
+	var result []networkingv1.IngressTLS
+	for _, tls := range ingress.Spec.TLS {
+		if !r.isEnvTLS(ingress, tls) {
+			result = append(result, tls)
+		}
+	}
+
+	envs := []string{}
+	hostsByEnv := make(map[string][]string)
+	for _, rule := range rules {
+		if !r.isEnvRule(ingress, rule) {
+			continue
+		}
+		_, env, _ := ephconfig.ParseEndpointHost(rule.Host, r.gatewayHost())
+		if _, ok := hostsByEnv[env]; !ok {
+			envs = append(envs, env)
+		}
+		hostsByEnv[env] = append(hostsByEnv[env], rule.Host)
+	}
+
+	for _, env := range envs {
+		tls := envTLS(r.tls, env, hostsByEnv[env])
+		if tls != nil {
+			result = append(result, *tls)
+		}
+	}
+	return result
+}
+
+// Make sure there's a cert-manager Certificate for each env TLS entry,
+// and none for envs that are gone.
+//
+// Certificates are owned by the gateway Ingress. We leave alone
+// Certificates that we don't own, e.g., ones that cert-manager made
+// for an older version that annotated the gateway Ingress.
+func (r *GatewayReconciler) syncCertificates(ctx context.Context, ing *networkingv1.Ingress, tls []networkingv1.IngressTLS) error {
+	if r.tls.CertIssuer == "" {
+		return nil
+	}
+
+	desired := make(map[string]*unstructured.Unstructured)
+	for _, t := range tls {
+		if !r.isEnvTLS(ing, t) {
+			continue
+		}
+		_, env, _ := ephconfig.ParseEndpointHost(t.Hosts[0], r.gatewayHost())
+		cert := envCertificate(r.tls.CertIssuer, ing.Namespace, env, t)
+		err := ctrl.SetControllerReference(ing, cert, r.cluster.GetScheme())
+		if err != nil {
+			return err
+		}
+		desired[cert.GetName()] = cert
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(certificateGVK.GroupVersion().WithKind("CertificateList"))
+	err := r.client().List(ctx, list,
+		client.InNamespace(ing.Namespace),
+		client.MatchingLabels{appKey: appValue, nameKey: nameCertValue})
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*unstructured.Unstructured)
+	for i := range list.Items {
+		cert := &list.Items[i]
+		if !metav1.IsControlledBy(cert, ing) {
+			continue
+		}
+		current[cert.GetName()] = cert
+		if _, ok := desired[cert.GetName()]; !ok {
+			err := client.IgnoreNotFound(r.client().Delete(ctx, cert))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, cert := range desired {
+		existing, ok := current[name]
+		if !ok {
+			// If it already exists, someone else owns it.
+			err := r.client().Create(ctx, cert)
+			if err != nil && !apierrors.IsAlreadyExists(err) {
+				return err
+			}
+			continue
+		}
+		if equality.Semantic.DeepEqual(existing.Object["spec"], cert.Object["spec"]) {
+			continue
+		}
+		update := existing.DeepCopy()
+		update.Object["spec"] = cert.Object["spec"]
+		err := r.client().Update(ctx, update)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the ingress routes the gateway host somewhere (usually to ephdash).
+func (r *GatewayReconciler) hasDashboardRoute(ingress *networkingv1.Ingress) bool {
+	if ingress.Spec.DefaultBackend != nil {
+		return true
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == r.gatewayHost() || rule.Host == "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Convert the services into a set of ingress rules.
-func (r *GatewayReconciler) desiredRules(ingress *networkingv1.Ingress, svcs []v1.Service) []networkingv1.IngressRule {
-	rules := []networkingv1.IngressRule{
-		// Always preserve the first rule. That's the one that goes to ephdash.
-		ingress.Spec.Rules[0],
+//
+// Preserves all the rules owned by the operator, followed by the rules for each env.
+// Returns the rules, and any env hosts that conflict with operator rules.
+func (r *GatewayReconciler) desiredRules(ingress *networkingv1.Ingress, svcs []v1.Service) ([]networkingv1.IngressRule, []string) {
+	rules := []networkingv1.IngressRule{}
+	hosts := make(map[string]bool)
+	for _, rule := range ingress.Spec.Rules {
+		if r.isEnvRule(ingress, rule) {
+			continue
+		}
+		rules = append(rules, rule)
+		hosts[rule.Host] = true
 	}
-	prefix := networkingv1.PathTypePrefix
+
+	operatorHosts := make(map[string]bool, len(hosts))
+	for host := range hosts {
+		operatorHosts[host] = true
+	}
+
+	conflicts := []string{}
 	for _, svc := range svcs {
 		for _, port := range svc.Spec.Ports {
-			subdomain := fmt.Sprintf("%d", port.Port)
-			rules = append(rules, networkingv1.IngressRule{
-				Host: fmt.Sprintf("%s---%s.%s", subdomain, svc.Name, r.gatewayHost),
-				IngressRuleValue: networkingv1.IngressRuleValue{
-					HTTP: &networkingv1.HTTPIngressRuleValue{
-						Paths: []networkingv1.HTTPIngressPath{
-							{
-								Path:     "/",
-								PathType: &prefix,
-								Backend: networkingv1.IngressBackend{
-									Service: &networkingv1.IngressServiceBackend{
-										Name: svc.Name,
-										Port: networkingv1.ServiceBackendPort{
-											Number: port.Port,
-										},
-									},
+			if !isRoutablePort(port) {
+				continue
+			}
+			for _, host := range ephconfig.PortHosts(port.Name, port.Port, svc.Name, r.gatewayHost()) {
+				if operatorHosts[host] {
+					conflicts = append(conflicts, host)
+					continue
+				}
+				if hosts[host] {
+					// If two ports map to the same host, the first one wins.
+					continue
+				}
+				hosts[host] = true
+				rules = append(rules, serviceRule(host, svc.Name, port.Port))
+			}
+		}
+	}
+	return rules, conflicts
+}
+
+// Returns true if the Ingress and HTTPRoute backends can route to the port.
+//
+// They can't tell the ingress controller to connect over TLS, so
+// HTTPS ports are only reachable through the ephgateway proxy.
+func isRoutablePort(port v1.ServicePort) bool {
+	return ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) &&
+		!ephconfig.IsHTTPSPort(string(port.Protocol), port.AppProtocol)
+}
+
+// An ingress rule that routes all traffic on a host to the given service port.
+func serviceRule(host string, svcName string, port int32) networkingv1.IngressRule {
+	prefix := networkingv1.PathTypePrefix
+	return networkingv1.IngressRule{
+		Host: host,
+		IngressRuleValue: networkingv1.IngressRuleValue{
+			HTTP: &networkingv1.HTTPIngressRuleValue{
+				Paths: []networkingv1.HTTPIngressPath{
+					{
+						Path:     "/",
+						PathType: &prefix,
+						Backend: networkingv1.IngressBackend{
+							Service: &networkingv1.IngressServiceBackend{
+								Name: svcName,
+								Port: networkingv1.ServiceBackendPort{
+									Number: port,
 								},
 							},
 						},
 					},
 				},
-			})
-		}
+			},
+		},
 	}
-	return rules
 }
 
 // Fetch all the services that need ingress host names assigned.
@@ -0,0 +1,236 @@
+package env
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestDesiredRulesNoRules(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+	rules, conflicts := r.desiredRules(&networkingv1.Ingress{}, []v1.Service{svcWithPort("alice", "web", 8000)})
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(rules))
+}
+
+func TestDesiredRulesPreservesOperatorRules(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+	ing := &networkingv1.Ingress{
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{Host: "stale---bob.preview.localhost"},
+				{Host: "preview.localhost"},
+				{Host: "docs.preview.localhost"},
+			},
+		},
+	}
+	rules, conflicts := r.desiredRules(ing, []v1.Service{svcWithPort("alice", "web", 8000)})
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{
+		"preview.localhost",
+		"docs.preview.localhost",
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(rules))
+}
+
+func TestDesiredRulesOperatorHostConflict(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{operatorHostsKey: "web---alice.preview.localhost"},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{Host: "preview.localhost"},
+				{Host: "web---alice.preview.localhost"},
+			},
+		},
+	}
+	rules, conflicts := r.desiredRules(ing, []v1.Service{svcWithPort("alice", "web", 8000)})
+	assert.Equal(t, []string{"web---alice.preview.localhost"}, conflicts)
+	assert.Equal(t, []string{
+		"preview.localhost",
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(rules))
+}
+
+func TestDesiredRulesSkipsTunnelPorts(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+	svc := svcWithPort("alice", "web", 8000)
+	postgres := "postgres"
+	svc.Spec.Ports = append(svc.Spec.Ports,
+		v1.ServicePort{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432, AppProtocol: &postgres},
+		v1.ServicePort{Name: "statsd", Protocol: v1.ProtocolUDP, Port: 8125})
+	rules, conflicts := r.desiredRules(&networkingv1.Ingress{}, []v1.Service{svc})
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(rules))
+}
+
+func TestDesiredRulesSkipsHTTPSPorts(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+	svc := svcWithPort("alice", "web", 8000)
+	https := "https"
+	svc.Spec.Ports = append(svc.Spec.Ports,
+		v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8443, AppProtocol: &https})
+	rules, conflicts := r.desiredRules(&networkingv1.Ingress{}, []v1.Service{svc})
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, ruleHosts(rules))
+}
+
+func svcWithPort(name, portName string, port int32) v1.Service {
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Name: portName, Port: port}},
+		},
+	}
+}
+
+func ruleHosts(rules []networkingv1.IngressRule) []string {
+	result := []string{}
+	for _, rule := range rules {
+		result = append(result, rule.Host)
+	}
+	return result
+}
+
+func TestDesiredTLSWildcard(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"),
+		ephconfig.GatewayTLS{WildcardSecretName: "preview-localhost"})
+	ing := &networkingv1.Ingress{
+		Spec: networkingv1.IngressSpec{
+			TLS: []networkingv1.IngressTLS{
+				{SecretName: "preview-localhost"},
+				{Hosts: []string{"web---bob.preview.localhost"}, SecretName: "preview-localhost"},
+			},
+			Rules: []networkingv1.IngressRule{{Host: "preview.localhost"}},
+		},
+	}
+	rules, _ := r.desiredRules(ing, []v1.Service{svcWithPort("alice", "web", 8000)})
+	assert.Equal(t, []networkingv1.IngressTLS{
+		{SecretName: "preview-localhost"},
+		{
+			Hosts:      []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"},
+			SecretName: "preview-localhost",
+		},
+	}, r.desiredTLS(ing, rules))
+}
+
+func TestDesiredTLSCertIssuer(t *testing.T) {
+	r := NewGatewayReconciler(nil, record.NewFakeRecorder(10), ephconfig.StaticConfig(nil, "preview.localhost"),
+		ephconfig.GatewayTLS{CertIssuer: "letsencrypt"})
+	ing := &networkingv1.Ingress{}
+	rules, _ := r.desiredRules(ing, []v1.Service{svcWithPort("alice", "web", 8000)})
+	assert.Equal(t, []networkingv1.IngressTLS{
+		{
+			Hosts:      []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"},
+			SecretName: "alice-tls",
+		},
+	}, r.desiredTLS(ing, rules))
+}
+
+func TestGatewayWarningsOnlyOnChange(t *testing.T) {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ephgateway",
+			Namespace: "default",
+			Labels:    map[string]string{appKey: appValue, nameKey: nameGatewayValue},
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	c := fake.NewClientBuilder().WithObjects(ing).Build()
+	r := NewGatewayReconciler(fakeCluster{client: c}, recorder, ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{})
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "ephgateway"}}
+	for i := 0; i < 3; i++ {
+		_, err := r.Reconcile(ctx, req)
+		require.NoError(t, err)
+	}
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "MissingDashboardRule")
+
+	// Once the operator adds the rule, and removes it again, we warn again.
+	require.NoError(t, c.Get(ctx, req.NamespacedName, ing))
+	ing.Spec.Rules = []networkingv1.IngressRule{{Host: "preview.localhost"}}
+	require.NoError(t, c.Update(ctx, ing))
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	assert.Len(t, recorder.Events, 0)
+
+	require.NoError(t, c.Get(ctx, req.NamespacedName, ing))
+	ing.Spec.Rules = nil
+	require.NoError(t, c.Update(ctx, ing))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "MissingDashboardRule")
+}
+
+func TestGatewayCertificates(t *testing.T) {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ephgateway",
+			Namespace: "default",
+			UID:       "gateway-uid",
+			Labels:    map[string]string{appKey: appValue, nameKey: nameGatewayValue},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{Host: "preview.localhost"}},
+			TLS:   []networkingv1.IngressTLS{{Hosts: []string{"preview.localhost"}, SecretName: "operator-tls"}},
+		},
+	}
+	svc := envService("alice", v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000})
+	c := fake.NewClientBuilder().WithObjects(ing, svc).Build()
+	r := NewGatewayReconciler(fakeCluster{client: c}, record.NewFakeRecorder(10),
+		ephconfig.StaticConfig(nil, "preview.localhost"), ephconfig.GatewayTLS{CertIssuer: "letsencrypt"})
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "ephgateway"}}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The operator's TLS entry stays out of cert-manager's hands.
+	require.NoError(t, c.Get(ctx, req.NamespacedName, ing))
+	assert.NotContains(t, ing.Annotations, certIssuerKey)
+	assert.Equal(t, []string{"operator-tls", "alice-tls"}, []string{ing.Spec.TLS[0].SecretName, ing.Spec.TLS[1].SecretName})
+
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "alice-tls"}, cert))
+	dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+	assert.Equal(t, []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"}, dnsNames)
+	issuer, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name")
+	assert.Equal(t, "letsencrypt", issuer)
+	assert.True(t, metav1.IsControlledBy(cert, ing))
+
+	// When the env goes away, so does its certificate.
+	require.NoError(t, c.Delete(ctx, svc))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	err = c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "alice-tls"}, cert)
+	assert.True(t, apierrors.IsNotFound(err))
+}
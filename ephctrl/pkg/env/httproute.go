@@ -0,0 +1,306 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gatewayv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+)
+
+// Makes sure that every environment has Gateway API routes attached to the gateway.
+//
+// An alternative to the GatewayReconciler for clusters that use the Gateway API
+// instead of Ingress.
+//
+// Each env gets one route, with the hosts of all its HTTP ports, and a rule
+// per host that matches on the Host header. Envs with more hosts than a route
+// may have get more routes. The routes are owned by the env ConfigMap,
+// like the env's Pod and Service, so they're cleaned up when the env is deleted.
+//
+// TLS is terminated by the Gateway's listeners, so the gateway TLS settings
+// don't apply here.
+type HTTPRouteReconciler struct {
+	cluster Cluster
+	config  *ephconfig.LiveConfig
+	parent  ephconfig.GatewayParent
+}
+
+func NewHTTPRouteReconciler(cluster Cluster, config *ephconfig.LiveConfig, parent ephconfig.GatewayParent) *HTTPRouteReconciler {
+	return &HTTPRouteReconciler{
+		cluster: cluster,
+		config:  config,
+		parent:  parent,
+	}
+}
+
+func (r *HTTPRouteReconciler) AddToManager(mgr ctrl.Manager) error {
+	svcLS := metav1.SetAsLabelSelector(labels.Set{appKey: appValue, nameKey: nameValue})
+	svcPred, err := predicate.LabelSelectorPredicate(*svcLS)
+	if err != nil {
+		return err
+	}
+
+	routeLS := metav1.SetAsLabelSelector(labels.Set{appKey: appValue, nameKey: nameRouteValue})
+	routePred, err := predicate.LabelSelectorPredicate(*routeLS)
+	if err != nil {
+		return err
+	}
+
+	configChanges := configChangeSource(r.cluster, r.config, gatewayHostChange,
+		func() client.ObjectList { return &v1.ServiceList{} },
+		client.MatchingLabels{appKey: appValue, nameKey: nameValue})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1.Service{}, builder.WithPredicates(svcPred)).
+		Watches(&source.Kind{Type: &gatewayv1alpha2.HTTPRoute{}},
+			&handler.EnqueueRequestForOwner{OwnerType: &v1.ConfigMap{}, IsController: true},
+			builder.WithPredicates(routePred)).
+		Watches(configChanges, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
+
+func (r *HTTPRouteReconciler) client() client.Client {
+	return r.cluster.GetClient()
+}
+
+func (r *HTTPRouteReconciler) gatewayHost() string {
+	return r.config.GatewayHost()
+}
+
+// Make sure the routes match the service ports.
+func (r *HTTPRouteReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log := log.FromContext(ctx)
+	log.Info("reconciling routes")
+
+	nn := req.NamespacedName
+
+	svc := &v1.Service{}
+	err := r.client().Get(ctx, nn, svc)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	if apierrors.IsNotFound(err) || svc.DeletionTimestamp != nil {
+		// The routes are garbage-collected with the env.
+		return reconcile.Result{}, nil
+	}
+
+	if svc.Labels[appKey] != appValue || svc.Labels[nameKey] != nameValue {
+		// If the labels don't match, bail out.
+		return reconcile.Result{}, fmt.Errorf("Cannot touch conflicting service")
+	}
+
+	cm := &v1.ConfigMap{}
+	err = r.client().Get(ctx, nn, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	if apierrors.IsNotFound(err) || cm.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+
+	desired, err := r.desiredRoutes(cm, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	current, err := r.routes(ctx, cm)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	for _, route := range current {
+		route := route
+		if _, ok := desired[route.Name]; ok {
+			continue
+		}
+		log.Info(fmt.Sprintf("deleting route %s", route.Name))
+		err := client.IgnoreNotFound(r.client().Delete(ctx, &route))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	for name, route := range desired {
+		existing, ok := current[name]
+		if !ok {
+			log.Info(fmt.Sprintf("creating route %s", name))
+			err := r.client().Create(ctx, route)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			continue
+		}
+
+		if equality.Semantic.DeepEqual(existing.Spec, route.Spec) &&
+			equality.Semantic.DeepEqual(existing.OwnerReferences, route.OwnerReferences) {
+			continue
+		}
+
+		log.Info(fmt.Sprintf("updating route %s", name))
+		update := existing.DeepCopy()
+		update.OwnerReferences = route.OwnerReferences
+		update.Spec = route.Spec
+		err := r.client().Update(ctx, update)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// Convert the service ports into the env's routes, indexed by name.
+//
+// The routes have the hosts of every HTTP port, with a rule per host that
+// matches on the Host header. The first route is named after the env, and
+// the rest get a suffix, like "alice.2". Env names are DNS labels, so these
+// can't collide with another env's route. Returns no routes if the env has
+// no HTTP ports.
+func (r *HTTPRouteReconciler) desiredRoutes(cm *v1.ConfigMap, svc *v1.Service) (map[string]*gatewayv1alpha2.HTTPRoute, error) {
+	parentRef := gatewayv1alpha2.ParentRef{
+		Name: gatewayv1alpha2.ObjectName(r.parent.Name),
+	}
+	if r.parent.Namespace != "" {
+		ns := gatewayv1alpha2.Namespace(r.parent.Namespace)
+		parentRef.Namespace = &ns
+	}
+	if r.parent.SectionName != "" {
+		section := gatewayv1alpha2.SectionName(r.parent.SectionName)
+		parentRef.SectionName = &section
+	}
+
+	hostnames := []gatewayv1alpha2.Hostname{}
+	rules := []gatewayv1alpha2.HTTPRouteRule{}
+	seen := make(map[string]bool)
+	for _, port := range svc.Spec.Ports {
+		if !isRoutablePort(port) {
+			continue
+		}
+		for _, host := range ephconfig.PortHosts(port.Name, port.Port, svc.Name, r.gatewayHost()) {
+			if seen[host] {
+				// If two ports map to the same host, the first one wins.
+				continue
+			}
+			seen[host] = true
+			hostnames = append(hostnames, gatewayv1alpha2.Hostname(host))
+			rules = append(rules, hostRouteRule(host, svc.Name, port.Port))
+		}
+	}
+
+	result := make(map[string]*gatewayv1alpha2.HTTPRoute)
+	if len(rules) == 0 {
+		return result, nil
+	}
+
+	for i := 0; i < len(rules); i += maxRouteHosts {
+		end := i + maxRouteHosts
+		if end > len(rules) {
+			end = len(rules)
+		}
+		name := svc.Name
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", svc.Name, i/maxRouteHosts+1)
+		}
+		route := &gatewayv1alpha2.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: svc.Namespace,
+				Labels: map[string]string{
+					appKey:          appValue,
+					nameKey:         nameRouteValue,
+					ephOwnerNameKey: svc.Name,
+				},
+			},
+			Spec: gatewayv1alpha2.HTTPRouteSpec{
+				CommonRouteSpec: gatewayv1alpha2.CommonRouteSpec{
+					ParentRefs: []gatewayv1alpha2.ParentRef{parentRef},
+				},
+				Hostnames: hostnames[i:end],
+				Rules:     rules[i:end],
+			},
+		}
+
+		err := ctrl.SetControllerReference(cm, route, r.cluster.GetScheme())
+		if err != nil {
+			return nil, err
+		}
+		result[route.Name] = route
+	}
+	return result, nil
+}
+
+// The Gateway API limits routes to 16 hostnames and 16 rules,
+// so envs with more hosts get more routes.
+const maxRouteHosts = 16
+
+// A route rule that sends all traffic for a host to the given service port.
+func hostRouteRule(host string, svcName string, port int32) gatewayv1alpha2.HTTPRouteRule {
+	portNumber := gatewayv1alpha2.PortNumber(port)
+	pathType := gatewayv1alpha2.PathMatchPathPrefix
+	headerType := gatewayv1alpha2.HeaderMatchExact
+	path := "/"
+	return gatewayv1alpha2.HTTPRouteRule{
+		Matches: []gatewayv1alpha2.HTTPRouteMatch{
+			{
+				Path: &gatewayv1alpha2.HTTPPathMatch{
+					Type:  &pathType,
+					Value: &path,
+				},
+				Headers: []gatewayv1alpha2.HTTPHeaderMatch{
+					{
+						Type:  &headerType,
+						Name:  "Host",
+						Value: host,
+					},
+				},
+			},
+		},
+		BackendRefs: []gatewayv1alpha2.HTTPBackendRef{
+			{
+				BackendRef: gatewayv1alpha2.BackendRef{
+					BackendObjectReference: gatewayv1alpha2.BackendObjectReference{
+						Name: gatewayv1alpha2.ObjectName(svcName),
+						Port: &portNumber,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Fetch all the routes that belong to the given env, indexed by name.
+func (r *HTTPRouteReconciler) routes(ctx context.Context, cm *v1.ConfigMap) (map[string]gatewayv1alpha2.HTTPRoute, error) {
+	ls := labels.SelectorFromSet(labels.Set{appKey: appValue, nameKey: nameRouteValue, ephOwnerNameKey: cm.Name})
+	var list gatewayv1alpha2.HTTPRouteList
+	err := r.client().List(ctx, &list, &client.ListOptions{
+		Namespace:     cm.Namespace,
+		LabelSelector: ls,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]gatewayv1alpha2.HTTPRoute)
+	for _, route := range list.Items {
+		if !metav1.IsControlledBy(&route, cm) {
+			continue
+		}
+		result[route.Name] = route
+	}
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package env
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+)
+
+func newRouteFixture(t *testing.T, objs ...client.Object) *HTTPRouteReconciler {
+	s := runtime.NewScheme()
+	require.NoError(t, scheme.AddToScheme(s))
+	require.NoError(t, gatewayv1alpha2.AddToScheme(s))
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	return NewHTTPRouteReconciler(fakeCluster{client: c}, ephconfig.StaticConfig(nil, "preview.localhost"),
+		ephconfig.GatewayParent{Name: "eph", Namespace: "gateway"})
+}
+
+func envService(name string, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID(name + "-uid"),
+			Labels:    map[string]string{appKey: appValue, nameKey: nameValue},
+		},
+		Spec: v1.ServiceSpec{Ports: ports},
+	}
+}
+
+func routeHosts(route gatewayv1alpha2.HTTPRoute) ([]string, []string) {
+	hostnames := []string{}
+	for _, h := range route.Spec.Hostnames {
+		hostnames = append(hostnames, string(h))
+	}
+	ruleHosts := []string{}
+	for _, rule := range route.Spec.Rules {
+		ruleHosts = append(ruleHosts, rule.Matches[0].Headers[0].Value)
+	}
+	return hostnames, ruleHosts
+}
+
+func TestDesiredRoutesOnePerEnv(t *testing.T) {
+	udp := v1.ServicePort{Name: "statsd", Protocol: v1.ProtocolUDP, Port: 8125}
+	svc := envService("alice",
+		v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000},
+		v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8080},
+		udp)
+	r := newRouteFixture(t)
+
+	routes, err := r.desiredRoutes(envConfigMap("alice"), svc)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+
+	route := routes["alice"]
+	hostnames, ruleHosts := routeHosts(*route)
+	expected := []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+		"api---alice.preview.localhost",
+		"8080---alice.preview.localhost",
+	}
+	assert.Equal(t, expected, hostnames)
+	assert.Equal(t, expected, ruleHosts)
+	assert.Equal(t, gatewayv1alpha2.PortNumber(8080), *route.Spec.Rules[2].BackendRefs[0].Port)
+	assert.Equal(t, gatewayv1alpha2.ObjectName("eph"), route.Spec.ParentRefs[0].Name)
+	assert.True(t, metav1.IsControlledBy(route, envConfigMap("alice")))
+
+	routes, err = r.desiredRoutes(envConfigMap("bob"), envService("bob", udp))
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+}
+
+func TestDesiredRoutesSkipsHTTPSPorts(t *testing.T) {
+	https := "https"
+	svc := envService("alice",
+		v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000},
+		v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8443, AppProtocol: &https})
+	r := newRouteFixture(t)
+
+	routes, err := r.desiredRoutes(envConfigMap("alice"), svc)
+	require.NoError(t, err)
+	hostnames, _ := routeHosts(*routes["alice"])
+	assert.Equal(t, []string{
+		"web---alice.preview.localhost",
+		"8000---alice.preview.localhost",
+	}, hostnames)
+}
+
+func TestDesiredRoutesHostLimit(t *testing.T) {
+	svc := envService("alice")
+	for i := int32(0); i < 20; i++ {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Protocol: v1.ProtocolTCP, Port: 8000 + i})
+	}
+	r := newRouteFixture(t)
+
+	// Hosts past the limit go in another route.
+	routes, err := r.desiredRoutes(envConfigMap("alice"), svc)
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	hostnames, ruleHosts := routeHosts(*routes["alice"])
+	assert.Len(t, hostnames, maxRouteHosts)
+	assert.Equal(t, hostnames, ruleHosts)
+	assert.Equal(t, "8000---alice.preview.localhost", hostnames[0])
+
+	hostnames, ruleHosts = routeHosts(*routes["alice.2"])
+	assert.Len(t, hostnames, 20-maxRouteHosts)
+	assert.Equal(t, hostnames, ruleHosts)
+	assert.Equal(t, "8016---alice.preview.localhost", hostnames[0])
+	assert.True(t, metav1.IsControlledBy(routes["alice.2"], envConfigMap("alice")))
+}
+
+func TestHTTPRouteReconcile(t *testing.T) {
+	svc := envService("alice", v1.ServicePort{Name: "web", Protocol: v1.ProtocolTCP, Port: 8000})
+
+	// A route from when the env had more hosts than fit in one route.
+	stale := &gatewayv1alpha2.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "alice.2",
+			Namespace: "default",
+			Labels:    map[string]string{appKey: appValue, nameKey: nameRouteValue, ephOwnerNameKey: "alice"},
+		},
+	}
+	cm := envConfigMap("alice")
+	r := newRouteFixture(t, cm, svc)
+	require.NoError(t, r.cluster.GetClient().Get(context.Background(), client.ObjectKeyFromObject(cm), cm))
+	require.NoError(t, ctrl.SetControllerReference(cm, stale, r.cluster.GetScheme()))
+	require.NoError(t, r.client().Create(context.Background(), stale))
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "alice"}}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	var list gatewayv1alpha2.HTTPRouteList
+	require.NoError(t, r.client().List(ctx, &list))
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, "alice", list.Items[0].Name)
+	assert.True(t, metav1.IsControlledBy(&list.Items[0], cm))
+	hostnames, _ := routeHosts(list.Items[0])
+	assert.Equal(t, []string{"web---alice.preview.localhost", "8000---alice.preview.localhost"}, hostnames)
+
+	// A new port updates the route in place.
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "api", Protocol: v1.ProtocolTCP, Port: 8080})
+	require.NoError(t, r.client().Update(ctx, svc))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, r.client().List(ctx, &list))
+	require.Len(t, list.Items, 1)
+	hostnames, _ = routeHosts(list.Items[0])
+	assert.Len(t, hostnames, 4)
+
+	// Without HTTP ports, the route goes away.
+	svc.Spec.Ports = nil
+	require.NoError(t, r.client().Update(ctx, svc))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, r.client().List(ctx, &list))
+	assert.Empty(t, list.Items)
+}
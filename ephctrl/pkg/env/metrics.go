@@ -0,0 +1,197 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Metrics are served by the controller-runtime metrics server,
+// alongside the default controller metrics.
+var (
+	envTimeToReady = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ephctrl_env_time_to_ready_seconds",
+		Help:    "Time from env creation (or restart) until all its Tilt resources are running.",
+		Buckets: []float64{30, 60, 120, 180, 300, 450, 600, 900, 1800},
+	})
+
+	envTeardownDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ephctrl_env_teardown_duration_seconds",
+		Help:    "Time spent tearing down the cluster inside an env pod.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	})
+
+	envTeardownFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ephctrl_env_teardown_failures_total",
+		Help: "Number of env cluster teardowns that failed.",
+	})
+
+	envExpirationDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ephctrl_env_expiration_deletions_total",
+		Help: "Number of envs deleted because their expiration passed or was malformed.",
+	}, []string{"reason"})
+
+	podExecDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ephctrl_pod_exec_duration_seconds",
+		Help:    "Latency of commands run inside env pods.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"command", "result"})
+
+	gatewayRules = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ephctrl_gateway_rules",
+		Help: "Number of host rules on the shared gateway Ingress, including operator rules.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		envTimeToReady,
+		envTeardownDuration,
+		envTeardownFailures,
+		envExpirationDeletions,
+		podExecDuration,
+		gatewayRules,
+	)
+}
+
+// A short, bounded label for a command, e.g., "tilt get" or "k3d cluster".
+func commandLabel(cmd []string) string {
+	if len(cmd) > 2 {
+		cmd = cmd[:2]
+	}
+	return strings.Join(cmd, " ")
+}
+
+// Observe the duration of a command run inside an env pod.
+func observeExec(cmd []string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	podExecDuration.WithLabelValues(commandLabel(cmd), result).Observe(time.Since(start).Seconds())
+}
+
+// Tracks envs that are on their way to ready, so that we can
+// observe how long they took.
+//
+// We only observe envs that we've seen become ready, so that restarting
+// the controller doesn't observe envs that were ready long ago.
+type readinessTracker struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newReadinessTracker() *readinessTracker {
+	return &readinessTracker{pending: make(map[string]bool)}
+}
+
+// Record whether the env is ready.
+//
+// Time to ready is measured from when the ConfigMap was created, or from when
+// the pod was created if the env has since restarted.
+func (t *readinessTracker) track(key string, cm *v1.ConfigMap, pod *v1.Pod, ready bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if cm.Name == "" {
+		delete(t.pending, key)
+		return
+	}
+
+	if !ready {
+		t.pending[key] = true
+		return
+	}
+
+	if !t.pending[key] {
+		return
+	}
+	delete(t.pending, key)
+
+	start := cm.CreationTimestamp.Time
+	if pod.CreationTimestamp.After(start) {
+		start = pod.CreationTimestamp.Time
+	}
+	envTimeToReady.Observe(time.Since(start).Seconds())
+}
+
+// Reports the number of envs in each phase when scraped.
+//
+// Reads from the manager cache, so it doesn't hit the API server.
+type envCollector struct {
+	client client.Client
+	desc   *prometheus.Desc
+}
+
+func newEnvCollector(c client.Client) *envCollector {
+	return &envCollector{
+		client: c,
+		desc: prometheus.NewDesc(
+			"ephctrl_envs",
+			"Number of envs, by the phase of their pod.",
+			[]string{"phase"}, nil),
+	}
+}
+
+func (c *envCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *envCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	labels := client.MatchingLabels{appKey: appValue, nameKey: nameValue}
+	var cms v1.ConfigMapList
+	err := c.client.List(ctx, &cms, labels)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("listing configmaps: %v", err))
+		return
+	}
+
+	var pods v1.PodList
+	err = c.client.List(ctx, &pods, labels)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("listing pods: %v", err))
+		return
+	}
+
+	podsByName := make(map[string]v1.Pod, len(pods.Items))
+	for _, pod := range pods.Items {
+		podsByName[pod.Namespace+"/"+pod.Name] = pod
+	}
+
+	counts := map[string]int{
+		string(v1.PodPending):   0,
+		string(v1.PodRunning):   0,
+		string(v1.PodSucceeded): 0,
+		string(v1.PodFailed):    0,
+		"Ready":                 0,
+		"Deleting":              0,
+	}
+	for _, cm := range cms.Items {
+		pod, ok := podsByName[cm.Namespace+"/"+cm.Name]
+		phase := string(v1.PodPending)
+		switch {
+		case !ok:
+		case pod.DeletionTimestamp != nil:
+			phase = "Deleting"
+		case isPodReady(&pod):
+			phase = "Ready"
+		case pod.Status.Phase != "":
+			phase = string(pod.Status.Phase)
+		}
+		counts[phase]++
+	}
+
+	for phase, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), phase)
+	}
+}
@@ -0,0 +1,45 @@
+package env
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func histogramCount(t *testing.T, h prometheus.Histogram) uint64 {
+	var m dto.Metric
+	require.NoError(t, h.Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestReadinessTracker(t *testing.T) {
+	tracker := newReadinessTracker()
+	created := metav1.NewTime(time.Now().Add(-time.Minute))
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "nick", CreationTimestamp: created}}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nick", CreationTimestamp: created}}
+	before := histogramCount(t, envTimeToReady)
+
+	// Envs that were already ready when we started aren't observed.
+	tracker.track("default/nick", cm, pod, true)
+	assert.Equal(t, before, histogramCount(t, envTimeToReady))
+
+	tracker.track("default/nick", cm, pod, false)
+	tracker.track("default/nick", cm, pod, true)
+	assert.Equal(t, before+1, histogramCount(t, envTimeToReady))
+
+	// Only observed once per transition.
+	tracker.track("default/nick", cm, pod, true)
+	assert.Equal(t, before+1, histogramCount(t, envTimeToReady))
+}
+
+func TestCommandLabel(t *testing.T) {
+	assert.Equal(t, "tilt get", commandLabel([]string{"tilt", "get", "uiresources", "-o", "json"}))
+	assert.Equal(t, "k3d cluster", commandLabel([]string{"k3d", "cluster", "delete", "--all"}))
+	assert.Equal(t, "tilt", commandLabel([]string{"tilt"}))
+}
@@ -0,0 +1,154 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// How long before an env expires that we warn its owner.
+const expiringWarning = 5 * time.Minute
+
+// Container waiting reasons that won't fix themselves.
+var failedWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Why the env pod failed, or "" if it hasn't.
+func podFailure(pod *v1.Pod) string {
+	if pod == nil || pod.Name == "" || pod.DeletionTimestamp != nil {
+		return ""
+	}
+
+	if pod.Status.Phase == v1.PodFailed {
+		if pod.Status.Message != "" {
+			return fmt.Sprintf("Pod failed: %s", pod.Status.Message)
+		}
+		return "Pod failed"
+	}
+
+	statuses := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, c := range statuses {
+		if c.State.Waiting != nil && failedWaitingReasons[c.State.Waiting.Reason] {
+			return fmt.Sprintf("Container %s: %s", c.Name, c.State.Waiting.Reason)
+		}
+	}
+	return ""
+}
+
+// Links to the dashboard and, if the env has a service, its endpoints.
+func (r *Reconciler) notificationLinks(cm *v1.ConfigMap, svc *v1.Service) []notify.Link {
+	scheme := r.gatewayTLS.Scheme()
+	gatewayHost := r.config.GatewayHost()
+	links := []notify.Link{{Name: "Dashboard", URL: fmt.Sprintf("%s://%s/", scheme, gatewayHost)}}
+	if svc == nil {
+		return links
+	}
+
+	for _, port := range svc.Spec.Ports {
+		if !ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) {
+			continue
+		}
+		links = append(links, notify.Link{
+			Name: port.Name,
+			URL:  fmt.Sprintf("%s://%s/", scheme, ephconfig.EndpointHost(port.Name, cm.Name, gatewayHost)),
+		})
+	}
+	return links
+}
+
+// Notify the env's watchers when it becomes ready, fails, or is about to expire.
+//
+// Records each notification on the ConfigMap before sending it, so that we
+// send it at most once, even across controller restarts.
+//
+// Returns when to check again for an upcoming expiration.
+func (r *Reconciler) maybeNotify(ctx context.Context, cm *v1.ConfigMap, pod *v1.Pod, svc *v1.Service, ready bool) (reconcile.Result, error) {
+	if !r.notifier.Enabled() || cm.Name == "" || cm.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+	if pod == nil {
+		pod = &v1.Pod{}
+	}
+
+	var events []notify.Event
+	notified := map[string]string{}
+	spec := ephconfig.SpecFromData(cm.Data)
+	podUID := string(pod.UID)
+
+	if pod.Name != "" && ready && cm.Annotations[notify.AnnotationNotifiedReady] != podUID {
+		notified[notify.AnnotationNotifiedReady] = podUID
+		events = append(events, notify.Event{
+			Type:  notify.EventReady,
+			Env:   cm.Name,
+			Spec:  &spec,
+			Links: r.notificationLinks(cm, svc),
+		})
+	}
+
+	if reason := podFailure(pod); reason != "" && cm.Annotations[notify.AnnotationNotifiedFailed] != podUID {
+		notified[notify.AnnotationNotifiedFailed] = podUID
+		events = append(events, notify.Event{
+			Type:    notify.EventFailed,
+			Env:     cm.Name,
+			Spec:    &spec,
+			Message: reason,
+			Links:   r.notificationLinks(cm, nil),
+		})
+	}
+
+	result := reconcile.Result{}
+	expirationValue := cm.Data["expiration"]
+	expiration, err := time.Parse(time.RFC3339, expirationValue)
+	if err == nil && cm.Annotations[notify.AnnotationNotifiedExpiring] != expirationValue {
+		now := time.Now()
+		warnAt := expiration.Add(-expiringWarning)
+		if now.Before(warnAt) {
+			result.RequeueAfter = warnAt.Sub(now)
+		} else if now.Before(expiration) {
+			notified[notify.AnnotationNotifiedExpiring] = expirationValue
+			events = append(events, notify.Event{
+				Type:       notify.EventExpiring,
+				Env:        cm.Name,
+				Time:       now,
+				Expiration: &expiration,
+				Links:      r.notificationLinks(cm, nil),
+			})
+		}
+	}
+
+	if len(events) == 0 {
+		return result, nil
+	}
+
+	update := cm.DeepCopy()
+	if update.Annotations == nil {
+		update.Annotations = map[string]string{}
+	}
+	for k, v := range notified {
+		update.Annotations[k] = v
+	}
+	err = r.client().Update(ctx, update)
+	if err != nil {
+		return result, client.IgnoreNotFound(err)
+	}
+
+	for _, e := range events {
+		log.FromContext(ctx).Info(fmt.Sprintf("notifying: %s", e.Summary()))
+		r.notifier.Notify(e)
+	}
+	return result, nil
+}
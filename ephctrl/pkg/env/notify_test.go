@@ -0,0 +1,157 @@
+package env
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakeCluster struct {
+	client client.Client
+}
+
+func (c fakeCluster) GetClient() client.Client   { return c.client }
+func (c fakeCluster) GetConfig() *rest.Config    { return &rest.Config{} }
+func (c fakeCluster) GetScheme() *runtime.Scheme { return scheme.Scheme }
+
+type chanNotifier chan notify.Event
+
+func (n chanNotifier) Notify(ctx context.Context, e notify.Event) error {
+	n <- e
+	return nil
+}
+
+func newNotifyFixture(t *testing.T, cm *v1.ConfigMap) (*Reconciler, chanNotifier) {
+	events := make(chanNotifier, 10)
+	dispatcher := notify.NewDispatcher(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dispatcher.Run(ctx)
+
+	r := &Reconciler{
+		cluster:  fakeCluster{client: fake.NewClientBuilder().WithObjects(cm).Build()},
+		notifier: dispatcher,
+		config:   ephconfig.StaticConfig(nil, "preview.localhost"),
+	}
+	return r, events
+}
+
+func nextEvent(t *testing.T, events chanNotifier) notify.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+		return notify.Event{}
+	}
+}
+
+func getConfigMap(t *testing.T, r *Reconciler, name string) *v1.ConfigMap {
+	cm := &v1.ConfigMap{}
+	require.NoError(t, r.client().Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, cm))
+	return cm
+}
+
+func TestPodFailure(t *testing.T) {
+	running := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "alice"}, Status: v1.PodStatus{Phase: v1.PodRunning}}
+	assert.Equal(t, "", podFailure(running))
+	assert.Equal(t, "", podFailure(nil))
+
+	crashing := running.DeepCopy()
+	crashing.Status.ContainerStatuses = []v1.ContainerStatus{{
+		Name:  "tilt-upper",
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	}}
+	assert.Equal(t, "Container tilt-upper: CrashLoopBackOff", podFailure(crashing))
+
+	failed := running.DeepCopy()
+	failed.Status.Phase = v1.PodFailed
+	failed.Status.Message = "evicted"
+	assert.Equal(t, "Pod failed: evicted", podFailure(failed))
+}
+
+func TestNotifyReadyOnce(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Data:       map[string]string{"repo": "https://github.com/tilt-dev/tilt", "branch": "master", "path": "Tiltfile"},
+	}
+	r, events := newNotifyFixture(t, cm)
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "alice", UID: "pod-1"}}
+	svc := &v1.Service{Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "web", Port: 8000, Protocol: "TCP"},
+		{Name: "postgres", Port: 5432, Protocol: "TCP", AppProtocol: stringPtr("postgres")},
+	}}}
+
+	_, err := r.maybeNotify(context.Background(), cm, pod, svc, true)
+	require.NoError(t, err)
+
+	e := nextEvent(t, events)
+	assert.Equal(t, notify.EventReady, e.Type)
+	assert.Equal(t, &ephconfig.EnvSpec{Repo: "https://github.com/tilt-dev/tilt", Branch: "master", Path: "Tiltfile"}, e.Spec)
+	assert.Equal(t, []notify.Link{
+		{Name: "Dashboard", URL: "http://preview.localhost/"},
+		{Name: "web", URL: "http://web---alice.preview.localhost/"},
+	}, e.Links)
+
+	// The second time around, we've already notified.
+	cm = getConfigMap(t, r, "alice")
+	assert.Equal(t, "pod-1", cm.Annotations[notify.AnnotationNotifiedReady])
+	_, err = r.maybeNotify(context.Background(), cm, pod, svc, true)
+	require.NoError(t, err)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected notification: %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNotifyExpiring(t *testing.T) {
+	expiration := time.Now().Add(20 * time.Minute).UTC().Format(time.RFC3339)
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Data:       map[string]string{"expiration": expiration},
+	}
+	r, events := newNotifyFixture(t, cm)
+
+	// Too early to warn, so check back when it's time.
+	result, err := r.maybeNotify(context.Background(), cm, nil, nil, false)
+	require.NoError(t, err)
+	assert.InDelta(t, (15 * time.Minute).Seconds(), result.RequeueAfter.Seconds(), 5)
+
+	cm = getConfigMap(t, r, "alice")
+	cm.Data["expiration"] = time.Now().Add(3 * time.Minute).UTC().Format(time.RFC3339)
+	require.NoError(t, r.client().Update(context.Background(), cm))
+
+	result, err = r.maybeNotify(context.Background(), cm, nil, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), result.RequeueAfter)
+
+	e := nextEvent(t, events)
+	assert.Equal(t, notify.EventExpiring, e.Type)
+	assert.Equal(t, "Env alice expires in 3m0s", e.Summary())
+	assert.Equal(t, cm.Data["expiration"], getConfigMap(t, r, "alice").Annotations[notify.AnnotationNotifiedExpiring])
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	r := &Reconciler{}
+	result, err := r.maybeNotify(context.Background(), &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}, nil, nil, true)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), result.RequeueAfter)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -7,26 +7,36 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
 	"github.com/tilt-dev/tilt/pkg/apis/core/v1alpha1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/kubectl/pkg/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
@@ -39,8 +49,12 @@ var (
 	nameKey          = ephconfig.LabelNameKey
 	nameValue        = ephconfig.LabelNameValueEphrunner
 	nameGatewayValue = "ephgateway"
+	nameRouteValue   = "ephroute"
+	nameIngressValue = "ephingress"
+	nameCertValue    = "ephcert"
 	ephOwnerNameKey  = "ephemerator.tilt.dev/owner-name"
 	configKey        = "ephemerator.tilt.dev/configmap"
+	operatorHostsKey = "ephemerator.tilt.dev/operator-hosts"
 )
 
 type Cluster interface {
@@ -50,21 +64,29 @@ type Cluster interface {
 }
 
 type Reconciler struct {
-	cluster   Cluster
-	clientset *kubernetes.Clientset
-	allowlist *ephconfig.Allowlist
+	cluster    Cluster
+	clientset  *kubernetes.Clientset
+	recorder   record.EventRecorder
+	config     *ephconfig.LiveConfig
+	readiness  *readinessTracker
+	notifier   *notify.Dispatcher
+	gatewayTLS ephconfig.GatewayTLS
 }
 
-func NewReconciler(cluster Cluster, allowlist *ephconfig.Allowlist) (*Reconciler, error) {
+func NewReconciler(cluster Cluster, recorder record.EventRecorder, config *ephconfig.LiveConfig, notifier *notify.Dispatcher, gatewayTLS ephconfig.GatewayTLS) (*Reconciler, error) {
 	clientset, err := kubernetes.NewForConfig(cluster.GetConfig())
 	if err != nil {
 		return nil, err
 	}
 
 	return &Reconciler{
-		cluster:   cluster,
-		clientset: clientset,
-		allowlist: allowlist,
+		cluster:    cluster,
+		clientset:  clientset,
+		recorder:   recorder,
+		config:     config,
+		readiness:  newReadinessTracker(),
+		notifier:   notifier,
+		gatewayTLS: gatewayTLS,
 	}, nil
 }
 
@@ -75,13 +97,57 @@ func (r *Reconciler) AddToManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	err = metrics.Registry.Register(newEnvCollector(mgr.GetClient()))
+	if err != nil {
+		return err
+	}
+
+	configChanges := configChangeSource(r.cluster, r.config, anyConfigChange,
+		func() client.ObjectList { return &v1.ConfigMapList{} },
+		client.MatchingLabels{appKey: appValue, nameKey: nameValue})
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1.ConfigMap{}, builder.WithPredicates(pred)).
+		For(&v1.ConfigMap{}, builder.WithPredicates(pred, ignoreActivityUpdates)).
 		Owns(&v1.Pod{}, builder.WithPredicates(pred)).
 		Owns(&v1.Service{}, builder.WithPredicates(pred)).
+		Watches(configChanges, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
 
+// The ephgateway records env activity on the ConfigMap every minute.
+// Skip updates that only change the activity annotation, so that
+// busy envs don't reconcile (and exec into the pod) every minute.
+var ignoreActivityUpdates = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldCM, ok := e.ObjectOld.(*v1.ConfigMap)
+		if !ok {
+			return true
+		}
+		newCM, ok := e.ObjectNew.(*v1.ConfigMap)
+		if !ok {
+			return true
+		}
+		return !isActivityUpdate(oldCM, newCM)
+	},
+}
+
+func isActivityUpdate(oldCM, newCM *v1.ConfigMap) bool {
+	oldActivity := oldCM.Annotations[ephconfig.AnnotationLastActivity]
+	newActivity := newCM.Annotations[ephconfig.AnnotationLastActivity]
+	if oldActivity == newActivity {
+		return false
+	}
+
+	withoutActivity := func(cm *v1.ConfigMap) *v1.ConfigMap {
+		cm = cm.DeepCopy()
+		delete(cm.Annotations, ephconfig.AnnotationLastActivity)
+		cm.ResourceVersion = ""
+		cm.ManagedFields = nil
+		return cm
+	}
+	return equality.Semantic.DeepEqual(withoutActivity(oldCM), withoutActivity(newCM))
+}
+
 func (r *Reconciler) client() client.Client {
 	return r.cluster.GetClient()
 }
@@ -142,16 +208,31 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if err != nil {
 		return reconcile.Result{}, fmt.Errorf("connecting service: %v", err)
 	}
+	ready := desiredSvc != nil && svcResult.RequeueAfter == 0
+	r.readiness.track(nn.String(), cm, pod, ready)
 
-	err = r.maybeUpdateService(ctx, service, desiredSvc)
+	err = r.maybeUpdateService(ctx, cm, service, desiredSvc)
 	if err != nil {
 		return reconcile.Result{}, fmt.Errorf("reconciling service: %v", err)
 	}
 
+	err = r.maybeRunAction(ctx, cm, pod)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("running action: %v", err)
+	}
+
+	notifyResult, err := r.maybeNotify(ctx, cm, pod, desiredSvc, ready)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("sending notifications: %v", err)
+	}
+
 	result := cmResult
 	if svcResult.RequeueAfter > 0 && svcResult.RequeueAfter < result.RequeueAfter {
 		result.RequeueAfter = svcResult.RequeueAfter
 	}
+	if notifyResult.RequeueAfter > 0 && notifyResult.RequeueAfter < result.RequeueAfter {
+		result.RequeueAfter = notifyResult.RequeueAfter
+	}
 
 	if result.RequeueAfter > 0 {
 		log.Info(fmt.Sprintf("requeueing after: %s", result.RequeueAfter))
@@ -161,7 +242,7 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 }
 
 // If the configmap does not have an expiration set on it,
-// set one for a default time from now.
+// set one for the TTL of its group (or a default time) from now.
 //
 // If the expiration has passed, delete the configmap.
 func (r *Reconciler) reconcileExpiration(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, reconcile.Result, error) {
@@ -171,39 +252,109 @@ func (r *Reconciler) reconcileExpiration(ctx context.Context, cm *v1.ConfigMap)
 
 	log := log.FromContext(ctx)
 	if cm.Data["expiration"] == "" {
+		ttl := r.envTTL(cm)
 		update := cm.DeepCopy()
-		update.Data["expiration"] = time.Now().Add(defaultExpiration).Format(time.RFC3339)
+		update.Data["expiration"] = time.Now().Add(ttl).Format(time.RFC3339)
 		log.Info(fmt.Sprintf("Setting expiration: %s", update.Data["expiration"]))
 
 		err := r.client().Update(ctx, update)
 		if err != nil {
 			return nil, reconcile.Result{}, err
 		}
-		return update, reconcile.Result{RequeueAfter: defaultExpiration}, nil
+		return update, reconcile.Result{RequeueAfter: ttl}, nil
 	}
 
 	now := time.Now()
 
 	expiration, err := time.Parse(time.RFC3339, cm.Data["expiration"])
-	shouldDelete := false
+	deleteReason := ""
 	if err != nil {
 		log.Info(fmt.Sprintf("deleting configmap because the expiration is malformed: %v", err))
-		shouldDelete = true
+		r.recorder.Eventf(cm, v1.EventTypeWarning, "MalformedExpiration",
+			"Deleting env because its expiration is malformed: %v", err)
+		deleteReason = "malformed"
 	} else if now.After(expiration) || now.Equal(expiration) {
 		log.Info(fmt.Sprintf("deleting configmap because the expiration is passed: %s", expiration))
-		shouldDelete = true
+		r.recorder.Eventf(cm, v1.EventTypeNormal, "Expired",
+			"Deleting env because it expired at %s", expiration.Format(time.RFC3339))
+		deleteReason = "expired"
 	}
 
-	if shouldDelete {
+	if deleteReason != "" {
 		err := client.IgnoreNotFound(r.client().Delete(ctx, cm))
 		if err != nil {
 			return nil, reconcile.Result{}, err
 		}
+		envExpirationDeletions.WithLabelValues(deleteReason).Inc()
 		return &v1.ConfigMap{}, reconcile.Result{}, nil
 	}
 	return cm, reconcile.Result{RequeueAfter: expiration.Sub(now)}, nil
 }
 
+// How long the env lives, from the policy of the group it was created under.
+func (r *Reconciler) envTTL(cm *v1.ConfigMap) time.Duration {
+	policy, err := r.config.Allowlist().Policy(cm.Annotations[ephconfig.AnnotationGroup])
+	if err == nil && policy.TTLDuration() > 0 {
+		return policy.TTLDuration()
+	}
+	return defaultExpiration
+}
+
+// Counts the envs in the group that were created before this one.
+//
+// Envs get slots in the order they were created, so that every
+// reconcile agrees on which envs are over the group's limit.
+func (r *Reconciler) groupEnvsAhead(ctx context.Context, cm *v1.ConfigMap, group string) (int, error) {
+	cms := &v1.ConfigMapList{}
+	err := r.client().List(ctx, cms, client.InNamespace(cm.Namespace), client.MatchingLabels{appKey: appValue, nameKey: nameValue})
+	if err != nil {
+		return 0, fmt.Errorf("listing envs: %v", err)
+	}
+
+	ahead := 0
+	for _, other := range cms.Items {
+		if other.Name == cm.Name || other.DeletionTimestamp != nil || other.Annotations[ephconfig.AnnotationGroup] != group {
+			continue
+		}
+		if other.CreationTimestamp.Before(&cm.CreationTimestamp) ||
+			(other.CreationTimestamp.Equal(&cm.CreationTimestamp) && other.Name < cm.Name) {
+			ahead++
+		}
+	}
+	return ahead, nil
+}
+
+// The resource requests of envs of the given size.
+//
+// Sizes are validated when the allowlist is read.
+func sizeResources(size *ephconfig.SizeClass) v1.ResourceRequirements {
+	requests := v1.ResourceList{}
+	if size != nil && size.CPU != "" {
+		requests[v1.ResourceCPU] = resource.MustParse(size.CPU)
+	}
+	if size != nil && size.Memory != "" {
+		requests[v1.ResourceMemory] = resource.MustParse(size.Memory)
+	}
+	if len(requests) == 0 {
+		return v1.ResourceRequirements{}
+	}
+	return v1.ResourceRequirements{Requests: requests}
+}
+
+// The configmap data that the env pod depends on.
+//
+// Excludes the expiration, so that extending an env doesn't restart it.
+func specData(data map[string]string) map[string]string {
+	result := make(map[string]string, len(data))
+	for k, v := range data {
+		if k == "expiration" {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
 func (r *Reconciler) createAnnotation(cm *v1.ConfigMap) (string, error) {
 	if cm.Name == "" {
 		return "", nil
@@ -211,13 +362,26 @@ func (r *Reconciler) createAnnotation(cm *v1.ConfigMap) (string, error) {
 
 	buf := bytes.NewBuffer(nil)
 	encoder := json.NewEncoder(buf)
-	err := encoder.Encode(cm.Data)
+	err := encoder.Encode(specData(cm.Data))
 	if err != nil {
 		return "", err
 	}
 	return buf.String(), nil
 }
 
+// Whether the pod was created from different configmap data.
+//
+// Pods created by older versions of ephctrl recorded the expiration
+// in the annotation too, so we compare without it.
+func podSpecChanged(pod *v1.Pod, cm *v1.ConfigMap) bool {
+	var podData map[string]string
+	err := json.Unmarshal([]byte(pod.Annotations[configKey]), &podData)
+	if err != nil {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(specData(podData), specData(cm.Data))
+}
+
 // Create the pod with the parameters specified
 // in the given configmap.
 func (r *Reconciler) createPod(ctx context.Context, cm *v1.ConfigMap) (*v1.Pod, error) {
@@ -227,19 +391,34 @@ func (r *Reconciler) createPod(ctx context.Context, cm *v1.ConfigMap) (*v1.Pod,
 		return nil, fmt.Errorf("serializing configmap: %v", err)
 	}
 
-	spec := ephconfig.EnvSpec{
-		Repo:   cm.Data["repo"],
-		Path:   cm.Data["path"],
-		Branch: cm.Data["branch"],
+	// Check the spec against the allowlist and the policy of the group
+	// the env was created under, including the group's limit on envs.
+	spec := ephconfig.SpecFromData(cm.Data)
+	allowlist := r.config.Allowlist()
+	policy, err := allowlist.Policy(cm.Annotations[ephconfig.AnnotationGroup])
+	if err == nil {
+		err = ephconfig.IsAllowedForGroup(allowlist, policy, spec)
+	}
+	if err == nil && policy != nil && policy.MaxEnvs > 0 {
+		ahead, listErr := r.groupEnvsAhead(ctx, cm, policy.Name)
+		if listErr != nil {
+			return nil, listErr
+		}
+		if ahead >= policy.MaxEnvs {
+			err = fmt.Errorf("Forbidden: group %s may only run %d envs at once", policy.Name, policy.MaxEnvs)
+		}
 	}
-	err = ephconfig.IsAllowed(r.allowlist, spec)
 	if err != nil {
 		log.Error(err, "ignoring configmap")
-
-		// TODO(nick): Find some way to propagate back to the frontend
-		// that we've gotten a permission error.
+		r.recorder.Eventf(cm, v1.EventTypeWarning, "Rejected", "Env spec rejected: %v", err)
 		return nil, nil
 	}
+	size, _ := allowlist.Size(spec.Size)
+	settings := allowlist.RepoSettings(spec.Repo)
+	image := os.Getenv("TILT_UPPER_IMAGE")
+	if settings.Image != "" {
+		image = settings.Image
+	}
 
 	automountServiceAccountToken := false
 	// Credits:
@@ -283,8 +462,9 @@ func (r *Reconciler) createPod(ctx context.Context, cm *v1.ConfigMap) (*v1.Pod,
 		},
 		Containers: []v1.Container{
 			{
-				Name:  "dind",
-				Image: os.Getenv("DIND_IMAGE"),
+				Name:      "dind",
+				Image:     os.Getenv("DIND_IMAGE"),
+				Resources: sizeResources(size),
 				SecurityContext: &v1.SecurityContext{
 					Privileged: &privileged,
 				},
@@ -310,37 +490,8 @@ func (r *Reconciler) createPod(ctx context.Context, cm *v1.ConfigMap) (*v1.Pod,
 			},
 			{
 				Name:  "tilt-upper",
-				Image: os.Getenv("TILT_UPPER_IMAGE"),
-				Env: []v1.EnvVar{
-					{
-						Name:  "TILT_UPPER_REPO",
-						Value: spec.Repo,
-					},
-					{
-						Name:  "TILT_UPPER_PATH",
-						Value: spec.Path,
-					},
-					{
-						Name:  "TILT_UPPER_BRANCH",
-						Value: spec.Branch,
-					},
-					{
-						Name:  "K3D_IMAGE_REGISTRY",
-						Value: os.Getenv("K3D_IMAGE_REGISTRY"),
-					},
-					{
-						Name:  "K3D_IMAGE_K3S",
-						Value: os.Getenv("K3D_IMAGE_K3S"),
-					},
-					{
-						Name:  "K3D_IMAGE_LOADBALANCER",
-						Value: os.Getenv("K3D_IMAGE_LOADBALANCER"),
-					},
-					{
-						Name:  "K3D_IMAGE_TOOLS",
-						Value: os.Getenv("K3D_IMAGE_TOOLS"),
-					},
-				},
+				Image: image,
+				Env:   tiltUpperEnv(spec, settings),
 				ReadinessProbe: &v1.Probe{
 					ProbeHandler: v1.ProbeHandler{
 						Exec: &v1.ExecAction{
@@ -382,7 +533,65 @@ func (r *Reconciler) createPod(ctx context.Context, cm *v1.ConfigMap) (*v1.Pod,
 	}
 
 	log.Info("creating pod")
-	return pod, r.client().Create(ctx, pod)
+	err = r.client().Create(ctx, pod)
+	if err != nil {
+		return pod, err
+	}
+	r.recorder.Eventf(cm, v1.EventTypeNormal, "Created",
+		"Creating env for %s (branch %s, path %s)", spec.Repo, spec.Branch, spec.Path)
+	return pod, nil
+}
+
+// The env of the tilt-upper container, which tells the entrypoint what to run.
+//
+// Args go one per line, since the entrypoint can't split them like a shell would.
+// The repo's own env vars come last; the allowlist can't set the entrypoint's.
+// The user's params follow the repo's settings.
+func tiltUpperEnv(spec ephconfig.EnvSpec, settings ephconfig.RepoSettings) []v1.EnvVar {
+	paramArgs, paramEnv := settings.ParamValues(spec)
+	tiltfileArgs := append(append([]string{}, settings.TiltUpTrailingArgs()...), paramArgs...)
+	env := []v1.EnvVar{
+		{
+			Name:  "TILT_UPPER_REPO",
+			Value: spec.Repo,
+		},
+		{
+			Name:  "TILT_UPPER_PATH",
+			Value: spec.Path,
+		},
+		{
+			Name:  "TILT_UPPER_BRANCH",
+			Value: spec.Branch,
+		},
+		{
+			Name:  "TILT_UPPER_ARGS",
+			Value: strings.Join(settings.TiltArgs, "\n"),
+		},
+		{
+			Name:  "TILT_UPPER_TILTFILE_ARGS",
+			Value: strings.Join(tiltfileArgs, "\n"),
+		},
+		{
+			Name:  "K3D_IMAGE_REGISTRY",
+			Value: os.Getenv("K3D_IMAGE_REGISTRY"),
+		},
+		{
+			Name:  "K3D_IMAGE_K3S",
+			Value: os.Getenv("K3D_IMAGE_K3S"),
+		},
+		{
+			Name:  "K3D_IMAGE_LOADBALANCER",
+			Value: os.Getenv("K3D_IMAGE_LOADBALANCER"),
+		},
+		{
+			Name:  "K3D_IMAGE_TOOLS",
+			Value: os.Getenv("K3D_IMAGE_TOOLS"),
+		},
+	}
+	for _, v := range append(append([]ephconfig.EnvVar{}, settings.Env...), paramEnv...) {
+		env = append(env, v1.EnvVar{Name: v.Name, Value: v.Value})
+	}
+	return env
 }
 
 // Determine if there's any mismatch between the pod and its owner config,
@@ -397,19 +606,15 @@ func (r *Reconciler) maybeDeletePod(ctx context.Context, pod *v1.Pod, owner *v1.
 	}
 
 	if !needsDelete && pod.Name != "" {
-		configAnnoValue, err := r.createAnnotation(owner)
-		if err != nil {
-			return nil, fmt.Errorf("serializing configmap: %v", err)
-		}
-
-		if pod.Annotations[configKey] != configAnnoValue {
+		if podSpecChanged(pod, owner) {
 			log.Info("deleting pod because configmap changed")
+			r.recorder.Event(owner, v1.EventTypeNormal, "SpecChanged", "Restarting env because its spec changed")
 			needsDelete = true
 		}
 	}
 
 	if needsDelete {
-		err := r.deletePod(ctx, pod)
+		err := r.deletePod(ctx, pod, owner)
 		if err != nil {
 			return nil, err
 		}
@@ -419,7 +624,9 @@ func (r *Reconciler) maybeDeletePod(ctx context.Context, pod *v1.Pod, owner *v1.
 }
 
 // Tear down the dind cluster (DIND is not create at shutting down cleanly on its own).
-func (r *Reconciler) deletePod(ctx context.Context, pod *v1.Pod) error {
+//
+// Records the teardown result on the owner, or on the pod if the owner is gone.
+func (r *Reconciler) deletePod(ctx context.Context, pod *v1.Pod, owner *v1.ConfigMap) error {
 	if pod.DeletionTimestamp != nil {
 		log.FromContext(ctx).Info("pod deletion already in progress")
 		return nil
@@ -436,20 +643,19 @@ func (r *Reconciler) deletePod(ctx context.Context, pod *v1.Pod) error {
 	}
 
 	if needsClusterTeardown {
-		err := client.IgnoreNotFound(
-			r.exec(ctx, pod,
-				[]string{"k3d", "cluster", "delete", "--all"},
-				ioutil.Discard, ioutil.Discard))
-		if err != nil {
-			return fmt.Errorf("deleting cluster: %v", err)
+		var eventObj runtime.Object = pod
+		if owner.Name != "" {
+			eventObj = owner
 		}
-		err = client.IgnoreNotFound(
-			r.exec(ctx, pod,
-				[]string{"k3d", "registry", "delete", "--all"},
-				ioutil.Discard, ioutil.Discard))
+
+		start := time.Now()
+		err := r.teardownCluster(ctx, pod)
 		if err != nil {
-			return fmt.Errorf("deleting registry: %v", err)
+			r.recorder.Eventf(eventObj, v1.EventTypeWarning, "TeardownFailed", "Tearing down env cluster: %v", err)
+			return err
 		}
+		r.recorder.Eventf(eventObj, v1.EventTypeNormal, "TornDown",
+			"Tore down env cluster in %s", time.Since(start).Round(time.Second))
 	}
 	err := client.IgnoreNotFound(r.client().Delete(ctx, pod))
 	if err != nil {
@@ -458,7 +664,37 @@ func (r *Reconciler) deletePod(ctx context.Context, pod *v1.Pod) error {
 	return nil
 }
 
-func (r *Reconciler) exec(ctx context.Context, pod *v1.Pod, cmd []string, stdout, stderr io.Writer) error {
+// Delete the k3d cluster and registry inside the pod.
+func (r *Reconciler) teardownCluster(ctx context.Context, pod *v1.Pod) (err error) {
+	start := time.Now()
+	defer func() {
+		envTeardownDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			envTeardownFailures.Inc()
+		}
+	}()
+
+	err = client.IgnoreNotFound(
+		r.exec(ctx, pod,
+			[]string{"k3d", "cluster", "delete", "--all"},
+			ioutil.Discard, ioutil.Discard))
+	if err != nil {
+		return fmt.Errorf("deleting cluster: %v", err)
+	}
+	err = client.IgnoreNotFound(
+		r.exec(ctx, pod,
+			[]string{"k3d", "registry", "delete", "--all"},
+			ioutil.Discard, ioutil.Discard))
+	if err != nil {
+		return fmt.Errorf("deleting registry: %v", err)
+	}
+	return nil
+}
+
+func (r *Reconciler) exec(ctx context.Context, pod *v1.Pod, cmd []string, stdout, stderr io.Writer) (err error) {
+	start := time.Now()
+	defer func() { observeExec(cmd, start, err) }()
+
 	log.FromContext(ctx).Info(fmt.Sprintf("running in pod %s: %s", pod.Name, cmd))
 	req := r.clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
@@ -506,19 +742,120 @@ func (r *Reconciler) uiResources(ctx context.Context, pod *v1.Pod) (*v1alpha1.UI
 	return &uiResourceList, nil
 }
 
-// Determine the ports that are exposed by this tilt instance.
-func (r *Reconciler) determinePorts(uiResourceList *v1alpha1.UIResourceList) []v1.ServicePort {
+// Kubernetes limits Service port names to 15 characters.
+const maxPortNameLen = 15
+
+var invalidPortNameCharsRe = regexp.MustCompile("[^a-z0-9]+")
+
+// Convert a Tilt resource name into a valid Service port name.
+//
+// The gateway uses port names in host names, so they must also
+// be valid endpoint names.
+func portName(resourceName string) string {
+	name := invalidPortNameCharsRe.ReplaceAllString(strings.ToLower(resourceName), "-")
+	name = truncatePortName(strings.Trim(name, "-"), maxPortNameLen)
+	if !ephconfig.IsValidEndpointName(name) {
+		name = truncatePortName("r-"+name, maxPortNameLen)
+	}
+	if !ephconfig.IsValidEndpointName(name) {
+		return "endpoint"
+	}
+	return name
+}
+
+func truncatePortName(name string, max int) string {
+	if len(name) > max {
+		name = name[:max]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// Hosts that mean "this machine" in a Tilt endpoint link.
+var localLinkHosts = map[string]bool{
+	"localhost": true,
+	"0.0.0.0":   true,
+	"127.0.0.1": true,
+	"::1":       true,
+}
+
+// An endpoint link that points at a port inside the env.
+type endpointLink struct {
+	scheme string
+	port   int32
+
+	// The path, query, and fragment of the link, or empty for the root.
+	path string
+}
+
+var linkSchemeRe = regexp.MustCompile("^[a-z][a-z0-9+.-]*$")
+
+// Parse a Tilt endpoint link.
+//
+// Links with schemes other than http and https, like postgres://localhost:5432,
+// are exposed as raw TCP endpoints, so they must have an explicit port.
+//
+// Returns false for links that don't point at the env itself,
+// like links to docs or to remote servers.
+func parseEndpointLink(link string) (endpointLink, bool) {
+	u, err := url.Parse(link)
+	if err != nil || !localLinkHosts[u.Hostname()] || !linkSchemeRe.MatchString(u.Scheme) {
+		return endpointLink{}, false
+	}
+
+	var port int
+	switch u.Scheme {
+	case "http":
+		port = 80
+	case "https":
+		port = 443
+	default:
+		if u.Port() == "" {
+			return endpointLink{}, false
+		}
+	}
+
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil || port <= 0 || port > 65535 {
+			return endpointLink{}, false
+		}
+	}
+
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		path += "#" + u.EscapedFragment()
+	}
+	if path == "/" {
+		path = ""
+	}
+
+	return endpointLink{scheme: u.Scheme, port: int32(port), path: path}, true
+}
+
+// Determine the ports that are exposed by this tilt instance,
+// and the endpoint links that they serve.
+//
+// Ports that don't serve HTTP are marked with their app protocol,
+// so that the gateway skips them.
+func (r *Reconciler) determinePorts(uiResourceList *v1alpha1.UIResourceList) ([]v1.ServicePort, []ephconfig.EndpointInfo) {
 	svcPorts := []v1.ServicePort{}
+	endpoints := []ephconfig.EndpointInfo{}
 	names := make(map[string]bool)
-	ports := make(map[int32]bool)
+	ports := make(map[string]string)
 
 	// Add service ports, ensuring unique names and ports.
-	safeAdd := func(name string, port int32) {
-		_, taken := ports[port]
+	// Returns the name of the port.
+	safeAdd := func(name string, port int32, protocol v1.Protocol, appProtocol string) string {
+		key := fmt.Sprintf("%s/%d", protocol, port)
+		existing, taken := ports[key]
 		if taken {
-			return
+			return existing
 		}
 
+		name = portName(name)
 		candidate := name
 		i := 1
 		for {
@@ -527,48 +864,97 @@ func (r *Reconciler) determinePorts(uiResourceList *v1alpha1.UIResourceList) []v
 				break
 			}
 			i++
-			candidate = fmt.Sprintf("%s-%d", name, i)
+			suffix := fmt.Sprintf("-%d", i)
+			candidate = truncatePortName(name, maxPortNameLen-len(suffix)) + suffix
 		}
 
-		svcPorts = append(svcPorts, v1.ServicePort{
+		svcPort := v1.ServicePort{
 			Name:     candidate,
-			Protocol: "TCP",
+			Protocol: protocol,
 			Port:     port,
-		})
+		}
+		if appProtocol != "" && appProtocol != "http" {
+			svcPort.AppProtocol = &appProtocol
+		}
+		svcPorts = append(svcPorts, svcPort)
 		names[candidate] = true
-		ports[port] = true
+		ports[key] = candidate
+		return candidate
 	}
 
-	safeAdd("tilt", 10350)
+	safeAdd("tilt", 10350, v1.ProtocolTCP, "http")
 
 	for _, uiResource := range uiResourceList.Items {
 		for _, link := range uiResource.Status.EndpointLinks {
-			var port int32
-			_, err := fmt.Sscanf(link.URL, "http://0.0.0.0:%d", &port)
-			if err != nil || port == 0 {
-				_, err := fmt.Sscanf(link.URL, "http://localhost:%d", &port)
-				if err != nil || port == 0 {
-					continue
-				}
+			parsed, ok := parseEndpointLink(link.URL)
+			if !ok {
+				continue
+			}
+
+			name := uiResource.Name
+			if link.Name != "" {
+				name = link.Name
+			}
+
+			endpoints = append(endpoints, ephconfig.EndpointInfo{
+				PortName: safeAdd(name, parsed.port, v1.ProtocolTCP, parsed.scheme),
+				Resource: uiResource.Name,
+				Name:     link.Name,
+				Path:     parsed.path,
+			})
+		}
+	}
+
+	if allowlist := r.config.Allowlist(); allowlist != nil {
+		for _, extra := range allowlist.ExtraPorts {
+			protocol := v1.ProtocolTCP
+			if extra.Protocol == string(v1.ProtocolUDP) {
+				protocol = v1.ProtocolUDP
 			}
-			safeAdd(uiResource.Name, port)
+			safeAdd(extra.Name, extra.Port, protocol, strings.ToLower(string(protocol)))
 		}
 	}
 
-	sort.Slice(svcPorts, func(i, j int) bool { return svcPorts[i].Port < svcPorts[j].Port })
-	return svcPorts
+	sort.Slice(svcPorts, func(i, j int) bool {
+		if svcPorts[i].Port != svcPorts[j].Port {
+			return svcPorts[i].Port < svcPorts[j].Port
+		}
+		return svcPorts[i].Protocol < svcPorts[j].Protocol
+	})
+	return svcPorts, endpoints
 }
 
-func (r *Reconciler) desiredService(ctx context.Context, cm *v1.ConfigMap, pod *v1.Pod) (*v1.Service, reconcile.Result, error) {
-	if cm == nil || cm.Name == "" || pod == nil || pod.Name == "" || pod.Status.Phase != v1.PodRunning {
-		return nil, reconcile.Result{}, nil
+// Determine the resources in this tilt instance, for the dashboard.
+func (r *Reconciler) determineResources(uiResourceList *v1alpha1.UIResourceList) []ephconfig.ResourceInfo {
+	result := []ephconfig.ResourceInfo{}
+	for _, uiResource := range uiResourceList.Items {
+		result = append(result, ephconfig.ResourceInfo{
+			Name:     uiResource.Name,
+			Disabled: uiResource.Status.DisableStatus.DisabledCount > 0,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Returns true if the pod is running and all its containers are ready.
+func isPodReady(pod *v1.Pod) bool {
+	if pod == nil || pod.Name == "" || pod.Status.Phase != v1.PodRunning {
+		return false
 	}
 
 	for _, c := range pod.Status.ContainerStatuses {
 		if !c.Ready {
-			return nil, reconcile.Result{}, nil
+			return false
 		}
 	}
+	return true
+}
+
+func (r *Reconciler) desiredService(ctx context.Context, cm *v1.ConfigMap, pod *v1.Pod) (*v1.Service, reconcile.Result, error) {
+	if cm == nil || cm.Name == "" || !isPodReady(pod) {
+		return nil, reconcile.Result{}, nil
+	}
 
 	uiResourceList, err := r.uiResources(ctx, pod)
 	if err != nil {
@@ -585,7 +971,15 @@ func (r *Reconciler) desiredService(ctx context.Context, cm *v1.ConfigMap, pod *
 		}
 	}
 
-	servicePorts := r.determinePorts(uiResourceList)
+	servicePorts, endpointInfos := r.determinePorts(uiResourceList)
+	resources, err := json.Marshal(r.determineResources(uiResourceList))
+	if err != nil {
+		return nil, reconcile.Result{}, err
+	}
+	endpoints, err := json.Marshal(endpointInfos)
+	if err != nil {
+		return nil, reconcile.Result{}, err
+	}
 
 	svc := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -595,6 +989,10 @@ func (r *Reconciler) desiredService(ctx context.Context, cm *v1.ConfigMap, pod *
 				appKey:  appValue,
 				nameKey: nameValue,
 			},
+			Annotations: map[string]string{
+				ephconfig.AnnotationResources: string(resources),
+				ephconfig.AnnotationEndpoints: string(endpoints),
+			},
 		},
 		Spec: v1.ServiceSpec{
 			Selector: map[string]string{
@@ -614,7 +1012,9 @@ func (r *Reconciler) desiredService(ctx context.Context, cm *v1.ConfigMap, pod *
 }
 
 // Reconcile the desired service spec with the current service.
-func (r *Reconciler) maybeUpdateService(ctx context.Context, current, desired *v1.Service) error {
+//
+// Records an event on the env when the exposed ports change.
+func (r *Reconciler) maybeUpdateService(ctx context.Context, cm *v1.ConfigMap, current, desired *v1.Service) error {
 	currentMissing := current == nil || current.Name == ""
 	desiredMissing := desired == nil || desired.Name == ""
 	if currentMissing && desiredMissing {
@@ -628,15 +1028,52 @@ func (r *Reconciler) maybeUpdateService(ctx context.Context, current, desired *v
 
 	if currentMissing {
 		log.FromContext(ctx).Info("creating service")
-		return r.client().Create(ctx, desired)
+		err := r.client().Create(ctx, desired)
+		if err != nil {
+			return err
+		}
+		r.recorder.Eventf(cm, v1.EventTypeNormal, "PortsChanged", "Exposing ports: %s", describePorts(desired.Spec.Ports))
+		return nil
 	}
 
-	if equality.Semantic.DeepEqual(desired.Spec.Ports, current.Spec.Ports) {
+	desiredResources := desired.Annotations[ephconfig.AnnotationResources]
+	desiredEndpoints := desired.Annotations[ephconfig.AnnotationEndpoints]
+	if equality.Semantic.DeepEqual(desired.Spec.Ports, current.Spec.Ports) &&
+		desiredResources == current.Annotations[ephconfig.AnnotationResources] &&
+		desiredEndpoints == current.Annotations[ephconfig.AnnotationEndpoints] {
 		return nil
 	}
 
 	log.FromContext(ctx).Info("updating service")
 	update := current.DeepCopy()
 	update.Spec.Ports = desired.Spec.Ports
-	return r.client().Update(ctx, update)
+	if update.Annotations == nil {
+		update.Annotations = map[string]string{}
+	}
+	update.Annotations[ephconfig.AnnotationResources] = desiredResources
+	update.Annotations[ephconfig.AnnotationEndpoints] = desiredEndpoints
+	err := r.client().Update(ctx, update)
+	if err != nil {
+		return err
+	}
+	if !equality.Semantic.DeepEqual(desired.Spec.Ports, current.Spec.Ports) {
+		r.recorder.Eventf(cm, v1.EventTypeNormal, "PortsChanged", "Exposing ports: %s", describePorts(desired.Spec.Ports))
+	}
+	return nil
+}
+
+// A short human-readable list of ports, e.g., "web:8000, statsd:8125/UDP".
+func describePorts(ports []v1.ServicePort) string {
+	if len(ports) == 0 {
+		return "none"
+	}
+	result := make([]string, 0, len(ports))
+	for _, port := range ports {
+		s := fmt.Sprintf("%s:%d", port.Name, port.Port)
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			s = fmt.Sprintf("%s/%s", s, port.Protocol)
+		}
+		result = append(result, s)
+	}
+	return strings.Join(result, ", ")
 }
@@ -0,0 +1,396 @@
+package env
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/tilt/pkg/apis/core/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestDeterminePorts(t *testing.T) {
+	https := "https"
+	postgres := "postgres"
+	tcp := "tcp"
+	udp := "udp"
+	tiltPort := v1.ServicePort{Name: "tilt", Protocol: "TCP", Port: 10350}
+
+	cases := []struct {
+		fixture    string
+		extraPorts []ephconfig.ExtraPort
+		ports      []v1.ServicePort
+		endpoints  []ephconfig.EndpointInfo
+	}{
+		{
+			fixture: "uiresources-servantes.json",
+			ports: []v1.ServicePort{
+				{Name: "vigoda", Protocol: "TCP", Port: 9000},
+				{Name: "snack", Protocol: "TCP", Port: 9001},
+				{Name: "doggos", Protocol: "TCP", Port: 9002},
+				tiltPort,
+			},
+			endpoints: []ephconfig.EndpointInfo{
+				{PortName: "vigoda", Resource: "vigoda"},
+				{PortName: "snack", Resource: "snack"},
+				{PortName: "vigoda", Resource: "fe"},
+				{PortName: "doggos", Resource: "doggos"},
+			},
+		},
+		{
+			fixture: "uiresources-links.json",
+			ports: []v1.ServicePort{
+				{Name: "web", Protocol: "TCP", Port: 3000},
+				{Name: "web-2", Protocol: "TCP", Port: 3001},
+				{Name: "postgres", Protocol: "TCP", Port: 5432, AppProtocol: &postgres},
+				{Name: "api", Protocol: "TCP", Port: 8443, AppProtocol: &https},
+				tiltPort,
+			},
+			endpoints: []ephconfig.EndpointInfo{
+				{PortName: "api", Resource: "api-server", Name: "API"},
+				{PortName: "api", Resource: "api-server", Name: "Admin UI", Path: "/admin?debug=1"},
+				{PortName: "web", Resource: "web", Path: "/app/#/home"},
+				{PortName: "web-2", Resource: "web"},
+				{PortName: "postgres", Resource: "postgres", Path: "/app"},
+			},
+		},
+		{
+			fixture: "uiresources-links.json",
+			extraPorts: []ephconfig.ExtraPort{
+				{Name: "statsd", Port: 8125, Protocol: "UDP"},
+				{Name: "redis", Port: 6379},
+				{Name: "pg-replica", Port: 5432},
+			},
+			ports: []v1.ServicePort{
+				{Name: "web", Protocol: "TCP", Port: 3000},
+				{Name: "web-2", Protocol: "TCP", Port: 3001},
+				{Name: "postgres", Protocol: "TCP", Port: 5432, AppProtocol: &postgres},
+				{Name: "redis", Protocol: "TCP", Port: 6379, AppProtocol: &tcp},
+				{Name: "statsd", Protocol: "UDP", Port: 8125, AppProtocol: &udp},
+				{Name: "api", Protocol: "TCP", Port: 8443, AppProtocol: &https},
+				tiltPort,
+			},
+			endpoints: []ephconfig.EndpointInfo{
+				{PortName: "api", Resource: "api-server", Name: "API"},
+				{PortName: "api", Resource: "api-server", Name: "Admin UI", Path: "/admin?debug=1"},
+				{PortName: "web", Resource: "web", Path: "/app/#/home"},
+				{PortName: "web-2", Resource: "web"},
+				{PortName: "postgres", Resource: "postgres", Path: "/app"},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d-%s", i, c.fixture), func(t *testing.T) {
+			contents, err := os.ReadFile(filepath.Join("testdata", c.fixture))
+			require.NoError(t, err)
+
+			var list v1alpha1.UIResourceList
+			require.NoError(t, json.Unmarshal(contents, &list))
+
+			r := &Reconciler{config: ephconfig.StaticConfig(&ephconfig.Allowlist{ExtraPorts: c.extraPorts}, "preview.localhost")}
+			ports, endpoints := r.determinePorts(&list)
+			assert.Equal(t, c.ports, ports)
+			assert.Equal(t, c.endpoints, endpoints)
+		})
+	}
+}
+
+func TestParseEndpointLink(t *testing.T) {
+	cases := []struct {
+		url  string
+		ok   bool
+		link endpointLink
+	}{
+		{"http://localhost:8000", true, endpointLink{scheme: "http", port: 8000}},
+		{"http://0.0.0.0:8000/", true, endpointLink{scheme: "http", port: 8000}},
+		{"https://127.0.0.1:8443/api", true, endpointLink{scheme: "https", port: 8443, path: "/api"}},
+		{"http://localhost/", true, endpointLink{scheme: "http", port: 80}},
+		{"https://localhost", true, endpointLink{scheme: "https", port: 443}},
+		{"http://[::1]:3000/?q=a%20b", true, endpointLink{scheme: "http", port: 3000, path: "/?q=a%20b"}},
+		{"https://example.com:8443/", false, endpointLink{}},
+		{"postgres://localhost:5432/app", true, endpointLink{scheme: "postgres", port: 5432, path: "/app"}},
+		{"grpc://0.0.0.0:50051", true, endpointLink{scheme: "grpc", port: 50051}},
+		{"redis://localhost", false, endpointLink{}},
+		{"http://localhost:99999/", false, endpointLink{}},
+		{"not a url", false, endpointLink{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			link, ok := parseEndpointLink(c.url)
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.link, link)
+		})
+	}
+}
+
+func TestCreatePodRejected(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{
+		recorder: recorder,
+		config:   ephconfig.StaticConfig(&ephconfig.Allowlist{RepoBase: "https://github.com/tilt-dev", RepoNames: []string{"tilt"}}, "preview.localhost"),
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Data:       map[string]string{"repo": "https://github.com/evil/repo"},
+	}
+
+	pod, err := r.createPod(context.Background(), cm)
+	require.NoError(t, err)
+	assert.Nil(t, pod)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning Rejected Env spec rejected: ")
+}
+
+func TestCreatePodGroupLimit(t *testing.T) {
+	allowlist := &ephconfig.Allowlist{
+		RepoBase:  "https://github.com/tilt-dev",
+		RepoNames: []string{"tilt"},
+		Sizes:     []ephconfig.SizeClass{{Name: "small", CPU: "1", Memory: "2Gi"}},
+		Groups:    []ephconfig.GroupPolicy{{Name: "design", TTL: "2h", MaxEnvs: 1}},
+	}
+	newEnv := func(name string, created time.Time) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				Labels:            map[string]string{appKey: appValue, nameKey: nameValue},
+				Annotations:       map[string]string{ephconfig.AnnotationGroup: "design"},
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Data: map[string]string{"repo": "https://github.com/tilt-dev/tilt", "branch": "master", "path": "Tiltfile"},
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	alice := newEnv("alice", now.Add(-time.Minute))
+	bob := newEnv("bob", now)
+
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{
+		cluster:  fakeCluster{client: fake.NewClientBuilder().WithObjects(alice, bob).Build()},
+		recorder: recorder,
+		config:   ephconfig.StaticConfig(allowlist, "preview.localhost"),
+	}
+	assert.Equal(t, 2*time.Hour, r.envTTL(alice))
+
+	// Bob's env came second, so it's over the group's limit.
+	pod, err := r.createPod(context.Background(), bob)
+	require.NoError(t, err)
+	assert.Nil(t, pod)
+	assert.Contains(t, <-recorder.Events, "Warning Rejected Env spec rejected: Forbidden: group design may only run 1 envs at once")
+
+	pod, err = r.createPod(context.Background(), alice)
+	require.NoError(t, err)
+	require.NotNil(t, pod)
+	assert.Equal(t, "1", pod.Spec.Containers[0].Resources.Requests.Cpu().String())
+	assert.Equal(t, "2Gi", pod.Spec.Containers[0].Resources.Requests.Memory().String())
+}
+
+func TestCreatePodRepoSettings(t *testing.T) {
+	allowlist := &ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{
+			Base:  "https://gitea.internal/team",
+			Names: []string{"svc-*"},
+			Settings: ephconfig.RepoSettings{
+				TiltArgs:  []string{"--legacy=false", "--port=10351"},
+				Resources: []string{"api", "web"},
+				Env:       []ephconfig.EnvVar{{Name: "FEATURE_FLAGS", Value: "a,b"}},
+				Image:     "registry.internal/tilt-upper:custom",
+			},
+		}},
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Data:       map[string]string{"repo": "https://gitea.internal/team/svc-api", "branch": "main", "path": "Tiltfile"},
+	}
+	r := &Reconciler{
+		cluster:  fakeCluster{client: fake.NewClientBuilder().WithObjects(cm).Build()},
+		recorder: record.NewFakeRecorder(10),
+		config:   ephconfig.StaticConfig(allowlist, "preview.localhost"),
+	}
+
+	pod, err := r.createPod(context.Background(), cm)
+	require.NoError(t, err)
+	require.NotNil(t, pod)
+
+	upper := pod.Spec.Containers[1]
+	assert.Equal(t, "registry.internal/tilt-upper:custom", upper.Image)
+	env := map[string]string{}
+	for _, v := range upper.Env {
+		env[v.Name] = v.Value
+	}
+	assert.Equal(t, "--legacy=false\n--port=10351", env["TILT_UPPER_ARGS"])
+	assert.Equal(t, "api\nweb", env["TILT_UPPER_TILTFILE_ARGS"])
+	assert.Equal(t, "a,b", env["FEATURE_FLAGS"])
+	assert.Equal(t, "main", env["TILT_UPPER_BRANCH"])
+}
+
+func TestCreatePodParams(t *testing.T) {
+	allowlist := &ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{
+			Base:  "https://gitea.internal/team",
+			Names: []string{"svc-*"},
+			Settings: ephconfig.RepoSettings{
+				TiltfileArgs: []string{"--env=preview"},
+				Env:          []ephconfig.EnvVar{{Name: "FEATURE_FLAGS", Value: "a,b"}},
+				Params: []ephconfig.Param{
+					{Name: "replicas", Type: ephconfig.ParamTypeInt, Default: "1"},
+					{Name: "seed", Type: ephconfig.ParamTypeBool},
+					{Name: "LOG_LEVEL", Kind: ephconfig.ParamKindEnv, Enum: []string{"info", "debug"}},
+				},
+			},
+		}},
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+		Data: map[string]string{
+			"repo":          "https://gitea.internal/team/svc-api",
+			"branch":        "main",
+			"path":          "Tiltfile",
+			"env.LOG_LEVEL": "debug",
+		},
+	}
+	r := &Reconciler{
+		cluster:  fakeCluster{client: fake.NewClientBuilder().WithObjects(cm).Build()},
+		recorder: record.NewFakeRecorder(10),
+		config:   ephconfig.StaticConfig(allowlist, "preview.localhost"),
+	}
+
+	pod, err := r.createPod(context.Background(), cm)
+	require.NoError(t, err)
+	require.NotNil(t, pod)
+
+	env := map[string]string{}
+	for _, v := range pod.Spec.Containers[1].Env {
+		env[v.Name] = v.Value
+	}
+	assert.Equal(t, "--env=preview\n--replicas=1", env["TILT_UPPER_TILTFILE_ARGS"])
+	assert.Equal(t, "a,b", env["FEATURE_FLAGS"])
+	assert.Equal(t, "debug", env["LOG_LEVEL"])
+}
+
+func TestDescribePorts(t *testing.T) {
+	assert.Equal(t, "none", describePorts(nil))
+	assert.Equal(t, "web:8000, statsd:8125/UDP", describePorts([]v1.ServicePort{
+		{Name: "web", Port: 8000, Protocol: "TCP"},
+		{Name: "statsd", Port: 8125, Protocol: "UDP"},
+	}))
+}
+
+func TestPodSpecChanged(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "alice"},
+		Data:       map[string]string{"repo": "https://github.com/tilt-dev/tilt", "expiration": "2022-03-01T12:00:00Z"},
+	}
+	r := &Reconciler{}
+	anno, err := r.createAnnotation(cm)
+	require.NoError(t, err)
+	assert.NotContains(t, anno, "expiration")
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{configKey: anno}}}
+	assert.False(t, podSpecChanged(pod, cm))
+
+	// Extending the env doesn't restart it.
+	extended := cm.DeepCopy()
+	extended.Data["expiration"] = "2022-03-01T13:00:00Z"
+	assert.False(t, podSpecChanged(pod, extended))
+
+	// Pods from older versions recorded the expiration.
+	legacy := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		configKey: `{"expiration":"2022-03-01T12:00:00Z","repo":"https://github.com/tilt-dev/tilt"}`,
+	}}}
+	assert.False(t, podSpecChanged(legacy, extended))
+
+	changed := cm.DeepCopy()
+	changed.Data["repo"] = "https://github.com/tilt-dev/tilt-example-go"
+	assert.True(t, podSpecChanged(pod, changed))
+	assert.True(t, podSpecChanged(&v1.Pod{}, cm))
+}
+
+func TestCreatePodWithoutGroup(t *testing.T) {
+	allowlist := &ephconfig.Allowlist{
+		RepoBase:  "https://github.com/tilt-dev",
+		RepoNames: []string{"tilt"},
+		Groups:    []ephconfig.GroupPolicy{{Name: "design", TTL: "2h", MaxEnvs: 1}},
+	}
+
+	// Created before the allowlist had groups, so it has no group annotation.
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "alice",
+			Namespace: "default",
+			Labels:    map[string]string{appKey: appValue, nameKey: nameValue},
+		},
+		Data: map[string]string{"repo": "https://github.com/tilt-dev/tilt", "branch": "master", "path": "Tiltfile"},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	r := &Reconciler{
+		cluster:  fakeCluster{client: fake.NewClientBuilder().WithObjects(cm).Build()},
+		recorder: recorder,
+		config:   ephconfig.StaticConfig(allowlist, "preview.localhost"),
+	}
+	assert.Equal(t, defaultExpiration, r.envTTL(cm))
+
+	// It doesn't get around the groups' limits.
+	pod, err := r.createPod(context.Background(), cm)
+	require.NoError(t, err)
+	assert.Nil(t, pod)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning Rejected Env spec rejected: Forbidden: env has no group")
+}
+
+func TestIgnoreActivityUpdates(t *testing.T) {
+	base := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "nick",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{ephconfig.AnnotationLastActivity: "2021-01-01T00:00:00Z"},
+		},
+		Data: map[string]string{"repo": "tilt-dev/servantes"},
+	}
+
+	touched := base.DeepCopy()
+	touched.ResourceVersion = "2"
+	touched.Annotations[ephconfig.AnnotationLastActivity] = "2021-01-01T00:01:00Z"
+
+	firstTouch := base.DeepCopy()
+	firstTouch.Annotations = nil
+
+	touchedAndEdited := touched.DeepCopy()
+	touchedAndEdited.Data["branch"] = "main"
+
+	edited := base.DeepCopy()
+	edited.ResourceVersion = "2"
+	edited.Annotations[ephconfig.AnnotationShareID] = "s1"
+
+	cases := []struct {
+		old, new *v1.ConfigMap
+		expected bool
+	}{
+		{base, touched, false},
+		{firstTouch, base, false},
+		{base, touchedAndEdited, true},
+		{base, edited, true},
+
+		// Resyncs still reconcile.
+		{base, base, true},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestIgnoreActivityUpdates%d", i), func(t *testing.T) {
+			assert.Equal(t, c.expected, ignoreActivityUpdates.Update(event.UpdateEvent{ObjectOld: c.old, ObjectNew: c.new}))
+		})
+	}
+}
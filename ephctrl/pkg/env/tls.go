@@ -0,0 +1,73 @@
+package env
+
+import (
+	"fmt"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Asks cert-manager to issue certificates for every TLS entry of an Ingress.
+//
+// We only set it on Ingresses where ephctrl owns every TLS entry,
+// so cert-manager never takes over the operator's certificates.
+const certIssuerKey = "cert-manager.io/cluster-issuer"
+
+// cert-manager's Certificate kind. We use unstructured objects,
+// so that ephctrl doesn't depend on the cert-manager API types.
+var certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+// The TLS entry for an env's hosts.
+//
+// With a wildcard certificate, all envs share the same secret.
+// With cert-manager, each env gets its own secret.
+//
+// Returns nil if the gateway doesn't serve env hosts over TLS.
+func envTLS(tls ephconfig.GatewayTLS, env string, hosts []string) *networkingv1.IngressTLS {
+	if tls.WildcardSecretName != "" {
+		return &networkingv1.IngressTLS{
+			Hosts:      hosts,
+			SecretName: tls.WildcardSecretName,
+		}
+	}
+	if tls.CertIssuer != "" {
+		return &networkingv1.IngressTLS{
+			Hosts:      hosts,
+			SecretName: fmt.Sprintf("%s-tls", env),
+		}
+	}
+	return nil
+}
+
+// A cert-manager Certificate for the secret of an env's TLS entry.
+//
+// The shared gateway Ingress has TLS entries that the operator owns,
+// so we ask for the env certificates directly instead of annotating it.
+func envCertificate(issuer, namespace, env string, tls networkingv1.IngressTLS) *unstructured.Unstructured {
+	dnsNames := []interface{}{}
+	for _, host := range tls.Hosts {
+		dnsNames = append(dnsNames, host)
+	}
+
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetName(tls.SecretName)
+	cert.SetNamespace(namespace)
+	cert.SetLabels(map[string]string{
+		appKey:          appValue,
+		nameKey:         nameCertValue,
+		ephOwnerNameKey: env,
+	})
+	cert.Object["spec"] = map[string]interface{}{
+		"secretName": tls.SecretName,
+		"dnsNames":   dnsNames,
+		"issuerRef": map[string]interface{}{
+			"group": "cert-manager.io",
+			"kind":  "ClusterIssuer",
+			"name":  issuer,
+		},
+	}
+	return cert
+}
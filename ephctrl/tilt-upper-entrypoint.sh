@@ -30,7 +30,30 @@ cd src
 git checkout "$TILT_UPPER_BRANCH"
 cd "$(dirname "$TILT_UPPER_PATH")"
 
+# Extra tilt up flags, and the args after --, from the allowlist. One per line.
+TILT_ARGS=()
+if [[ "${TILT_UPPER_ARGS:-}" != "" ]]; then
+    mapfile -t TILT_ARGS <<< "$TILT_UPPER_ARGS"
+fi
+TILTFILE_ARGS=()
+if [[ "${TILT_UPPER_TILTFILE_ARGS:-}" != "" ]]; then
+    mapfile -t TILTFILE_ARGS <<< "$TILT_UPPER_TILTFILE_ARGS"
+fi
+
 export DO_NOT_TRACK="1"
 k3d registry create --image="$K3D_IMAGE_REGISTRY"
 k3d cluster create --image="$K3D_IMAGE_K3S" --registry-use k3d-registry
-tilt up -f "$(basename "$TILT_UPPER_PATH")" --host=0.0.0.0
+
+# ephctrl restarts tilt by killing the pid in this file,
+# so keep tilt up running in a loop.
+set +e
+while true
+do
+    tilt up -f "$(basename "$TILT_UPPER_PATH")" --host=0.0.0.0 \
+         ${TILT_ARGS[@]+"${TILT_ARGS[@]}"} \
+         -- ${TILTFILE_ARGS[@]+"${TILTFILE_ARGS[@]}"} &
+    echo "$!" > /tmp/tilt-up.pid
+    wait "$!"
+    echo "tilt up exited with status $?, restarting"
+    sleep 1
+done
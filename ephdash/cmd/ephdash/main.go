@@ -7,14 +7,23 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephconfig/live"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/apitoken"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
 	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
 	"github.com/tilt-dev/ephemerator/ephdash/pkg/server"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
 )
 
 var authFakeUser = flag.String(
@@ -25,9 +34,68 @@ var authProxy = flag.String(
 	"auth-proxy", "",
 	"URL of the oauth2-proxy inside the cluster, e.g., 'http://oauth-proxy'. Must not end in a slash.")
 
+var authProxyJWTIssuer = flag.String(
+	"auth-proxy-jwt-issuer", "",
+	"URL of the OIDC issuer behind the oauth proxy. When specified, requests may prove their identity headers with an ID token from the issuer in the Authorization header, instead of the shared secret in EPH_AUTH_PROXY_SECRET.")
+
+var authProxyJWTAudience = flag.String(
+	"auth-proxy-jwt-audience", "",
+	"The audience of ID tokens from the proxy's issuer, usually the proxy's client ID.")
+
+var authProxyJWTUserClaim = flag.String(
+	"auth-proxy-jwt-user-claim", "preferred_username",
+	"The ID token claim that must match the X-Auth-Request-User header.")
+
+var authOIDCIssuer = flag.String(
+	"auth-oidc-issuer", "",
+	"URL of an OpenID Connect issuer. When specified, ephdash signs users in itself instead of using the oauth proxy. Reads the client secret from EPH_OIDC_CLIENT_SECRET and the cookie secret from EPH_OIDC_COOKIE_SECRET.")
+
+var authOIDCClientID = flag.String(
+	"auth-oidc-client-id", "",
+	"The OIDC client ID registered with the issuer.")
+
+var authOIDCRedirectURL = flag.String(
+	"auth-oidc-redirect-url", "",
+	"The URL of /oauth2/callback registered with the issuer. Defaults to the callback on the gateway host.")
+
+var authOIDCScopes = flag.String(
+	"auth-oidc-scopes", "openid,profile,email",
+	"Comma-separated list of OIDC scopes to request. Some issuers need offline_access to return refresh tokens.")
+
+var authOIDCUserClaim = flag.String(
+	"auth-oidc-user-claim", "preferred_username",
+	"The ID token claim with the user name. The user name names the env, so must be a valid DNS label.")
+
+var authOIDCGroupsClaim = flag.String(
+	"auth-oidc-groups-claim", "groups",
+	"The ID token claim with the user's groups.")
+
+var adminUsers = flag.String(
+	"admin-users", "",
+	"Comma-separated list of users who may use the admin pages.")
+
+var adminEmails = flag.String(
+	"admin-emails", "",
+	"Comma-separated list of emails whose users may use the admin pages.")
+
+var adminGroups = flag.String(
+	"admin-groups", "",
+	"Comma-separated list of groups whose members may use the admin pages.")
+
+var auditLogFile = flag.String(
+	"audit-log-file", "",
+	"When specified, audit entries are also appended to this file, e.g., on a persistent volume. Entries are always written to stdout.")
+
+var metricsAddr = flag.String(
+	"metrics-addr", ":9090",
+	"Address to serve Prometheus metrics on. Kept off the main port so that metrics aren't exposed through the gateway.")
+
 func main() {
 	flag.Parse()
 
+	// Config reloads are logged through the controller-runtime logger.
+	ctrllog.SetLogger(zap.New())
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		log.Fatalf("kubernetes connection setup failed: %v", err)
@@ -42,36 +110,99 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	envClient := env.NewClient(ctx, clientset, os.Getenv("NAMESPACE"), os.Getenv("EPH_SLACK_WEBHOOK"))
+	envClient := env.NewClient(ctx, clientset, os.Getenv("NAMESPACE"))
+	tokens := apitoken.NewStore(clientset, os.Getenv("NAMESPACE"))
 
-	allowlist, err := ephconfig.ReadAllowlist()
+	notifiers, err := notify.ReadNotifiers()
 	if err != nil {
-		log.Fatal("server setup failed")
+		log.Fatalf("server setup failed: %v", err)
 	}
+	notifier := notify.NewDispatcher(notifiers...)
+	go notifier.Run(ctx)
 
-	gatewayHost, err := ephconfig.ReadGatewayHost()
+	// Start with the config from env vars, then follow edits to the ConfigMap.
+	initialConfig, err := ephconfig.ReadConfig()
 	if err != nil {
-		log.Fatal("server setup failed")
+		log.Fatalf("server setup failed: %v", err)
+	}
+	liveConfig := ephconfig.NewLiveConfig(initialConfig)
+	prometheus.MustRegister(live.NewCollector(liveConfig, "ephdash"))
+	go live.Watch(ctx, liveConfig, clientset, os.Getenv("NAMESPACE"))
+	log.Printf("loaded config %s", liveConfig.Version())
+
+	gatewayTLS, err := ephconfig.ReadGatewayTLS()
+	if err != nil {
+		log.Fatalf("server setup failed: %v", err)
 	}
 
 	authSettings := server.AuthSettings{
-		FakeUser: *authFakeUser,
-		Proxy:    *authProxy,
+		FakeUser:    *authFakeUser,
+		Proxy:       *authProxy,
+		ShareSecret: os.Getenv("EPH_SHARE_SECRET"),
+		CSRFSecret:  os.Getenv("EPH_CSRF_SECRET"),
+
+		ProxySecret:       os.Getenv("EPH_AUTH_PROXY_SECRET"),
+		ProxyJWTIssuer:    *authProxyJWTIssuer,
+		ProxyJWTAudience:  *authProxyJWTAudience,
+		ProxyJWTUserClaim: *authProxyJWTUserClaim,
 	}
+	if *authOIDCIssuer != "" {
+		authSettings.OIDC = server.OIDCSettings{
+			IssuerURL:    *authOIDCIssuer,
+			ClientID:     *authOIDCClientID,
+			ClientSecret: os.Getenv("EPH_OIDC_CLIENT_SECRET"),
+			RedirectURL:  *authOIDCRedirectURL,
+			CookieSecret: os.Getenv("EPH_OIDC_COOKIE_SECRET"),
+			UserClaim:    *authOIDCUserClaim,
+			GroupsClaim:  *authOIDCGroupsClaim,
+			Scopes:       splitList(*authOIDCScopes),
+		}
+	}
+	authSettings.AdminUsers = splitList(*adminUsers)
+	authSettings.AdminEmails = splitList(*adminEmails)
+	authSettings.AdminGroups = splitList(*adminGroups)
 
 	err = authSettings.Validate()
 	if err != nil {
 		log.Fatalf("server setup failed: %v", err)
 	}
 
-	handler, err := server.NewServer(envClient, allowlist, gatewayHost, authSettings)
+	auditLog := audit.NewLogger(os.Stdout, audit.DefaultCapacity)
+	if *auditLogFile != "" {
+		err = auditLog.OpenFile(*auditLogFile)
+		if err != nil {
+			log.Fatalf("server setup failed: %v", err)
+		}
+	}
+
+	handler, err := server.NewServer(envClient, auditLog, notifier, tokens, liveConfig, gatewayTLS, authSettings)
 	if err != nil {
 		log.Fatal(err)
 	}
 	http.Handle("/", handler)
 
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			log.Fatalf("metrics server failed: %v", err)
+		}
+	}()
+
 	fmt.Printf("Starting server at port 8080\n")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// Split a comma-separated flag value, skipping empty items.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
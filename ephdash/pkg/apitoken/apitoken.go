@@ -0,0 +1,281 @@
+// Package apitoken stores personal API tokens, so that CI jobs can call the
+// ephdash JSON API as a user without an oauth2-proxy cookie.
+//
+// Tokens live in a single Secret, keyed by the SHA-256 hash of the token.
+// We never store the token itself, so we can only show it once.
+package apitoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// The Secret that holds every user's tokens.
+const SecretName = "ephtokens"
+
+// Every token starts with this prefix, so that we can tell tokens
+// from other bearer tokens, and secret scanners can find leaked ones.
+const Prefix = "eph_"
+
+// The number of hex digits of the hash we show users to tell tokens apart.
+const idLength = 12
+
+// The most tokens a user may have at once.
+const MaxPerUser = 20
+
+// The longest a token may live.
+const MaxTTL = 90 * 24 * time.Hour
+
+type Scope string
+
+const (
+	// Read the user's env and the status of its actions.
+	ScopeRead Scope = "env:read"
+
+	// Create, update and delete the user's env, run actions, and mint share links.
+	ScopeWrite Scope = "env:write"
+)
+
+var Scopes = []Scope{ScopeRead, ScopeWrite}
+
+// Returned when the token is unknown or expired,
+// as opposed to when we can't read the tokens at all.
+var ErrInvalid = errors.New("invalid API token")
+
+// A token, without the secret part.
+//
+// We keep the email and groups the user had when they minted the token,
+// so that CI gets the same group policy as the user.
+type Token struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	Email   string    `json:"email,omitempty"`
+	Groups  []string  `json:"groups,omitempty"`
+	Scopes  []Scope   `json:"scopes"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (t Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+type Store struct {
+	clientset kubernetes.Interface
+	namespace string
+	now       func() time.Time
+}
+
+func NewStore(clientset kubernetes.Interface, namespace string) *Store {
+	return &Store{clientset: clientset, namespace: namespace, now: time.Now}
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the Secret with the tokens, and whether it exists yet.
+func (s *Store) get(ctx context.Context) (*v1.Secret, bool, error) {
+	secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(ctx, SecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      SecretName,
+				Namespace: s.namespace,
+				Labels: map[string]string{
+					ephconfig.LabelAppKey: ephconfig.LabelAppValueEphemerator,
+				},
+			},
+		}, false, nil
+	}
+	return secret, err == nil, err
+}
+
+func (s *Store) save(ctx context.Context, secret *v1.Secret, exists bool) error {
+	if !exists {
+		_, err := s.clientset.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	_, err := s.clientset.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// Retry read-modify-write when someone else wrote the Secret first,
+// including when two replicas race to create it.
+func update(fn func() error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, fn)
+}
+
+func decode(data []byte) (Token, error) {
+	var t Token
+	err := json.Unmarshal(data, &t)
+	return t, err
+}
+
+// Mints a new token for the user.
+//
+// Returns the token itself, which we can't show again, and its metadata.
+func (s *Store) Create(ctx context.Context, t Token, ttl time.Duration) (string, Token, error) {
+	if t.Name == "" {
+		return "", Token{}, fmt.Errorf("Missing token name")
+	}
+	if len(t.Scopes) == 0 {
+		return "", Token{}, fmt.Errorf("Missing token scopes")
+	}
+	for _, scope := range t.Scopes {
+		if scope != ScopeRead && scope != ScopeWrite {
+			return "", Token{}, fmt.Errorf("Unknown token scope: %s", scope)
+		}
+	}
+	if ttl <= 0 || ttl > MaxTTL {
+		return "", Token{}, fmt.Errorf("Tokens must expire within %d days", int(MaxTTL.Hours()/24))
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", Token{}, err
+	}
+	value := Prefix + base64.RawURLEncoding.EncodeToString(b)
+	key := hash(value)
+
+	now := s.now()
+	t.ID = key[:idLength]
+	t.Created = now
+	t.Expires = now.Add(ttl)
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	err = update(func() error {
+		secret, exists, err := s.get(ctx)
+		if err != nil {
+			return err
+		}
+		secret = secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+
+		count := 0
+		for k, v := range secret.Data {
+			existing, err := decode(v)
+			if err != nil || existing.Expired(now) {
+				// Clean up as we go, so expired tokens don't pile up.
+				delete(secret.Data, k)
+				continue
+			}
+			if existing.User == t.User {
+				count++
+			}
+		}
+		if count >= MaxPerUser {
+			return fmt.Errorf("Forbidden: users may only have %d API tokens", MaxPerUser)
+		}
+
+		secret.Data[key] = data
+		return s.save(ctx, secret, exists)
+	})
+	if err != nil {
+		return "", Token{}, err
+	}
+	return value, t, nil
+}
+
+// Lists the user's tokens that haven't expired, newest first.
+func (s *Store) List(ctx context.Context, user string) ([]Token, error) {
+	secret, _, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var result []Token
+	for _, v := range secret.Data {
+		t, err := decode(v)
+		if err != nil || t.User != user || t.Expired(now) {
+			continue
+		}
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result, nil
+}
+
+// Revokes one of the user's tokens. Users can't revoke each other's tokens.
+func (s *Store) Revoke(ctx context.Context, user, id string) error {
+	return update(func() error {
+		secret, exists, err := s.get(ctx)
+		if err != nil {
+			return err
+		}
+		for k, v := range secret.Data {
+			t, err := decode(v)
+			if err != nil || t.User != user || t.ID != id {
+				continue
+			}
+			secret = secret.DeepCopy()
+			delete(secret.Data, k)
+			return s.save(ctx, secret, exists)
+		}
+		return fmt.Errorf("%w: no token %s for user %s", ErrInvalid, id, user)
+	})
+}
+
+// Finds the token. Returns ErrInvalid if it's unknown or expired.
+func (s *Store) Lookup(ctx context.Context, value string) (Token, error) {
+	if !strings.HasPrefix(value, Prefix) {
+		return Token{}, fmt.Errorf("%w: missing %s prefix", ErrInvalid, Prefix)
+	}
+	secret, _, err := s.get(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+
+	// The key is a hash of a random token, so looking it up by key
+	// doesn't leak anything through timing.
+	data, ok := secret.Data[hash(value)]
+	if !ok {
+		return Token{}, fmt.Errorf("%w: unknown token", ErrInvalid)
+	}
+	t, err := decode(data)
+	if err != nil {
+		return Token{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if t.Expired(s.now()) {
+		return Token{}, fmt.Errorf("%w: %s expired at %s", ErrInvalid, t.ID, t.Expires.Format(time.RFC3339))
+	}
+	return t, nil
+}
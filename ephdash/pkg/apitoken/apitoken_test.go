@@ -0,0 +1,107 @@
+package apitoken
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newFakeStore() (*Store, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset()
+	return NewStore(clientset, "ephemerator"), clientset
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	ctx := context.Background()
+	s, clientset := newFakeStore()
+
+	value, token, err := s.Create(ctx, Token{
+		Name:   "ci",
+		User:   "alice",
+		Groups: []string{"eng"},
+		Scopes: []Scope{ScopeRead},
+	}, time.Hour)
+	require.NoError(t, err)
+	assert.Contains(t, value, Prefix)
+	assert.Len(t, token.ID, idLength)
+
+	found, err := s.Lookup(ctx, value)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", found.User)
+	assert.Equal(t, []string{"eng"}, found.Groups)
+	assert.True(t, found.HasScope(ScopeRead))
+	assert.False(t, found.HasScope(ScopeWrite))
+
+	// Only the hash is stored.
+	secret, err := clientset.CoreV1().Secrets("ephemerator").Get(ctx, SecretName, metav1.GetOptions{})
+	require.NoError(t, err)
+	for k, v := range secret.Data {
+		assert.NotContains(t, k, value)
+		assert.NotContains(t, string(v), value)
+	}
+
+	_, err = s.Lookup(ctx, value+"x")
+	assert.True(t, errors.Is(err, ErrInvalid))
+	_, err = s.Lookup(ctx, "not-a-token")
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newFakeStore()
+
+	value, _, err := s.Create(ctx, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeRead}}, time.Hour)
+	require.NoError(t, err)
+
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = s.Lookup(ctx, value)
+	assert.True(t, errors.Is(err, ErrInvalid))
+
+	tokens, err := s.List(ctx, "alice")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	_, _, err = s.Create(ctx, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeRead}}, MaxTTL+time.Hour)
+	assert.Error(t, err)
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newFakeStore()
+
+	value, token, err := s.Create(ctx, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeWrite}}, time.Hour)
+	require.NoError(t, err)
+
+	// Users can't revoke each other's tokens.
+	err = s.Revoke(ctx, "bob", token.ID)
+	assert.True(t, errors.Is(err, ErrInvalid))
+
+	require.NoError(t, s.Revoke(ctx, "alice", token.ID))
+	_, err = s.Lookup(ctx, value)
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestMaxPerUser(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newFakeStore()
+
+	for i := 0; i < MaxPerUser; i++ {
+		_, _, err := s.Create(ctx, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeRead}}, time.Hour)
+		require.NoError(t, err)
+	}
+	_, _, err := s.Create(ctx, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeRead}}, time.Hour)
+	assert.Error(t, err)
+
+	_, _, err = s.Create(ctx, Token{Name: "ci", User: "bob", Scopes: []Scope{ScopeRead}}, time.Hour)
+	assert.NoError(t, err)
+
+	tokens, err := s.List(ctx, "alice")
+	require.NoError(t, err)
+	assert.Len(t, tokens, MaxPerUser)
+}
@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+// Actions that users take on envs.
+//
+// Tilt actions (like "trigger" or "restart") are recorded
+// under their own names.
+const (
+	ActionCreate     = "create"
+	ActionUpdate     = "update"
+	ActionDelete     = "delete"
+	ActionExtend     = "extend"
+	ActionVisibility = "visibility"
+	ActionRevoke     = "revoke-shares"
+
+	// API tokens aren't tied to an env, but they can change it.
+	ActionCreateToken = "create-token"
+	ActionRevokeToken = "revoke-token"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeDenied  Outcome = "denied"
+	OutcomeError   Outcome = "error"
+)
+
+// A single audit record, written as one line of JSON.
+type Entry struct {
+	Time     time.Time          `json:"time"`
+	User     string             `json:"user"`
+	Action   string             `json:"action"`
+	Env      string             `json:"env"`
+	Resource string             `json:"resource,omitempty"`
+	Spec     *ephconfig.EnvSpec `json:"spec,omitempty"`
+	Detail   string             `json:"detail,omitempty"`
+	SourceIP string             `json:"sourceIP,omitempty"`
+	Outcome  Outcome            `json:"outcome"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// Filters entries for a query. Empty fields match everything.
+type Query struct {
+	User   string
+	Env    string
+	Action string
+	Limit  int
+}
+
+func (q Query) matches(e Entry) bool {
+	return (q.User == "" || q.User == e.User) &&
+		(q.Env == "" || q.Env == e.Env) &&
+		(q.Action == "" || q.Action == e.Action)
+}
+
+// The number of entries kept in memory for queries.
+const DefaultCapacity = 1000
+
+// Writes audit entries as JSON lines to stdout (for the cluster
+// log collector) and optionally to a persistent file, and keeps
+// the most recent entries in memory for the admin page.
+type Logger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	sink     io.Writer
+	recent   []Entry
+	capacity int
+}
+
+func NewLogger(out io.Writer, capacity int) *Logger {
+	return &Logger{out: out, capacity: capacity}
+}
+
+// Append entries to the file at path, creating it if needed.
+//
+// Entries already in the file are loaded, so that the admin page
+// survives restarts when the file is on a persistent volume.
+func (l *Logger) OpenFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		l.remember(e)
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("reading audit log: %v", err)
+	}
+
+	l.sink = f
+	return nil
+}
+
+// Record an entry. Failures to write are logged, but never fail the request.
+func (l *Logger) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	content, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error: encoding audit entry: %v", err)
+		return
+	}
+	content = append(content, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remember(e)
+	if _, err := l.out.Write(content); err != nil {
+		log.Printf("error: writing audit entry: %v", err)
+	}
+	if l.sink != nil {
+		if _, err := l.sink.Write(content); err != nil {
+			log.Printf("error: writing audit entry to file: %v", err)
+		}
+	}
+}
+
+func (l *Logger) remember(e Entry) {
+	l.recent = append(l.recent, e)
+	if len(l.recent) > l.capacity {
+		l.recent = append([]Entry(nil), l.recent[len(l.recent)-l.capacity:]...)
+	}
+}
+
+// The most recent entries matching the query, newest first.
+func (l *Logger) Query(q Query) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := []Entry{}
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+		if q.matches(l.recent[i]) {
+			result = append(result, l.recent[i])
+		}
+	}
+	return result
+}
+
+// The address of the client that made the request.
+//
+// ephdash only runs behind the ingress and oauth2-proxy. The ingress
+// sets X-Real-Ip, overwriting any value from the client. Otherwise, we take the
+// last X-Forwarded-For hop, which our proxy appended. Earlier hops
+// come from the client, which can put anything there.
+func SourceIP(r *http.Request) string {
+	if real := strings.TrimSpace(r.Header.Get("X-Real-Ip")); real != "" {
+		return real
+	}
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
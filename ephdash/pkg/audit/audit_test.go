@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+func TestRecordWritesJSONLines(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	l := NewLogger(out, 10)
+	l.Record(Entry{User: "alice", Action: ActionCreate, Env: "alice",
+		Spec:    &ephconfig.EnvSpec{Repo: "https://github.com/tilt-dev/tilt", Branch: "master", Path: "Tiltfile"},
+		Outcome: OutcomeSuccess})
+	l.Record(Entry{User: "bob", Action: ActionDelete, Env: "bob", Outcome: OutcomeError, Error: "boom"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var e Entry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "alice", e.User)
+	assert.Equal(t, "master", e.Spec.Branch)
+	assert.False(t, e.Time.IsZero())
+	assert.Contains(t, lines[0], `"spec":{"repo":"https://github.com/tilt-dev/tilt","branch":"master","path":"Tiltfile"}`)
+	assert.Contains(t, lines[1], `"outcome":"error","error":"boom"`)
+}
+
+func TestQuery(t *testing.T) {
+	l := NewLogger(bytes.NewBuffer(nil), 3)
+	l.Record(Entry{User: "alice", Action: ActionCreate})
+	l.Record(Entry{User: "bob", Action: ActionCreate})
+	l.Record(Entry{User: "alice", Action: "restart"})
+	l.Record(Entry{User: "alice", Action: ActionDelete})
+
+	// The oldest entry falls out of the buffer.
+	assert.Equal(t, []string{ActionDelete, "restart"}, actions(l.Query(Query{User: "alice"})))
+	assert.Equal(t, []string{ActionDelete}, actions(l.Query(Query{User: "alice", Limit: 1})))
+	assert.Equal(t, []string{ActionCreate}, actions(l.Query(Query{Action: ActionCreate})))
+	assert.Empty(t, l.Query(Query{Env: "carol"}))
+}
+
+func TestOpenFileLoadsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l := NewLogger(bytes.NewBuffer(nil), 10)
+	require.NoError(t, l.OpenFile(path))
+	l.Record(Entry{User: "alice", Action: ActionCreate})
+	l.Record(Entry{User: "alice", Action: ActionDelete})
+
+	// A new logger (e.g., after a restart) picks up where we left off.
+	l2 := NewLogger(bytes.NewBuffer(nil), 10)
+	require.NoError(t, l2.OpenFile(path))
+	l2.Record(Entry{User: "bob", Action: ActionCreate})
+	assert.Len(t, l2.Query(Query{}), 3)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(content), "\n"))
+}
+
+func TestSourceIP(t *testing.T) {
+	type tc struct {
+		realIP    string
+		forwarded []string
+		expected  string
+	}
+	cases := []tc{
+		{"", nil, "10.0.0.1"},
+		{"10.0.0.2", nil, "10.0.0.2"},
+		{"", []string{"203.0.113.7"}, "203.0.113.7"},
+
+		// A client can't pick its own address by sending the headers.
+		{"", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"", []string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{"203.0.113.7", []string{"1.2.3.4, 10.0.0.3"}, "203.0.113.7"},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestSourceIP%d", i), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			if c.realIP != "" {
+				r.Header.Set("X-Real-Ip", c.realIP)
+			}
+			for _, f := range c.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			assert.Equal(t, c.expected, SourceIP(r))
+		})
+	}
+}
+
+func actions(entries []Entry) []string {
+	result := []string{}
+	for _, e := range entries {
+		result = append(result, e.Action)
+	}
+	return result
+}
@@ -0,0 +1,184 @@
+package env
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The spec the env was created with.
+func (e *Env) Spec() ephconfig.EnvSpec {
+	if e.ConfigMap == nil {
+		return ephconfig.EnvSpec{}
+	}
+	return ephconfig.SpecFromData(e.ConfigMap.Data)
+}
+
+// When the env expires, or nil if ephctrl hasn't set an expiration yet.
+func (e *Env) Expiration() *time.Time {
+	if e.ConfigMap == nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, e.ConfigMap.Data["expiration"])
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// How long ago the env was created, to the minute.
+func (e *Env) Age() time.Duration {
+	if e.ConfigMap == nil {
+		return 0
+	}
+	return time.Since(e.ConfigMap.CreationTimestamp.Time).Round(time.Minute)
+}
+
+// A one-word summary of where the env is in its lifecycle.
+func (e *Env) Phase() string {
+	switch {
+	case e.Pod == nil:
+		return "Pending"
+	case e.Pod.DeletionTimestamp != nil:
+		return "Deleting"
+	case e.Service != nil && e.Pod.Status.Phase == v1.PodRunning:
+		return "Ready"
+	case e.Pod.Status.Phase != "":
+		return string(e.Pod.Status.Phase)
+	}
+	return "Pending"
+}
+
+// List every env in the namespace, sorted by name, from the informer caches.
+func (c *Client) ListEnvs() ([]*Env, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+		ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+	})
+
+	cms, err := c.cms.Lister().ConfigMaps(c.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := c.pods.Lister().Pods(c.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	svcs, err := c.svcs.Lister().Services(c.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	podsByName := make(map[string]*v1.Pod, len(pods))
+	for _, pod := range pods {
+		podsByName[pod.Name] = pod
+	}
+	svcsByName := make(map[string]*v1.Service, len(svcs))
+	for _, svc := range svcs {
+		svcsByName[svc.Name] = svc
+	}
+
+	result := make([]*Env, 0, len(cms))
+	for _, cm := range cms {
+		result = append(result, &Env{
+			ConfigMap: cm,
+			Pod:       podsByName[cm.Name],
+			Service:   svcsByName[cm.Name],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConfigMap.Name < result[j].ConfigMap.Name
+	})
+	return result, nil
+}
+
+// Push back the expiration of the env by the given duration, counting
+// from now if it has already passed.
+//
+// ephctrl doesn't restart envs when only the expiration changes.
+func (c *Client) ExtendEnv(ctx context.Context, name string, d time.Duration) (time.Time, error) {
+	current, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !hasRunnerLabels(current.ObjectMeta) {
+		return time.Time{}, fmt.Errorf("conflict with existing env: %s", name)
+	}
+
+	start := time.Now()
+	expiration, err := time.Parse(time.RFC3339, current.Data["expiration"])
+	if err == nil && expiration.After(start) {
+		start = expiration
+	}
+	expiration = start.Add(d)
+
+	update := current.DeepCopy()
+	if update.Data == nil {
+		update.Data = map[string]string{}
+	}
+	update.Data["expiration"] = expiration.Format(time.RFC3339)
+	_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Update(ctx, update, metav1.UpdateOptions{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expiration, nil
+}
+
+// The resources an env pod is using, summed over its containers.
+type Usage struct {
+	CPU    resource.Quantity
+	Memory resource.Quantity
+}
+
+// The subset of the metrics.k8s.io PodMetricsList that we read.
+type podMetricsList struct {
+	Items []struct {
+		Metadata   metav1.ObjectMeta `json:"metadata"`
+		Containers []struct {
+			Usage v1.ResourceList `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+// Fetch the resource usage of every env pod from the metrics server.
+//
+// Returns an error if the cluster doesn't run a metrics server.
+func (c *Client) PodUsage(ctx context.Context) (map[string]Usage, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+		ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+	})
+	raw, err := c.clientset.CoreV1().RESTClient().Get().
+		AbsPath("/apis/metrics.k8s.io/v1beta1/namespaces", c.namespace, "pods").
+		Param("labelSelector", selector.String()).
+		Do(ctx).Raw()
+	if err != nil {
+		return nil, fmt.Errorf("fetching pod metrics: %v", err)
+	}
+
+	var list podMetricsList
+	err = json.Unmarshal(raw, &list)
+	if err != nil {
+		return nil, fmt.Errorf("reading pod metrics: %v", err)
+	}
+
+	result := make(map[string]Usage, len(list.Items))
+	for _, item := range list.Items {
+		usage := Usage{}
+		for _, container := range item.Containers {
+			usage.CPU.Add(container.Usage[v1.ResourceCPU])
+			usage.Memory.Add(container.Usage[v1.ResourceMemory])
+		}
+		result[item.Metadata.Name] = usage
+	}
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func runnerMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels: map[string]string{
+			ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+			ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+		},
+	}
+}
+
+func newFakeClient(t *testing.T, objs ...runtime.Object) (*Client, *fake.Clientset) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	clientset := fake.NewSimpleClientset(objs...)
+	c := NewClient(ctx, clientset, "default")
+	require.Eventually(t, func() bool {
+		return c.cms.Informer().HasSynced() && c.pods.Informer().HasSynced() && c.svcs.Informer().HasSynced()
+	}, time.Second, 10*time.Millisecond)
+	return c, clientset
+}
+
+func TestListEnvs(t *testing.T) {
+	c, _ := newFakeClient(t,
+		&v1.ConfigMap{ObjectMeta: runnerMeta("bob")},
+		&v1.ConfigMap{ObjectMeta: runnerMeta("alice")},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "ephconfig", Namespace: "default"}},
+		&v1.Pod{ObjectMeta: runnerMeta("alice"), Status: v1.PodStatus{Phase: v1.PodRunning}},
+		&v1.Service{ObjectMeta: runnerMeta("alice")},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bob", Namespace: "default"}})
+
+	envs, err := c.ListEnvs()
+	require.NoError(t, err)
+	require.Len(t, envs, 2)
+
+	assert.Equal(t, "alice", envs[0].ConfigMap.Name)
+	assert.NotNil(t, envs[0].Pod)
+	assert.NotNil(t, envs[0].Service)
+	assert.Equal(t, "Ready", envs[0].Phase())
+
+	// Pods without the runner labels don't belong to the env.
+	assert.Equal(t, "bob", envs[1].ConfigMap.Name)
+	assert.Nil(t, envs[1].Pod)
+	assert.Nil(t, envs[1].Service)
+	assert.Equal(t, "Pending", envs[1].Phase())
+}
+
+func TestExtendEnv(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	future := now.Add(30 * time.Minute)
+	past := now.Add(-30 * time.Minute)
+
+	cases := []struct {
+		data     map[string]string
+		expected time.Time
+	}{
+		// Extends from the current expiration.
+		{map[string]string{"expiration": future.Format(time.RFC3339)}, future.Add(time.Hour)},
+
+		// Extends from now if the env has expired, or has no expiration yet.
+		{map[string]string{"expiration": past.Format(time.RFC3339)}, now.Add(time.Hour)},
+		{nil, now.Add(time.Hour)},
+	}
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("TestExtendEnv%d", i), func(t *testing.T) {
+			c, clientset := newFakeClient(t, &v1.ConfigMap{ObjectMeta: runnerMeta("alice"), Data: tc.data})
+
+			expiration, err := c.ExtendEnv(context.Background(), "alice", time.Hour)
+			require.NoError(t, err)
+			assert.WithinDuration(t, tc.expected, expiration, 2*time.Second)
+
+			cm, err := clientset.CoreV1().ConfigMaps("default").Get(context.Background(), "alice", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, expiration.Format(time.RFC3339), cm.Data["expiration"])
+		})
+	}
+}
+
+func TestExtendEnvErrors(t *testing.T) {
+	c, _ := newFakeClient(t, &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}})
+
+	_, err := c.ExtendEnv(context.Background(), "missing", time.Hour)
+	assert.Error(t, err)
+
+	_, err = c.ExtendEnv(context.Background(), "other", time.Hour)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "conflict with existing env")
+	}
+}
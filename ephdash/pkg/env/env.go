@@ -6,7 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/acarl005/stripansi"
@@ -16,9 +17,13 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/informers"
 	informersv1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 var PodGVR = v1.SchemeGroupVersion.WithResource("pods")
@@ -30,22 +35,189 @@ type Env struct {
 	Pod       *v1.Pod
 	Service   *v1.Service
 	PodLogs   *bytes.Buffer
+
+	// Recent events recorded by the controller, newest first.
+	Events []v1.Event
+
+	// Resource usage of the env pod, if known.
+	Usage *Usage
 }
 
 func (e *Env) PodLogsWithoutColor() string {
 	return stripansi.Strip(e.PodLogs.String())
 }
 
+// A link to an endpoint served by the gateway.
+type Endpoint struct {
+	// The display label of the link.
+	Name string
+
+	// The Service port that serves the link.
+	PortName string
+
+	URL string
+}
+
+// The endpoints of the env, served by the gateway at the given scheme and host.
+//
+// Links to the same port are listed together, in port order.
+func (e *Env) Endpoints(gatewayScheme, gatewayHost string) []Endpoint {
+	if e.Service == nil {
+		return nil
+	}
+
+	var infos []ephconfig.EndpointInfo
+	_, _ = ephconfig.ParseAnnotation(e.Service.Annotations[ephconfig.AnnotationEndpoints], &infos)
+
+	result := []Endpoint{}
+	for _, port := range e.Service.Spec.Ports {
+		if !ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) {
+			continue
+		}
+
+		hosts := ephconfig.PortHosts(port.Name, port.Port, e.Service.Name, gatewayHost)
+		root := fmt.Sprintf("%s://%s", gatewayScheme, hosts[0])
+
+		found := false
+		for _, info := range infos {
+			if info.PortName != port.Name {
+				continue
+			}
+			found = true
+
+			name := info.Name
+			if name == "" {
+				name = info.Resource
+			}
+			path := info.Path
+			if path == "" {
+				path = "/"
+			}
+			result = append(result, Endpoint{
+				Name:     name,
+				PortName: port.Name,
+				URL:      root + path,
+			})
+		}
+
+		if !found {
+			result = append(result, Endpoint{
+				Name:     port.Name,
+				PortName: port.Name,
+				URL:      root + "/",
+			})
+		}
+	}
+	return result
+}
+
+// A port that the gateway can't route, because it doesn't serve HTTP.
+//
+// Users reach these ports with `ephctl port-forward`.
+type Tunnel struct {
+	PortName string
+	Port     int32
+
+	// The protocol that the port serves, e.g., "postgres" or "udp".
+	Protocol string
+}
+
+// The ports of the env that are only reachable through a tunnel.
+func (e *Env) Tunnels() []Tunnel {
+	if e.Service == nil {
+		return nil
+	}
+
+	result := []Tunnel{}
+	for _, port := range e.Service.Spec.Ports {
+		if ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) {
+			continue
+		}
+
+		protocol := strings.ToLower(string(port.Protocol))
+		if port.AppProtocol != nil {
+			protocol = *port.AppProtocol
+		}
+		result = append(result, Tunnel{
+			PortName: port.Name,
+			Port:     port.Port,
+			Protocol: protocol,
+		})
+	}
+	return result
+}
+
+// Who can reach the env's endpoints.
+func (e *Env) Visibility() ephconfig.Visibility {
+	if e.ConfigMap == nil {
+		return ephconfig.DefaultVisibility
+	}
+	v, err := ephconfig.ParseVisibility(e.ConfigMap.Annotations[ephconfig.AnnotationVisibility])
+	if err != nil {
+		// Fail closed.
+		return ephconfig.VisibilityPrivate
+	}
+	return v
+}
+
+// The ID that share tokens for this env must match.
+func (e *Env) ShareID() string {
+	if e.ConfigMap == nil {
+		return ""
+	}
+	return e.ConfigMap.Annotations[ephconfig.AnnotationShareID]
+}
+
+// The Tilt resources in the env, as reported by ephctrl.
+func (e *Env) Resources() []ephconfig.ResourceInfo {
+	if e.Service == nil {
+		return nil
+	}
+	var result []ephconfig.ResourceInfo
+	_, _ = ephconfig.ParseAnnotation(e.Service.Annotations[ephconfig.AnnotationResources], &result)
+	return result
+}
+
+// The result of the most recent action, or nil if ephctrl hasn't run one.
+func (e *Env) ActionStatus() *ephconfig.ActionStatus {
+	if e.ConfigMap == nil {
+		return nil
+	}
+	var status ephconfig.ActionStatus
+	ok, err := ephconfig.ParseAnnotation(e.ConfigMap.Annotations[ephconfig.AnnotationActionStatus], &status)
+	if !ok || err != nil {
+		return nil
+	}
+	return &status
+}
+
+// Returns true if ephctrl hasn't yet run the most recently requested action.
+func (e *Env) ActionPending() bool {
+	if e.ConfigMap == nil {
+		return false
+	}
+	var req ephconfig.ActionRequest
+	ok, err := ephconfig.ParseAnnotation(e.ConfigMap.Annotations[ephconfig.AnnotationActionRequest], &req)
+	if !ok || err != nil {
+		return false
+	}
+	status := e.ActionStatus()
+	return status == nil || status.ID != req.ID || status.Running
+}
+
 type Client struct {
-	clientset    *kubernetes.Clientset
-	namespace    string
-	pods         informersv1.PodInformer
-	svcs         informersv1.ServiceInformer
-	cms          informersv1.ConfigMapInformer
-	slackWebhook string
+	clientset kubernetes.Interface
+	namespace string
+	pods      informersv1.PodInformer
+	svcs      informersv1.ServiceInformer
+	cms       informersv1.ConfigMapInformer
+	events    cache.SharedIndexInformer
 }
 
-func NewClient(ctx context.Context, clientset *kubernetes.Clientset, namespace string, slackWebhook string) *Client {
+// Indexes events by the name of the object they're about.
+const eventObjectIndex = "involvedObject.name"
+
+func NewClient(ctx context.Context, clientset kubernetes.Interface, namespace string) *Client {
 	options := []informers.SharedInformerOption{
 		informers.WithNamespace(namespace),
 	}
@@ -58,13 +230,28 @@ func NewClient(ctx context.Context, clientset *kubernetes.Clientset, namespace s
 	go svcInformer.Informer().Run(ctx.Done())
 	go cmInformer.Informer().Run(ctx.Done())
 
+	// Only watch events from the controller, so that the kubelet's
+	// events don't fill the cache.
+	eventInformer := informersv1.NewFilteredEventInformer(clientset, namespace, time.Hour,
+		cache.Indexers{eventObjectIndex: func(obj interface{}) ([]string, error) {
+			e, ok := obj.(*v1.Event)
+			if !ok {
+				return nil, nil
+			}
+			return []string{e.InvolvedObject.Name}, nil
+		}},
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("source", ephconfig.EventComponent).String()
+		})
+	go eventInformer.Run(ctx.Done())
+
 	return &Client{
-		clientset:    clientset,
-		namespace:    namespace,
-		pods:         podInformer,
-		svcs:         svcInformer,
-		cms:          cmInformer,
-		slackWebhook: slackWebhook,
+		clientset: clientset,
+		namespace: namespace,
+		pods:      podInformer,
+		svcs:      svcInformer,
+		cms:       cmInformer,
+		events:    eventInformer,
 	}
 }
 
@@ -126,6 +313,15 @@ func (c *Client) GetEnv(ctx context.Context, name string) (*Env, error) {
 		return nil
 	})
 
+	g.Go(func() error {
+		events, err := c.listEnvEvents(name)
+		if err != nil {
+			return nil // Always return nil
+		}
+		env.Events = events
+		return nil
+	})
+
 	g.Go(func() error {
 		obj, err := c.svcs.Lister().Services(c.namespace).Get(name)
 		if err != nil {
@@ -154,38 +350,71 @@ func (c *Client) GetEnv(ctx context.Context, name string) (*Env, error) {
 	return env, nil
 }
 
-func hasRunnerLabels(meta metav1.ObjectMeta) bool {
-	return meta.Labels[ephconfig.LabelAppKey] == ephconfig.LabelAppValueEphemerator &&
-		meta.Labels[ephconfig.LabelNameKey] == ephconfig.LabelNameValueEphrunner
+// Fetch only the configmap of the env from the informer cache.
+//
+// Cheaper than GetEnv, for checks that run on every request.
+// Returns (nil, nil) if the env does not exist.
+func (c *Client) GetEnvConfig(name string) (*Env, error) {
+	obj, err := c.cms.Lister().ConfigMaps(c.namespace).Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !hasRunnerLabels(obj.ObjectMeta) {
+		return nil, nil
+	}
+	return &Env{ConfigMap: obj}, nil
 }
 
-type slackMessage struct {
-	Text string `json:"text"`
-}
+// The number of controller events to show for an env.
+const maxEnvEvents = 20
 
-// Post a slack message and ignore the result.
-func (c *Client) maybePostSlackMessage(msg string) {
-	if c.slackWebhook == "" {
-		return
-	}
-	slackMsg := slackMessage{Text: msg}
-	content, err := json.Marshal(slackMsg)
+// List the events the controller recorded on the env's ConfigMap and Pod,
+// newest first. Skips events from other components (like the kubelet)
+// to keep the history focused on env lifecycle decisions.
+func (c *Client) listEnvEvents(name string) ([]v1.Event, error) {
+	objs, err := c.events.GetIndexer().ByIndex(eventObjectIndex, name)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	resp, err := http.Post(c.slackWebhook, "application/json",
-		bytes.NewBuffer(content))
-	if err != nil {
-		return
+	result := []v1.Event{}
+	for _, obj := range objs {
+		e, ok := obj.(*v1.Event)
+		if !ok || e.Source.Component != ephconfig.EventComponent {
+			continue
+		}
+		result = append(result, *e)
 	}
-	defer resp.Body.Close()
+	sort.SliceStable(result, func(i, j int) bool {
+		return eventTime(result[i]).After(eventTime(result[j]))
+	})
+	if len(result) > maxEnvEvents {
+		result = result[:maxEnvEvents]
+	}
+	return result, nil
+}
+
+// The last time an event occurred.
+func eventTime(e v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+func hasRunnerLabels(meta metav1.ObjectMeta) bool {
+	return meta.Labels[ephconfig.LabelAppKey] == ephconfig.LabelAppValueEphemerator &&
+		meta.Labels[ephconfig.LabelNameKey] == ephconfig.LabelNameValueEphrunner
 }
 
 // Delete the configuration for the env.
 func (c *Client) DeleteEnv(ctx context.Context, name string) error {
-	c.maybePostSlackMessage(fmt.Sprintf("Deleting env: %s", name))
-
 	// Make sure we're not deleting a configmap for a non-runner.
 	current, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
@@ -203,10 +432,97 @@ func (c *Client) DeleteEnv(ctx context.Context, name string) error {
 	return c.clientset.CoreV1().ConfigMaps(c.namespace).Delete(ctx, name, metav1.DeleteOptions{})
 }
 
-// Set the configuration for the env.
-func (c *Client) SetEnvSpec(ctx context.Context, name string, spec ephconfig.EnvSpec) error {
-	c.maybePostSlackMessage(fmt.Sprintf("Updating env %s: %+v", name, spec))
+// Ask ephctrl to run an action in the env.
+//
+// Actions are passed as an annotation on the env configmap, so
+// that only ephctrl needs permission to exec into pods.
+func (c *Client) RequestAction(ctx context.Context, name string, req ephconfig.ActionRequest) error {
+	content, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return c.updateAnnotations(ctx, name, map[string]string{
+		ephconfig.AnnotationActionRequest: string(content),
+	})
+}
 
+// Set the visibility of the env's endpoints.
+//
+// Making an env public for the first time assigns it a share ID.
+func (c *Client) SetVisibility(ctx context.Context, name string, v ephconfig.Visibility) error {
+	annotations := map[string]string{
+		ephconfig.AnnotationVisibility: string(v),
+	}
+	if v == ephconfig.VisibilityPublic {
+		env, err := c.GetEnvConfig(name)
+		if err != nil {
+			return err
+		}
+		if env == nil || env.ShareID() == "" {
+			annotations[ephconfig.AnnotationShareID] = rand.String(16)
+		}
+	}
+	return c.updateAnnotations(ctx, name, annotations)
+}
+
+// Revoke all share links for the env.
+func (c *Client) RotateShareID(ctx context.Context, name string) error {
+	return c.updateAnnotations(ctx, name, map[string]string{
+		ephconfig.AnnotationShareID: rand.String(16),
+	})
+}
+
+// Merge the given annotations into the env configmap.
+//
+// Annotations don't restart the env, so this is how ephdash
+// changes settings on a running env.
+func (c *Client) updateAnnotations(ctx context.Context, name string, annotations map[string]string) error {
+	current, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if !hasRunnerLabels(current.ObjectMeta) {
+		return fmt.Errorf("conflict with existing env: %s", name)
+	}
+
+	update := current.DeepCopy()
+	if update.Annotations == nil {
+		update.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		update.Annotations[k] = v
+	}
+	_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Update(ctx, update, metav1.UpdateOptions{})
+	return err
+}
+
+// Counts the envs created under the given group policy, besides the named env.
+func (c *Client) CountGroupEnvs(group, exclude string) (int, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+		ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+	})
+	cms, err := c.cms.Lister().ConfigMaps(c.namespace).List(selector)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, cm := range cms {
+		if cm.Name != exclude && cm.DeletionTimestamp == nil && cm.Annotations[ephconfig.AnnotationGroup] == group {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Creates or updates the env.
+//
+// The group is the name of the group policy the user created the env under,
+// so that ephctrl can enforce it too. Empty if the allowlist has no groups.
+func (c *Client) SetEnvSpec(ctx context.Context, name string, spec ephconfig.EnvSpec, group string) error {
 	desired := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
@@ -216,12 +532,11 @@ func (c *Client) SetEnvSpec(ctx context.Context, name string, spec ephconfig.Env
 				ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
 			},
 		},
-		Data: map[string]string{
-			"repo":   spec.Repo,
-			"path":   spec.Path,
-			"branch": spec.Branch,
-			// For now, let the controller handle expiration.
-		},
+		// For now, let the controller handle expiration.
+		Data: spec.Data(),
+	}
+	if group != "" {
+		desired.Annotations = map[string]string{ephconfig.AnnotationGroup: group}
 	}
 
 	// Reconcile the desired config map with the current configmap.
@@ -242,6 +557,14 @@ func (c *Client) SetEnvSpec(ctx context.Context, name string, spec ephconfig.Env
 
 	update := current.DeepCopy()
 	update.Data = desired.Data
+	if group != "" {
+		if update.Annotations == nil {
+			update.Annotations = map[string]string{}
+		}
+		update.Annotations[ephconfig.AnnotationGroup] = group
+	} else {
+		delete(update.Annotations, ephconfig.AnnotationGroup)
+	}
 	_, err = c.clientset.CoreV1().ConfigMaps(c.namespace).Update(ctx, update, metav1.UpdateOptions{})
 	return err
 }
@@ -0,0 +1,44 @@
+package env
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newEvent(name, object, component, reason string, at time.Time) *v1.Event {
+	return &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default"},
+		InvolvedObject: v1.ObjectReference{Kind: "ConfigMap", Name: object, Namespace: "default"},
+		Source:         v1.EventSource{Component: component},
+		Reason:         reason,
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func TestListEnvEvents(t *testing.T) {
+	now := time.Now()
+	c, _ := newFakeClient(t,
+		newEvent("e1", "alice", ephconfig.EventComponent, "Created", now.Add(-2*time.Minute)),
+		newEvent("e2", "alice", ephconfig.EventComponent, "Ready", now.Add(-time.Minute)),
+		newEvent("e3", "alice", "kubelet", "Pulled", now),
+		newEvent("e4", "bob", ephconfig.EventComponent, "Created", now))
+	require.Eventually(t, c.events.HasSynced, time.Second, 10*time.Millisecond)
+
+	events, err := c.listEnvEvents("alice")
+	require.NoError(t, err)
+	reasons := []string{}
+	for _, e := range events {
+		reasons = append(reasons, e.Reason)
+	}
+	assert.Equal(t, []string{"Ready", "Created"}, reasons)
+
+	events, err = c.listEnvEvents("carol")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
+)
+
+const (
+	// How long to extend envs by, if the admin doesn't say.
+	defaultExtension = time.Hour
+
+	// The longest an admin can extend envs by at once.
+	maxExtension = 24 * time.Hour
+)
+
+// Bulk actions that admins can take on envs.
+const (
+	BulkActionDelete = "delete"
+	BulkActionExtend = "extend"
+)
+
+// An env, as listed by GET /api/admin/envs.
+type AdminEnv struct {
+	Name       string            `json:"name"`
+	Owner      string            `json:"owner"`
+	Spec       ephconfig.EnvSpec `json:"spec"`
+	Phase      string            `json:"phase"`
+	Created    time.Time         `json:"created"`
+	Expiration *time.Time        `json:"expiration,omitempty"`
+	CPU        string            `json:"cpu,omitempty"`
+	Memory     string            `json:"memory,omitempty"`
+}
+
+// JSON body of a POST to /api/admin/envs.
+type BulkParams struct {
+	Action string   `json:"action"`
+	Envs   []string `json:"envs"`
+
+	// How long to extend the envs by, e.g., "2h". Defaults to 1h.
+	Duration string `json:"duration,omitempty"`
+}
+
+// The result of a bulk action on one env.
+type BulkResult struct {
+	Env        string     `json:"env"`
+	Error      string     `json:"error,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// The config that ephdash is running with, as returned by GET /api/admin/config.
+type AdminConfig struct {
+	Version     string `json:"version"`
+	GatewayHost string `json:"gatewayHost"`
+
+	// Why the latest edit to the ephconfig ConfigMap didn't apply, if it didn't.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Reads the user, and checks that they're an admin.
+//
+// Writes an error response and returns false if they're not.
+func (s *Server) requireAdmin(res http.ResponseWriter, r *http.Request) (string, bool) {
+	id, err := s.identity(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return "", false
+	}
+	if !s.authSettings.IsAdmin(id) {
+		http.Error(res, fmt.Sprintf("User %s is not an admin", id.User), http.StatusForbidden)
+		return "", false
+	}
+	return id.User, true
+}
+
+// Whether the user who made the request is an admin.
+func (s *Server) isAdmin(r *http.Request) bool {
+	id, err := s.identity(r)
+	return err == nil && s.authSettings.IsAdmin(id)
+}
+
+// List every env, with resource usage if the cluster has a metrics server.
+func (s *Server) listAdminEnvs(r *http.Request) ([]*env.Env, error) {
+	envs, err := s.envClient.ListEnvs()
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := s.envClient.PodUsage(r.Context())
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	for _, e := range envs {
+		if u, ok := usage[e.ConfigMap.Name]; ok {
+			e.Usage = &u
+		}
+	}
+	return envs, nil
+}
+
+// Shows every env in the namespace. Admins only.
+func (s *Server) adminEnvs(res http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	envs, err := s.listAdminEnvs(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Listing envs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.tmpl.ExecuteTemplate(res, "admin.tmpl", map[string]interface{}{
+		"user":          user,
+		"envs":          envs,
+		"now":           time.Now(),
+		"gatewayHost":   s.gatewayHost(),
+		"gatewayScheme": s.gatewayTLS.Scheme(),
+		"csrfToken":     s.csrfToken(res, r),
+		"config":        s.adminConfig(),
+	})
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Rendering HTML: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Deletes or extends the envs selected on the admin page. Admins only.
+func (s *Server) adminBulk(res http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing form data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	params := BulkParams{
+		Action:   r.FormValue("action"),
+		Envs:     r.Form["env"],
+		Duration: r.FormValue("duration"),
+	}
+	_, code, err := s.bulkAction(r, user, params)
+	if err != nil {
+		http.Error(res, err.Error(), code)
+		return
+	}
+
+	http.Redirect(res, r, "/admin", http.StatusSeeOther)
+}
+
+// Lists every env in the namespace as JSON. Admins only.
+func (s *Server) apiAdminEnvs(res http.ResponseWriter, r *http.Request) {
+	_, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	envs, err := s.listAdminEnvs(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Listing envs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]AdminEnv, 0, len(envs))
+	for _, e := range envs {
+		item := AdminEnv{
+			Name:       e.ConfigMap.Name,
+			Owner:      e.ConfigMap.Name,
+			Spec:       e.Spec(),
+			Phase:      e.Phase(),
+			Created:    e.ConfigMap.CreationTimestamp.Time,
+			Expiration: e.Expiration(),
+		}
+		if e.Usage != nil {
+			item.CPU = e.Usage.CPU.String()
+			item.Memory = e.Usage.Memory.String()
+		}
+		result = append(result, item)
+	}
+	writeJSON(res, http.StatusOK, result)
+}
+
+// Deletes or extends envs, reporting the result for each. Admins only.
+func (s *Server) apiAdminBulk(res http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	var params BulkParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results, code, err := s.bulkAction(r, user, params)
+	if err != nil {
+		http.Error(res, err.Error(), code)
+		return
+	}
+	writeJSON(res, http.StatusOK, results)
+}
+
+// Validates a bulk action and applies it to each env.
+//
+// Failures on individual envs are reported in the results, not as an error.
+func (s *Server) bulkAction(r *http.Request, admin string, params BulkParams) ([]BulkResult, int, error) {
+	if len(params.Envs) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("No envs selected")
+	}
+
+	extension := defaultExtension
+	switch params.Action {
+	case BulkActionDelete:
+	case BulkActionExtend:
+		if params.Duration != "" {
+			d, err := time.ParseDuration(params.Duration)
+			if err != nil || d <= 0 || d > maxExtension {
+				return nil, http.StatusBadRequest, fmt.Errorf("Invalid duration %q: must be between 0 and %s", params.Duration, maxExtension)
+			}
+			extension = d
+		}
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("Unknown action %q", params.Action)
+	}
+
+	results := make([]BulkResult, 0, len(params.Envs))
+	for _, name := range params.Envs {
+		result := BulkResult{Env: name}
+		entry := audit.Entry{User: admin, Env: name}
+
+		var err error
+		switch params.Action {
+		case BulkActionDelete:
+			entry.Action = audit.ActionDelete
+			err = s.envClient.DeleteEnv(r.Context(), name)
+			if err == nil {
+				s.notifier.Notify(notify.Event{Type: notify.EventDeleted, Env: name, Message: fmt.Sprintf("Deleted by %s", admin)})
+			}
+		case BulkActionExtend:
+			entry.Action = audit.ActionExtend
+			entry.Detail = extension.String()
+			var expiration time.Time
+			expiration, err = s.envClient.ExtendEnv(r.Context(), name, extension)
+			if err == nil {
+				result.Expiration = &expiration
+			}
+		}
+
+		s.recordAudit(r, entry, http.StatusInternalServerError, err)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, http.StatusOK, nil
+}
+
+func (s *Server) adminConfig() AdminConfig {
+	config := s.config.Get()
+	return AdminConfig{
+		Version:     config.Version,
+		GatewayHost: config.GatewayHost,
+		LastError:   s.config.LastError(),
+	}
+}
+
+// Reports the version of the config we're running with, so operators can
+// check that an edit to the ephconfig ConfigMap applied. Admins only.
+func (s *Server) apiAdminConfig(res http.ResponseWriter, r *http.Request) {
+	_, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+	writeJSON(res, http.StatusOK, s.adminConfig())
+}
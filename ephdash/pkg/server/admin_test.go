@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var testAdminSettings = AuthSettings{
+	AdminUsers:  []string{"root"},
+	AdminEmails: []string{"ops@example.com"},
+	AdminGroups: []string{"sre"},
+}
+
+func TestIsAdmin(t *testing.T) {
+	cases := []struct {
+		id       Identity
+		expected bool
+	}{
+		{Identity{User: "root"}, true},
+		{Identity{User: "alice", Email: "ops@example.com"}, true},
+		{Identity{User: "alice", Groups: []string{"eng", "sre"}}, true},
+		{Identity{User: "alice", Email: "alice@example.com", Groups: []string{"eng"}}, false},
+		{Identity{User: "alice"}, false},
+		{Identity{}, false},
+
+		// Matches are exact.
+		{Identity{User: "Root"}, false},
+		{Identity{User: "alice", Email: "OPS@example.com"}, false},
+		{Identity{User: "alice", Groups: []string{"sre-oncall"}}, false},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestIsAdmin%d", i), func(t *testing.T) {
+			assert.Equal(t, c.expected, testAdminSettings.IsAdmin(c.id))
+		})
+	}
+
+	// An empty email never matches, even if the admin list has one.
+	settings := AuthSettings{AdminEmails: []string{""}}
+	assert.False(t, settings.IsAdmin(Identity{User: "alice"}))
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s := &Server{
+		authSettings: testAdminSettings,
+		config:       ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost"),
+	}
+
+	cases := []struct {
+		id   *Identity
+		code int
+	}{
+		{&Identity{User: "root"}, http.StatusOK},
+		{&Identity{User: "alice", Email: "ops@example.com"}, http.StatusOK},
+		{&Identity{User: "alice", Groups: []string{"sre"}}, http.StatusOK},
+		{&Identity{User: "alice", Email: "alice@example.com", Groups: []string{"eng"}}, http.StatusForbidden},
+		{nil, http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestRequireAdmin%d", i), func(t *testing.T) {
+			handlers := []http.HandlerFunc{s.apiAdminConfig}
+			if c.code != http.StatusOK {
+				// Non-admins are turned away before we touch the cluster.
+				handlers = append(handlers, s.apiAdminEnvs, s.apiAdminBulk, s.adminEnvs, s.adminBulk)
+			}
+			for _, h := range handlers {
+				req := httptest.NewRequest("POST", "/api/admin/config", nil)
+				if c.id != nil {
+					req = req.WithContext(context.WithValue(req.Context(), identityKey{}, *c.id))
+				}
+				rec := httptest.NewRecorder()
+				h(rec, req)
+				assert.Equal(t, c.code, rec.Code)
+			}
+		})
+	}
+}
+
+func TestBulkAction(t *testing.T) {
+	expiration := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+	alice := shareEnv("alice", ephconfig.VisibilityTeam, "").ConfigMap
+	alice.Data = map[string]string{"expiration": expiration.Format(time.RFC3339)}
+	bob := shareEnv("bob", ephconfig.VisibilityTeam, "").ConfigMap
+	other := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}}
+
+	cases := []struct {
+		params BulkParams
+		errors map[string]string
+	}{
+		{
+			params: BulkParams{Action: BulkActionExtend, Envs: []string{"alice", "missing", "other"}, Duration: "2h"},
+			errors: map[string]string{
+				"alice":   "",
+				"missing": `configmaps "missing" not found`,
+				"other":   "conflict with existing env: other",
+			},
+		},
+		{
+			// Deleting an env that's already gone isn't an error.
+			params: BulkParams{Action: BulkActionDelete, Envs: []string{"bob", "missing", "other"}},
+			errors: map[string]string{
+				"bob":     "",
+				"missing": "",
+				"other":   "conflict with existing env: other",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestBulkAction%d", i), func(t *testing.T) {
+			s := &Server{
+				envClient:    newFakeEnvClient(t, alice.DeepCopy(), bob.DeepCopy(), other.DeepCopy()),
+				auditLog:     audit.NewLogger(&strings.Builder{}, audit.DefaultCapacity),
+				authSettings: testAdminSettings,
+			}
+			body, err := json.Marshal(c.params)
+			require.NoError(t, err)
+			req := httptest.NewRequest("POST", "/api/admin/envs", strings.NewReader(string(body)))
+			req = req.WithContext(context.WithValue(req.Context(), identityKey{}, Identity{User: "root"}))
+			rec := httptest.NewRecorder()
+			s.apiAdminBulk(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			var results []BulkResult
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+			require.Len(t, results, len(c.params.Envs))
+			for j, result := range results {
+				assert.Equal(t, c.params.Envs[j], result.Env)
+				assert.Equal(t, c.errors[result.Env], result.Error, result.Env)
+			}
+
+			if c.params.Action == BulkActionExtend {
+				require.NotNil(t, results[0].Expiration)
+				assert.Equal(t, expiration.Add(2*time.Hour), results[0].Expiration.UTC())
+			}
+
+			entries := s.auditLog.Query(audit.Query{})
+			require.Len(t, entries, len(c.params.Envs))
+			for _, e := range entries {
+				assert.Equal(t, "root", e.User)
+				if c.errors[e.Env] == "" {
+					assert.Equal(t, audit.OutcomeSuccess, e.Outcome, e.Env)
+				} else {
+					assert.Equal(t, audit.OutcomeError, e.Outcome, e.Env)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkActionInvalid(t *testing.T) {
+	s := &Server{authSettings: testAdminSettings}
+	cases := []BulkParams{
+		{Action: BulkActionDelete},
+		{Action: "restart", Envs: []string{"alice"}},
+		{Action: BulkActionExtend, Envs: []string{"alice"}, Duration: "48h"},
+		{Action: BulkActionExtend, Envs: []string{"alice"}, Duration: "-1h"},
+		{Action: BulkActionExtend, Envs: []string{"alice"}, Duration: "soon"},
+	}
+	for i, params := range cases {
+		t.Run(fmt.Sprintf("TestBulkActionInvalid%d", i), func(t *testing.T) {
+			_, code, err := s.bulkAction(httptest.NewRequest("POST", "/api/admin/envs", nil), "root", params)
+			assert.Error(t, err)
+			assert.Equal(t, http.StatusBadRequest, code)
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
+)
+
+// JSON response from /api/env.
+type EnvResponse struct {
+	Name       string            `json:"name"`
+	Spec       ephconfig.EnvSpec `json:"spec"`
+	Phase      string            `json:"phase"`
+	Expiration *time.Time        `json:"expiration,omitempty"`
+	Endpoints  []EnvEndpoint     `json:"endpoints,omitempty"`
+}
+
+type EnvEndpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// JSON body of a POST to /api/env/action.
+type ActionParams struct {
+	Action   ephconfig.Action `json:"action"`
+	Resource string           `json:"resource,omitempty"`
+}
+
+// JSON response from /api/env/action.
+type ActionResponse struct {
+	// The request we've just submitted, or the most recent pending request.
+	Request *ephconfig.ActionRequest `json:"request,omitempty"`
+
+	// The result of the most recently completed action.
+	Status *ephconfig.ActionStatus `json:"status,omitempty"`
+
+	Pending bool `json:"pending"`
+}
+
+// JSON error response from POST /api/env, when the spec isn't allowed.
+type ErrorResponse struct {
+	Error string `json:"error"`
+
+	// What's wrong with each field of the spec.
+	FieldErrors ephconfig.FieldErrors `json:"fieldErrors,omitempty"`
+}
+
+func writeJSON(res http.ResponseWriter, code int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	_ = json.NewEncoder(res).Encode(v)
+}
+
+func (s *Server) envResponse(e *env.Env) EnvResponse {
+	resp := EnvResponse{
+		Name:       e.ConfigMap.Name,
+		Spec:       e.Spec(),
+		Phase:      e.Phase(),
+		Expiration: e.Expiration(),
+	}
+	for _, endpoint := range e.Endpoints(s.gatewayTLS.Scheme(), s.gatewayHost()) {
+		resp.Endpoints = append(resp.Endpoints, EnvEndpoint{Name: endpoint.Name, URL: endpoint.URL})
+	}
+	return resp
+}
+
+// Reports the user's env.
+func (s *Server) apiGetEnv(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	e, err := s.envClient.GetEnv(r.Context(), user)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Fetching env: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if e == nil || e.ConfigMap == nil {
+		http.Error(res, fmt.Sprintf("No env for user %s", user), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, s.envResponse(e))
+}
+
+// Creates the user's env, or updates it with a new spec.
+//
+// Takes an EnvSpec as the JSON body. CI jobs can call this
+// with an API token to deploy each build.
+func (s *Server) apiSetEnv(res http.ResponseWriter, r *http.Request) {
+	id, err := s.identity(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	var spec ephconfig.EnvSpec
+	err = json.NewDecoder(r.Body).Decode(&spec)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Fill in the repo's default branch and path, if the allowlist has them.
+	settings := s.allowlist().RepoSettings(spec.Repo)
+	if spec.Branch == "" {
+		spec.Branch = settings.DefaultBranch
+	}
+	if spec.Path == "" {
+		spec.Path = settings.DefaultPath
+	}
+	var missing ephconfig.FieldErrors
+	for _, f := range []struct{ name, value string }{{"repo", spec.Repo}, {"branch", spec.Branch}, {"path", spec.Path}} {
+		if f.value == "" {
+			missing = append(missing, &ephconfig.FieldError{Field: f.name, Reason: ephconfig.ReasonRequired, Message: fmt.Sprintf("missing %s", f.name)})
+		}
+	}
+	if len(missing) > 0 {
+		writeJSON(res, http.StatusBadRequest, ErrorResponse{
+			Error:       fmt.Sprintf("Missing repo, branch or path: %v", spec),
+			FieldErrors: missing,
+		})
+		return
+	}
+
+	code, err := s.setEnvSpec(r, id, spec)
+	if err != nil {
+		if errs := ephconfig.AsFieldErrors(err); errs != nil {
+			writeJSON(res, code, ErrorResponse{Error: err.Error(), FieldErrors: errs})
+			return
+		}
+		http.Error(res, err.Error(), code)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, EnvResponse{Name: id.User, Spec: spec, Phase: "Pending"})
+}
+
+// Deletes the user's env.
+func (s *Server) apiDeleteEnv(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	err = s.deleteUserEnv(r, user)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// Reports the status of the most recent action in the user's env.
+func (s *Server) apiGetAction(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	env, err := s.envClient.GetEnv(r.Context(), user)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Fetching env: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if env == nil {
+		http.Error(res, fmt.Sprintf("No env for user %s", user), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, ActionResponse{
+		Status:  env.ActionStatus(),
+		Pending: env.ActionPending(),
+	})
+}
+
+// Runs an action against the Tilt instance in the user's env.
+//
+// The action runs asynchronously. Poll GET /api/env/action for the result.
+func (s *Server) apiCreateAction(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	var params ActionParams
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req, code, err := s.requestAction(r, user, params.Action, params.Resource)
+	if err != nil {
+		http.Error(res, err.Error(), code)
+		return
+	}
+
+	writeJSON(res, code, ActionResponse{
+		Request: &req,
+		Pending: true,
+	})
+}
+
+// JSON response from /api/env/share.
+type ShareResponse struct {
+	Token string      `json:"token"`
+	Links []ShareLink `json:"links"`
+}
+
+// Mints a share token for the user's env.
+//
+// The env must already be public.
+func (s *Server) apiCreateShare(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	env, err := s.envClient.GetEnv(r.Context(), user)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Fetching env: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if env == nil {
+		http.Error(res, fmt.Sprintf("No env for user %s", user), http.StatusNotFound)
+		return
+	}
+
+	token, links, err := s.shareLinks(env)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Sharing env: %v", err), http.StatusForbidden)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, ShareResponse{Token: token, Links: links})
+}
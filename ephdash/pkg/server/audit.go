@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+)
+
+// The number of entries shown on the audit page by default.
+const defaultAuditLimit = 100
+
+// Record the outcome of a user action.
+//
+// A nil err is a success. Otherwise, failCode tells us whether
+// the user was denied (403) or the action failed.
+func (s *Server) recordAudit(r *http.Request, e audit.Entry, failCode int, err error) {
+	if e.Env == "" {
+		e.Env = e.User
+	}
+	e.SourceIP = audit.SourceIP(r)
+	if id, ok := identityFromContext(r.Context()); ok && id.TokenID != "" && e.Detail == "" {
+		e.Detail = fmt.Sprintf("via API token %s", id.TokenID)
+	}
+	e.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		e.Outcome = audit.OutcomeError
+		if failCode == http.StatusForbidden {
+			e.Outcome = audit.OutcomeDenied
+		}
+		e.Error = err.Error()
+	}
+	s.auditLog.Record(e)
+}
+
+// Parse an audit query from URL parameters.
+func auditQuery(r *http.Request) audit.Query {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	return audit.Query{
+		User:   q.Get("user"),
+		Env:    q.Get("env"),
+		Action: q.Get("action"),
+		Limit:  limit,
+	}
+}
+
+// Shows recent audit entries. Admins only.
+func (s *Server) adminAudit(res http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	query := auditQuery(r)
+	err := s.tmpl.ExecuteTemplate(res, "audit.tmpl", map[string]interface{}{
+		"user":    user,
+		"query":   query,
+		"entries": s.auditLog.Query(query),
+	})
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Rendering HTML: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Returns recent audit entries as JSON, filtered by the
+// user, env, action and limit URL parameters. Admins only.
+func (s *Server) apiAdminAudit(res http.ResponseWriter, r *http.Request) {
+	_, ok := s.requireAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(res, http.StatusOK, s.auditLog.Query(auditQuery(r)))
+}
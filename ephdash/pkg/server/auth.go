@@ -7,18 +7,87 @@ import (
 type AuthSettings struct {
 	FakeUser string
 	Proxy    string
+
+	// Proof that identity headers came from the oauth2-proxy. Requests must
+	// carry the shared secret in the X-Ephemerator-Proxy-Secret header, or
+	// an ID token from the issuer in the Authorization header.
+	ProxySecret       string
+	ProxyJWTIssuer    string
+	ProxyJWTAudience  string
+	ProxyJWTUserClaim string
+
+	// Sign users in with an OIDC issuer, instead of the oauth2-proxy.
+	OIDC OIDCSettings
+
+	// Secret key for signing share links. If empty, envs can't be made public.
+	ShareSecret string
+
+	// Secret key for signing CSRF tokens. If empty, we generate one at startup.
+	CSRFSecret string
+
+	// Users, emails and groups who may use the admin pages.
+	AdminUsers  []string
+	AdminEmails []string
+	AdminGroups []string
+}
+
+// Who made a request, as reported by the oauth2-proxy.
+type Identity struct {
+	User   string
+	Email  string
+	Groups []string
+
+	// Set if the request signed in with an API token.
+	TokenID string
+}
+
+func (s AuthSettings) IsAdmin(id Identity) bool {
+	if contains(s.AdminUsers, id.User) || (id.Email != "" && contains(s.AdminEmails, id.Email)) {
+		return true
+	}
+	for _, g := range id.Groups {
+		if contains(s.AdminGroups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
 }
 
 func (s AuthSettings) Validate() error {
-	if s.FakeUser == "" && s.Proxy == "" {
-		return fmt.Errorf("Auth settings missing. Please specify --auth-fake-user or --auth-proxy")
-	} else if s.FakeUser != "" && s.Proxy != "" {
-		return fmt.Errorf("Cannot specify both --auth-fake-user or --auth-proxy")
+	modes := 0
+	for _, enabled := range []bool{s.FakeUser != "", s.Proxy != "", s.OIDC.Enabled()} {
+		if enabled {
+			modes++
+		}
+	}
+	if modes == 0 {
+		return fmt.Errorf("Auth settings missing. Please specify --auth-fake-user, --auth-proxy or --auth-oidc-issuer")
+	} else if modes > 1 {
+		return fmt.Errorf("Cannot specify more than one of --auth-fake-user, --auth-proxy and --auth-oidc-issuer")
+	}
+	if s.Proxy != "" && s.ProxySecret == "" && s.ProxyJWTIssuer == "" {
+		return fmt.Errorf("Identity headers from the oauth proxy must be verified. Please set EPH_AUTH_PROXY_SECRET or --auth-proxy-jwt-issuer")
+	}
+	if s.ProxyJWTIssuer != "" && (s.ProxyJWTAudience == "" || s.ProxyJWTUserClaim == "") {
+		return fmt.Errorf("Please specify --auth-proxy-jwt-audience and --auth-proxy-jwt-user-claim with --auth-proxy-jwt-issuer")
+	}
+	if s.OIDC.Enabled() {
+		return s.OIDC.Validate()
 	}
 	return nil
 }
 
 type AuthResponse struct {
-	User  string `json:"user"`
-	Email string `json:"email"`
+	User   string   `json:"user"`
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
 }
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// The form field with the CSRF token, on every form that POSTs to ephdash.
+const CSRFFormField = "csrf_token"
+
+// JSON API clients must send this header, or a bearer token, on requests
+// that change anything. Browsers won't send either cross-site without
+// a CORS preflight, which we never approve.
+const CSRFHeader = "X-Ephemerator-CSRF"
+
+const csrfCookie = "_eph_csrf"
+
+// Protects dashboard forms against cross-site request forgery.
+//
+// Each browser session gets a random nonce in a cookie. The form token is
+// an HMAC of the nonce and the user, so a token only works for the session
+// and user it was rendered for. Env hosts can set cookies on the gateway
+// domain, so the nonce alone proves nothing.
+type csrfProtection struct {
+	key    []byte
+	secure bool
+}
+
+// If the secret is empty, we make up a key, so tokens don't survive
+// restarts, and only work with one replica.
+func newCSRFProtection(secret string, secure bool) *csrfProtection {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	return &csrfProtection{key: key, secure: secure}
+}
+
+// Returns the token to embed in forms, setting a session cookie if needed.
+func (c *csrfProtection) token(res http.ResponseWriter, r *http.Request, user string) string {
+	nonce := ""
+	cookie, err := r.Cookie(csrfCookie)
+	if err == nil {
+		nonce = cookie.Value
+	}
+	if nonce == "" {
+		nonce = randomString()
+		http.SetCookie(res, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    nonce,
+			Path:     "/",
+			Secure:   c.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return c.sign(nonce, user)
+}
+
+func (c *csrfProtection) sign(nonce, user string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(user))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *csrfProtection) valid(r *http.Request, user string) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	got := r.PostFormValue(CSRFFormField)
+	want := c.sign(cookie.Value, user)
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Rejects requests that change anything, unless they prove they came from
+// our own pages (form POSTs) or from a non-browser client (the JSON API).
+//
+// Runs after the auth middleware, so that tokens are checked against the
+// signed-in user.
+func (s *Server) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if r.Header.Get(CSRFHeader) == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				http.Error(res, "Missing "+CSRFHeader+" header or bearer token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		// If we can't tell who the user is, the handler will reject the
+		// request anyway, so it's fine to check the token against no user.
+		id, _ := s.identity(r)
+		if !s.csrf.valid(r, id.User) {
+			http.Error(res, "Invalid CSRF token. Please reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
+
+// The CSRF token for forms on the page we're about to render.
+func (s *Server) csrfToken(res http.ResponseWriter, r *http.Request) string {
+	id, _ := s.identity(r)
+	return s.csrf.token(res, r, id.User)
+}
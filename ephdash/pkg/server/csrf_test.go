@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type csrfFixture struct {
+	t       *testing.T
+	s       *Server
+	handler http.Handler
+}
+
+func newCSRFFixture(t *testing.T) *csrfFixture {
+	s := &Server{
+		authSettings: AuthSettings{FakeUser: "alice"},
+		csrf:         newCSRFProtection("shh", false),
+	}
+	handler := s.csrfMiddleware(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}))
+	return &csrfFixture{t: t, s: s, handler: handler}
+}
+
+// Renders a page, and returns the session cookie and form token.
+func (f *csrfFixture) render() (*http.Cookie, string) {
+	rec := httptest.NewRecorder()
+	token := f.s.csrfToken(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	require.Len(f.t, cookies, 1)
+	assert.Equal(f.t, http.SameSiteStrictMode, cookies[0].SameSite)
+	assert.True(f.t, cookies[0].HttpOnly)
+	return cookies[0], token
+}
+
+func (f *csrfFixture) post(path string, cookie *http.Cookie, form url.Values, headers map[string]string) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestCSRFForm(t *testing.T) {
+	f := newCSRFFixture(t)
+	cookie, token := f.render()
+
+	assert.Equal(t, http.StatusOK, f.post("/delete", cookie, url.Values{CSRFFormField: {token}}, nil))
+	assert.Equal(t, http.StatusForbidden, f.post("/delete", cookie, url.Values{}, nil))
+	assert.Equal(t, http.StatusForbidden, f.post("/delete", nil, url.Values{CSRFFormField: {token}}, nil))
+	assert.Equal(t, http.StatusForbidden, f.post("/delete", cookie, url.Values{CSRFFormField: {"guess"}}, nil))
+
+	// A cookie planted by another site (or an env host) doesn't match the token.
+	planted := &http.Cookie{Name: csrfCookie, Value: "planted"}
+	assert.Equal(t, http.StatusForbidden, f.post("/delete", planted, url.Values{CSRFFormField: {token}}, nil))
+
+	// Tokens are only good for the user they were rendered for.
+	f.s.authSettings.FakeUser = "bob"
+	assert.Equal(t, http.StatusForbidden, f.post("/delete", cookie, url.Values{CSRFFormField: {token}}, nil))
+}
+
+func TestCSRFReusesSession(t *testing.T) {
+	f := newCSRFFixture(t)
+	cookie, token := f.render()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	assert.Equal(t, token, f.s.csrfToken(rec, req))
+	assert.Empty(t, rec.Result().Cookies())
+}
+
+func TestCSRFAPI(t *testing.T) {
+	f := newCSRFFixture(t)
+
+	assert.Equal(t, http.StatusForbidden, f.post("/api/env/action", nil, nil, nil))
+	assert.Equal(t, http.StatusOK, f.post("/api/env/action", nil, nil, map[string]string{CSRFHeader: "1"}))
+	assert.Equal(t, http.StatusOK, f.post("/api/env/action", nil, nil, map[string]string{"Authorization": "Bearer xyz"}))
+
+	// Reads don't need protection.
+	req := httptest.NewRequest("GET", "/api/env/action", nil)
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ephdash_http_requests_total",
+		Help: "Number of HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ephdash_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	githubRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ephdash_github_requests_total",
+		Help: "Number of GitHub API calls, by call.",
+	}, []string{"call"})
+
+	githubErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ephdash_github_errors_total",
+		Help: "Number of GitHub API calls that failed, by call.",
+	}, []string{"call"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, githubRequests, githubErrors)
+}
+
+// Record a GitHub API call.
+func observeGitHubCall(call string, err error) {
+	githubRequests.WithLabelValues(call).Inc()
+	if err != nil {
+		githubErrors.WithLabelValues(call).Inc()
+	}
+}
+
+// Records the response status for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware that records request metrics, labeled by route template
+// so that the number of label values stays bounded.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: res}
+		next.ServeHTTP(rec, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
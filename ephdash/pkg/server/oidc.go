@@ -0,0 +1,614 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Cookies for the built-in OIDC login.
+//
+// The session cookie holds the refresh token, so it never leaves the
+// gateway host. Env hosts get the gateway cookie instead, which only
+// says who the user is until the tokens expire. Env servers can read it,
+// so the dashboard doesn't accept it.
+const (
+	oidcSessionCookie = "_eph_session"
+	oidcGatewayCookie = "_eph_gateway"
+	oidcStateCookie   = "_eph_oidc_state"
+)
+
+// How long a user has to finish signing in with the issuer.
+const oidcStateTTL = 10 * time.Minute
+
+// Settings for signing users in with an OpenID Connect issuer,
+// instead of running the oauth2-proxy.
+type OIDCSettings struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+
+	// The URL of /oauth2/callback on the dashboard, as registered with the issuer.
+	// Defaults to the callback on the gateway host.
+	RedirectURL string
+
+	// Secret key for encrypting session cookies.
+	CookieSecret string
+
+	// The ID token claims with the user name and groups.
+	// The user name must be a valid DNS label, because it names the env.
+	UserClaim   string
+	GroupsClaim string
+
+	Scopes []string
+}
+
+func (o OIDCSettings) Enabled() bool {
+	return o.IssuerURL != ""
+}
+
+func (o OIDCSettings) Validate() error {
+	if o.ClientID == "" {
+		return fmt.Errorf("Missing OIDC client ID. Please specify --auth-oidc-client-id")
+	}
+	if len(o.CookieSecret) < 16 {
+		return fmt.Errorf("OIDC cookie secret must be at least 16 characters. Please set EPH_OIDC_COOKIE_SECRET")
+	}
+	if o.UserClaim == "" {
+		return fmt.Errorf("Missing OIDC user claim")
+	}
+	return nil
+}
+
+// A signed-in user, stored encrypted in the session cookie.
+type oidcSession struct {
+	User   string   `json:"user"`
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// When the tokens expire, and how to get new ones.
+	Expiry       time.Time `json:"expiry"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+}
+
+func (s *oidcSession) identity() Identity {
+	return Identity{User: s.User, Email: s.Email, Groups: s.Groups}
+}
+
+// An in-progress sign-in, stored encrypted in the state cookie.
+type oidcState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Redirect string    `json:"redirect"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// Signs users in with the authorization code flow, and keeps
+// them signed in with refresh tokens.
+//
+// Serves the same /oauth2/ paths as the oauth2-proxy, so that
+// the gateway Ingress works with either.
+type oidcAuth struct {
+	settings OIDCSettings
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	aead     cipher.AEAD
+	live     *ephconfig.LiveConfig
+	secure   bool
+	now      func() time.Time
+}
+
+// Discovers the issuer's endpoints and keys.
+func newOIDCAuth(ctx context.Context, settings OIDCSettings, live *ephconfig.LiveConfig, gatewayTLS ephconfig.GatewayTLS) (*oidcAuth, error) {
+	provider, err := oidc.NewProvider(ctx, settings.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC issuer: %v", err)
+	}
+
+	key := sha256.Sum256([]byte(settings.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := settings.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	a := &oidcAuth{
+		settings: settings,
+		config: oauth2.Config{
+			ClientID:     settings.ClientID,
+			ClientSecret: settings.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  settings.RedirectURL,
+			Scopes:       scopes,
+		},
+		aead:   aead,
+		live:   live,
+		secure: gatewayTLS.Enabled(),
+		now:    time.Now,
+	}
+	a.verifier = provider.Verifier(&oidc.Config{
+		ClientID: settings.ClientID,
+		Now:      func() time.Time { return a.now() },
+	})
+	return a, nil
+}
+
+func (a *oidcAuth) gatewayHost() string {
+	return a.live.GatewayHost()
+}
+
+// The callback is on the gateway host, unless the operator
+// registered another URL with the issuer.
+func (a *oidcAuth) oauth2Config() *oauth2.Config {
+	config := a.config
+	if config.RedirectURL == "" {
+		scheme := "http"
+		if a.secure {
+			scheme = "https"
+		}
+		config.RedirectURL = fmt.Sprintf("%s://%s/oauth2/callback", scheme, a.gatewayHost())
+	}
+	return &config
+}
+
+func (a *oidcAuth) addRoutes(r *mux.Router) {
+	r.HandleFunc("/oauth2/start", a.signIn).Methods("GET")
+	r.HandleFunc("/oauth2/sign_in", a.signIn).Methods("GET")
+	r.HandleFunc("/oauth2/callback", a.callback).Methods("GET")
+	r.HandleFunc("/oauth2/sign_out", a.signOut).Methods("GET", "POST")
+	r.HandleFunc("/oauth2/auth", a.auth).Methods("GET")
+}
+
+// Paths that don't need a signed-in user, or that check it themselves.
+func isPublicPath(path string) bool {
+	return strings.HasPrefix(path, "/oauth2/") ||
+		strings.HasPrefix(path, "/static/") ||
+		path == "/favicon.ico" ||
+		path == "/share" ||
+		path == "/gateway/auth"
+}
+
+type identityKey struct{}
+
+// Requires a session for every request to the dashboard, refreshing
+// it if needed, and passes the user along in the request context.
+//
+// Browsers are sent to sign in. API clients get a 401.
+func (a *oidcAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) || hostname(r.Host) != a.gatewayHost() {
+			next.ServeHTTP(res, r)
+			return
+		}
+		if _, ok := identityFromContext(r.Context()); ok {
+			// Already signed in with an API token.
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		session, err := a.session(res, r)
+		if err != nil {
+			if r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/") {
+				q := url.Values{}
+				q.Set("rd", r.URL.RequestURI())
+				http.Redirect(res, r, fmt.Sprintf("/oauth2/start?%s", q.Encode()), http.StatusFound)
+				return
+			}
+			http.Error(res, fmt.Sprintf("Not signed in: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), identityKey{}, session.identity())
+		next.ServeHTTP(res, r.WithContext(ctx))
+	})
+}
+
+// The user that the OIDC middleware signed in,
+// or whose identity headers the proxy middleware verified.
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+func hostname(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return h
+}
+
+// Starts the authorization code flow.
+//
+// If the user already has a session (e.g., the gateway sent them here
+// because their tokens expired, and we could refresh them), sends them
+// straight back.
+func (a *oidcAuth) signIn(res http.ResponseWriter, r *http.Request) {
+	redirect := a.safeRedirect(r.URL.Query().Get("rd"))
+	if session, err := a.session(res, r); err == nil {
+		// The gateway cookie may have expired before the session did.
+		err = a.setGatewayCookie(res, session)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Starting sign-in: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(res, r, redirect, http.StatusFound)
+		return
+	}
+
+	state := oidcState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: redirect,
+		Expiry:   a.now().Add(oidcStateTTL),
+	}
+	err := a.setCookie(res, oidcStateCookie, "/oauth2/", state, state.Expiry)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Starting sign-in: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, r, a.oauth2Config().AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+// Finishes the authorization code flow, and starts the session.
+func (a *oidcAuth) callback(res http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	err := a.readCookie(r, oidcStateCookie, &state)
+	if err != nil || a.now().After(state.Expiry) {
+		http.Error(res, "Sign-in expired. Please try again", http.StatusBadRequest)
+		return
+	}
+	a.clearCookie(res, oidcStateCookie, "/oauth2/")
+
+	q := r.URL.Query()
+	if q.Get("state") != state.State {
+		http.Error(res, "Sign-in state mismatch. Please try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(res, fmt.Sprintf("Sign-in failed: %s %s", e, q.Get("error_description")), http.StatusForbidden)
+		return
+	}
+
+	token, err := a.oauth2Config().Exchange(r.Context(), q.Get("code"))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Exchanging code: %v", err), http.StatusForbidden)
+		return
+	}
+
+	session, err := a.newSession(r.Context(), token, state.Nonce)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Verifying ID token: %v", err), http.StatusForbidden)
+		return
+	}
+
+	err = a.startSession(res, session)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Starting session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, r, state.Redirect, http.StatusFound)
+}
+
+// Ends the session. Users stay signed in with the issuer.
+func (a *oidcAuth) signOut(res http.ResponseWriter, r *http.Request) {
+	a.endSession(res)
+	http.Redirect(res, r, a.safeRedirect(r.URL.Query().Get("rd")), http.StatusFound)
+}
+
+// Checks the session for the gateway Ingress, like the oauth2-proxy's
+// /oauth2/auth endpoint. Expired sessions get a 401, so that the
+// gateway sends the user to sign in, which refreshes them.
+func (a *oidcAuth) auth(res http.ResponseWriter, r *http.Request) {
+	session, err := a.loadGatewaySession(r)
+	if err != nil {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	for k, vs := range a.headers(session) {
+		res.Header()[k] = vs
+	}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// The headers that the oauth2-proxy would pass upstream for this session.
+func (a *oidcAuth) headers(session *oidcSession) http.Header {
+	h := http.Header{}
+	h.Set("X-Auth-Request-User", session.User)
+	if session.Email != "" {
+		h.Set("X-Auth-Request-Email", session.Email)
+	}
+	if len(session.Groups) > 0 {
+		h.Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+	}
+	return h
+}
+
+// Verifies the ID token in a token response, and reads the user from it.
+//
+// Refresh responses may not include a new ID token. In that case,
+// we keep the user from the previous session.
+func (a *oidcAuth) newSession(ctx context.Context, token *oauth2.Token, nonce string) (*oidcSession, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response has no ID token")
+	}
+	idToken, err := a.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := claims[a.settings.UserClaim].(string)
+	user = strings.ToLower(user)
+	if user == "" {
+		return nil, fmt.Errorf("ID token has no %s claim", a.settings.UserClaim)
+	}
+	if errs := validation.IsDNS1123Label(user); len(errs) > 0 {
+		return nil, fmt.Errorf("user %q from claim %s can't name an env: %s", user, a.settings.UserClaim, strings.Join(errs, ", "))
+	}
+
+	session := &oidcSession{
+		User:         user,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+	if session.Expiry.IsZero() {
+		session.Expiry = idToken.Expiry
+	}
+	// Only trust emails that the issuer verified, because
+	// admins may be listed by email.
+	if verified, _ := claims["email_verified"].(bool); verified {
+		session.Email, _ = claims["email"].(string)
+	}
+	switch groups := claims[a.settings.GroupsClaim].(type) {
+	case string:
+		session.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				session.Groups = append(session.Groups, g)
+			}
+		}
+	}
+	return session, nil
+}
+
+// Reads the session cookie, without refreshing it.
+func (a *oidcAuth) loadSession(r *http.Request) (*oidcSession, error) {
+	return a.loadCookieSession(r, oidcSessionCookie)
+}
+
+// Reads the gateway cookie, for requests to env hosts.
+func (a *oidcAuth) loadGatewaySession(r *http.Request) (*oidcSession, error) {
+	return a.loadCookieSession(r, oidcGatewayCookie)
+}
+
+func (a *oidcAuth) loadCookieSession(r *http.Request, name string) (*oidcSession, error) {
+	var session oidcSession
+	err := a.readCookie(r, name, &session)
+	if err != nil {
+		return nil, err
+	}
+	if !a.now().Before(session.Expiry) {
+		return &session, fmt.Errorf("session expired")
+	}
+	return &session, nil
+}
+
+// Sets the session cookie, and the gateway cookie for env hosts.
+func (a *oidcAuth) startSession(res http.ResponseWriter, session *oidcSession) error {
+	err := a.setCookie(res, oidcSessionCookie, "/", session, time.Time{})
+	if err != nil {
+		return err
+	}
+	return a.setGatewayCookie(res, session)
+}
+
+func (a *oidcAuth) endSession(res http.ResponseWriter) {
+	a.clearCookie(res, oidcSessionCookie, "/")
+	a.clearGatewayCookie(res)
+}
+
+// Reads the session cookie, refreshing the tokens if they've expired.
+func (a *oidcAuth) session(res http.ResponseWriter, r *http.Request) (*oidcSession, error) {
+	session, err := a.loadSession(r)
+	if err == nil {
+		return session, nil
+	}
+	if session == nil || session.RefreshToken == "" {
+		return nil, err
+	}
+
+	// Pass an expired token, so that the token source always refreshes.
+	expired := &oauth2.Token{RefreshToken: session.RefreshToken, Expiry: time.Unix(1, 0)}
+	token, err := a.oauth2Config().TokenSource(r.Context(), expired).Token()
+	if err != nil {
+		log.Printf("refreshing session for %s: %v", session.User, err)
+		a.endSession(res)
+		return nil, fmt.Errorf("refreshing session: %v", err)
+	}
+
+	refreshed := *session
+	refreshed.RefreshToken = token.RefreshToken
+	refreshed.Expiry = token.Expiry
+	if _, ok := token.Extra("id_token").(string); ok {
+		next, err := a.newSession(r.Context(), token, "")
+		if err != nil {
+			a.endSession(res)
+			return nil, fmt.Errorf("refreshing session: %v", err)
+		}
+		refreshed = *next
+	}
+	if !a.now().Before(refreshed.Expiry) {
+		return nil, fmt.Errorf("refreshed session already expired")
+	}
+
+	err = a.startSession(res, &refreshed)
+	if err != nil {
+		return nil, err
+	}
+	return &refreshed, nil
+}
+
+// Only redirect back to the dashboard or an env, never to another site.
+func (a *oidcAuth) safeRedirect(rd string) string {
+	if rd == "" {
+		return "/"
+	}
+	if strings.HasPrefix(rd, "/") && !strings.HasPrefix(rd, "//") && !strings.HasPrefix(rd, "/\\") {
+		return rd
+	}
+
+	u, err := url.Parse(rd)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "/"
+	}
+	host := u.Hostname()
+	if host == a.gatewayHost() || strings.HasSuffix(host, "."+a.gatewayHost()) {
+		return rd
+	}
+	return "/"
+}
+
+// Cookies are only sent back to the gateway host, not to env hosts.
+func (a *oidcAuth) setCookie(res http.ResponseWriter, name, path string, v interface{}, expires time.Time) error {
+	value, err := a.seal(v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(res, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (a *oidcAuth) clearCookie(res http.ResponseWriter, name, path string) {
+	http.SetCookie(res, &http.Cookie{
+		Name:     name,
+		Path:     path,
+		MaxAge:   -1,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The gateway cookie is valid on the gateway host and every env host,
+// so that the gateway can check it. It has no refresh token, and
+// expires with the tokens.
+func (a *oidcAuth) setGatewayCookie(res http.ResponseWriter, session *oidcSession) error {
+	identity := *session
+	identity.RefreshToken = ""
+	value, err := a.seal(&identity)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(res, &http.Cookie{
+		Name:     oidcGatewayCookie,
+		Value:    value,
+		Domain:   a.gatewayHost(),
+		Path:     "/",
+		Expires:  identity.Expiry,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (a *oidcAuth) clearGatewayCookie(res http.ResponseWriter) {
+	http.SetCookie(res, &http.Cookie{
+		Name:     oidcGatewayCookie,
+		Domain:   a.gatewayHost(),
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *oidcAuth) readCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return a.open(cookie.Value, v)
+}
+
+// Encrypt and authenticate a cookie value, so that users can't read
+// their refresh tokens or forge sessions.
+func (a *oidcAuth) seal(v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, a.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(a.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (a *oidcAuth) open(value string, v interface{}) error {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("malformed cookie: %v", err)
+	}
+	size := a.aead.NonceSize()
+	if len(ciphertext) < size {
+		return fmt.Errorf("malformed cookie")
+	}
+	plaintext, err := a.aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+	if err != nil {
+		return fmt.Errorf("invalid cookie")
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
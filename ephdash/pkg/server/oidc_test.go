@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+// A fake OIDC issuer that signs in a single user without asking.
+type mockIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	claims    map[string]interface{}
+	nonces    map[string]string
+	refreshes int
+	ttl       time.Duration
+}
+
+func newMockIssuer(t *testing.T, claims map[string]interface{}) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	m := &mockIssuer{t: t, key: key, claims: claims, nonces: map[string]string{}, ttl: time.Hour}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/keys", m.keys)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) discovery(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIssuer) keys(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Approves the sign-in right away, and sends the user back with a code.
+func (m *mockIssuer) authorize(res http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code := randomString()
+	m.mu.Lock()
+	m.nonces[code] = q.Get("nonce")
+	m.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	require.NoError(m.t, err)
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(res, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockIssuer) token(res http.ResponseWriter, r *http.Request) {
+	require.NoError(m.t, r.ParseForm())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nonce := ""
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		var ok bool
+		nonce, ok = m.nonces[r.Form.Get("code")]
+		if !ok {
+			http.Error(res, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(m.nonces, r.Form.Get("code"))
+	case "refresh_token":
+		if r.Form.Get("refresh_token") != "refresh-token" {
+			http.Error(res, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		m.refreshes++
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"access_token":  "access-token",
+		"token_type":    "Bearer",
+		"expires_in":    int(m.ttl.Seconds()),
+		"refresh_token": "refresh-token",
+		"id_token":      m.idToken(nonce),
+	})
+}
+
+func (m *mockIssuer) idToken(nonce string) string {
+	claims := map[string]interface{}{
+		"iss": m.URL,
+		"sub": "1234",
+		"aud": "ephdash",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(m.ttl).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := fmt.Sprintf("%s.%s",
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(payload))
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	require.NoError(m.t, err)
+	return fmt.Sprintf("%s.%s", signed, base64.RawURLEncoding.EncodeToString(sig))
+}
+
+type oidcFixture struct {
+	t      *testing.T
+	issuer *mockIssuer
+	auth   *oidcAuth
+	server *httptest.Server
+	client *http.Client
+}
+
+// Serves a dashboard that only shows who's signed in.
+func newOIDCFixture(t *testing.T, claims map[string]interface{}) *oidcFixture {
+	issuer := newMockIssuer(t, claims)
+
+	r := mux.NewRouter()
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	auth, err := newOIDCAuth(context.Background(), OIDCSettings{
+		IssuerURL:    issuer.URL,
+		ClientID:     "ephdash",
+		ClientSecret: "shh",
+		RedirectURL:  server.URL + "/oauth2/callback",
+		CookieSecret: "0123456789abcdef",
+		UserClaim:    "preferred_username",
+		GroupsClaim:  "groups",
+	}, ephconfig.StaticConfig(nil, "127.0.0.1"), ephconfig.GatewayTLS{})
+	require.NoError(t, err)
+
+	auth.addRoutes(r)
+	r.HandleFunc("/", func(res http.ResponseWriter, r *http.Request) {
+		id, ok := identityFromContext(r.Context())
+		require.True(t, ok)
+		_, _ = fmt.Fprintf(res, "%s %s %s", id.User, id.Email, strings.Join(id.Groups, ","))
+	})
+	r.HandleFunc("/api/env", func(res http.ResponseWriter, r *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	})
+	r.Use(auth.middleware)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &oidcFixture{t: t, issuer: issuer, auth: auth, server: server, client: &http.Client{Jar: jar}}
+}
+
+func (f *oidcFixture) get(path string) (int, string) {
+	resp, err := f.client.Get(f.server.URL + path)
+	require.NoError(f.t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(f.t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	f := newOIDCFixture(t, map[string]interface{}{
+		"preferred_username": "Alice",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"groups":             []string{"eng", "admins"},
+	})
+
+	// API clients aren't redirected.
+	code, _ := f.get("/api/env")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Browsers go through the issuer and back.
+	code, body := f.get("/")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "alice alice@example.com eng,admins", body)
+
+	code, _ = f.get("/api/env")
+	assert.Equal(t, http.StatusOK, code)
+
+	// The gateway can check the same user.
+	req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+	for _, c := range f.client.Jar.Cookies(mustParseURL(t, f.server.URL)) {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	f.auth.auth(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "alice", rec.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, "eng,admins", rec.Header().Get("X-Auth-Request-Groups"))
+
+	// Signing out ends the session. Don't follow the redirect,
+	// or the mock issuer will sign us right back in.
+	f.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := f.client.PostForm(f.server.URL+"/oauth2/sign_out", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, f.client.Jar.Cookies(mustParseURL(t, f.server.URL)))
+	code, _ = f.get("/api/env")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	f := newOIDCFixture(t, map[string]interface{}{
+		"preferred_username": "alice",
+		"email":              "ops@example.com",
+		"email_verified":     false,
+	})
+
+	code, body := f.get("/")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "alice  ", body)
+}
+
+func TestOIDCSessionCookies(t *testing.T) {
+	a := newOIDCFixture(t, map[string]interface{}{"preferred_username": "alice"}).auth
+	rec := httptest.NewRecorder()
+	err := a.startSession(rec, &oidcSession{
+		User:         "alice",
+		Expiry:       time.Now().Add(time.Hour),
+		RefreshToken: "refresh",
+	})
+	require.NoError(t, err)
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	require.Len(t, cookies, 2)
+
+	// The session stays on the gateway host.
+	assert.Equal(t, "", cookies[oidcSessionCookie].Domain)
+
+	// Env hosts only see who the user is.
+	gateway := cookies[oidcGatewayCookie]
+	assert.Equal(t, "127.0.0.1", gateway.Domain)
+	var session oidcSession
+	require.NoError(t, a.open(gateway.Value, &session))
+	assert.Equal(t, "alice", session.User)
+	assert.Equal(t, "", session.RefreshToken)
+
+	// The dashboard doesn't take the gateway cookie, because env
+	// servers can read it.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(gateway)
+	_, err = a.session(httptest.NewRecorder(), req)
+	assert.Error(t, err)
+
+	req = httptest.NewRequest("GET", "/oauth2/auth", nil)
+	req.AddCookie(gateway)
+	rec = httptest.NewRecorder()
+	a.auth(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	f := newOIDCFixture(t, map[string]interface{}{"preferred_username": "alice"})
+
+	code, body := f.get("/")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, 0, f.issuer.refreshes)
+
+	// Once the tokens expire, we refresh them without another sign-in.
+	f.auth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	f.issuer.ttl = 3 * time.Hour
+	code, body = f.get("/api/env")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, 1, f.issuer.refreshes)
+
+	// The refreshed session is good for a while.
+	code, _ = f.get("/api/env")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, f.issuer.refreshes)
+}
+
+func TestOIDCRejectsInvalidUser(t *testing.T) {
+	f := newOIDCFixture(t, map[string]interface{}{"preferred_username": "alice@example.com"})
+
+	code, body := f.get("/")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Contains(t, body, "can't name an env")
+}
+
+func TestOIDCSafeRedirect(t *testing.T) {
+	a := &oidcAuth{live: ephconfig.StaticConfig(nil, "preview.localhost")}
+	assert.Equal(t, "/", a.safeRedirect(""))
+	assert.Equal(t, "/admin?x=1", a.safeRedirect("/admin?x=1"))
+	assert.Equal(t, "https://web---alice.preview.localhost/app", a.safeRedirect("https://web---alice.preview.localhost/app"))
+	assert.Equal(t, "/", a.safeRedirect("//evil.com/"))
+	assert.Equal(t, "/", a.safeRedirect("https://evil.com/"))
+	assert.Equal(t, "/", a.safeRedirect("https://evilpreview.localhost/"))
+	assert.Equal(t, "/", a.safeRedirect("javascript:alert(1)"))
+}
+
+func TestOIDCCookieTampering(t *testing.T) {
+	f := newOIDCFixture(t, map[string]interface{}{"preferred_username": "alice"})
+
+	var session oidcSession
+	value, err := f.auth.seal(&oidcSession{User: "alice"})
+	require.NoError(t, err)
+	require.NoError(t, f.auth.open(value, &session))
+	assert.Equal(t, "alice", session.User)
+
+	tampered := []byte(value)
+	tampered[len(tampered)-2] ^= 1
+	assert.Error(t, f.auth.open(string(tampered), &session))
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
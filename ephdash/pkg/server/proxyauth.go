@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+)
+
+// The header that the gateway Ingress sets on requests to the dashboard,
+// to prove that the identity headers came from the oauth2-proxy.
+const ProxySecretHeader = "X-Ephemerator-Proxy-Secret"
+
+var authSpoofAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ephdash_auth_spoof_attempts_total",
+	Help: "Number of requests with identity headers that didn't come from the oauth2-proxy.",
+})
+
+func init() {
+	prometheus.MustRegister(authSpoofAttempts)
+}
+
+// Checks that identity headers came from the oauth2-proxy, by way of the
+// gateway Ingress, and not from a client that reached ephdash directly.
+//
+// Requests must carry the shared secret, or an ID token from the
+// proxy's issuer for the same user.
+type proxyVerifier struct {
+	secret    string
+	verifier  *oidc.IDTokenVerifier
+	userClaim string
+}
+
+func newProxyVerifier(ctx context.Context, settings AuthSettings) (*proxyVerifier, error) {
+	v := &proxyVerifier{
+		secret:    settings.ProxySecret,
+		userClaim: settings.ProxyJWTUserClaim,
+	}
+	if settings.ProxyJWTIssuer != "" {
+		provider, err := oidc.NewProvider(ctx, settings.ProxyJWTIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("discovering proxy JWT issuer: %v", err)
+		}
+		v.verifier = provider.Verifier(&oidc.Config{ClientID: settings.ProxyJWTAudience})
+	}
+	return v, nil
+}
+
+func (v *proxyVerifier) verify(r *http.Request, user string) error {
+	if v.secret != "" {
+		got := r.Header.Get(ProxySecretHeader)
+		if got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(v.secret)) == 1 {
+			return nil
+		}
+		if v.verifier == nil {
+			return fmt.Errorf("missing or invalid %s header", ProxySecretHeader)
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return fmt.Errorf("missing bearer token")
+	}
+	token, err := v.verifier.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return fmt.Errorf("invalid bearer token: %v", err)
+	}
+
+	var claims map[string]interface{}
+	err = token.Claims(&claims)
+	if err != nil {
+		return fmt.Errorf("invalid bearer token: %v", err)
+	}
+	claim, _ := claims[v.userClaim].(string)
+	if claim != user {
+		return fmt.Errorf("bearer token is for %q", claim)
+	}
+	return nil
+}
+
+// Reads the identity headers from the oauth2-proxy, and passes the user
+// along in the request context once we've verified them.
+//
+// Rejects requests with identity headers we can't verify.
+func (s *Server) proxyAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("X-Auth-Request-User")
+		if _, ok := identityFromContext(r.Context()); ok || user == "" {
+			// No headers, or already signed in with an API token.
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		err := s.proxyVerifier.verify(r, user)
+		if err != nil {
+			authSpoofAttempts.Inc()
+			log.Printf("auth: rejected identity headers for user %q from %s: %v", user, audit.SourceIP(r), err)
+			http.Error(res, "Unverified identity headers", http.StatusUnauthorized)
+			return
+		}
+
+		id := Identity{User: user, Email: r.Header.Get("X-Auth-Request-Email")}
+		for _, g := range strings.Split(r.Header.Get("X-Auth-Request-Groups"), ",") {
+			g = strings.TrimSpace(g)
+			if g != "" {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+		ctx := context.WithValue(r.Context(), identityKey{}, id)
+		next.ServeHTTP(res, r.WithContext(ctx))
+	})
+}
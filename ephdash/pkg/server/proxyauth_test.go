@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Serves a handler that only shows who's signed in.
+func newProxyAuthFixture(t *testing.T, settings AuthSettings) http.Handler {
+	v, err := newProxyVerifier(context.Background(), settings)
+	require.NoError(t, err)
+	s := &Server{authSettings: settings, proxyVerifier: v}
+	return s.proxyAuthMiddleware(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		id, err := s.identity(r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		_, _ = res.Write([]byte(id.User))
+	}))
+}
+
+func serve(h http.Handler, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProxySecret(t *testing.T) {
+	h := newProxyAuthFixture(t, AuthSettings{Proxy: "http://oauth2-proxy", ProxySecret: "shh"})
+
+	rec := serve(h, map[string]string{"X-Auth-Request-User": "alice", ProxySecretHeader: "shh"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "alice", rec.Body.String())
+
+	// No headers at all means no user.
+	rec = serve(h, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "userinfo empty")
+
+	// Headers without the secret are a spoof attempt.
+	before := testutil.ToFloat64(authSpoofAttempts)
+	rec = serve(h, map[string]string{"X-Auth-Request-User": "alice"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Unverified identity headers")
+
+	rec = serve(h, map[string]string{"X-Auth-Request-User": "alice", ProxySecretHeader: "guess"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, before+2, testutil.ToFloat64(authSpoofAttempts))
+}
+
+func TestProxyJWT(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]interface{}{"preferred_username": "alice"})
+	h := newProxyAuthFixture(t, AuthSettings{
+		Proxy:             "http://oauth2-proxy",
+		ProxyJWTIssuer:    issuer.URL,
+		ProxyJWTAudience:  "ephdash",
+		ProxyJWTUserClaim: "preferred_username",
+	})
+	token := issuer.idToken("")
+
+	rec := serve(h, map[string]string{"X-Auth-Request-User": "alice", "Authorization": "Bearer " + token})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "alice", rec.Body.String())
+
+	// A token for alice doesn't let you claim to be bob.
+	rec = serve(h, map[string]string{"X-Auth-Request-User": "bob", "Authorization": "Bearer " + token})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = serve(h, map[string]string{"X-Auth-Request-User": "alice", "Authorization": "Bearer garbage"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestFakeUserIgnoresHeaders(t *testing.T) {
+	s := &Server{authSettings: AuthSettings{FakeUser: "nick"}}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Auth-Request-User", "alice")
+	user, err := s.username(req)
+	require.NoError(t, err)
+	assert.Equal(t, "nick", user)
+}
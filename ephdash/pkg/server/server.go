@@ -1,19 +1,28 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v42/github"
 	"github.com/gorilla/mux"
 	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/apitoken"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
 	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
 	"github.com/tilt-dev/ephemerator/ephdash/web/static"
+	"github.com/tilt-dev/ephemerator/pkg/notify"
 	"golang.org/x/oauth2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/rand"
 
 	webtemplate "github.com/tilt-dev/ephemerator/ephdash/web/template"
 )
@@ -23,18 +32,35 @@ type Server struct {
 	*mux.Router
 
 	envClient    *env.Client
-	allowlist    *ephconfig.Allowlist
-	gatewayHost  string
+	auditLog     *audit.Logger
+	notifier     *notify.Dispatcher
+	tokens       *apitoken.Store
+	config       *ephconfig.LiveConfig
+	gatewayTLS   ephconfig.GatewayTLS
 	tmpl         *template.Template
 	authSettings AuthSettings
+
+	// Set if ephdash signs users in itself.
+	oidc *oidcAuth
+
+	// Set if ephdash trusts identity headers from the oauth2-proxy.
+	proxyVerifier *proxyVerifier
+
+	csrf *csrfProtection
+
+	defaultBranches defaultBranchCache
 }
 
-func NewServer(envClient *env.Client, allowlist *ephconfig.Allowlist, gatewayHost string, authSettings AuthSettings) (*Server, error) {
+func NewServer(envClient *env.Client, auditLog *audit.Logger, notifier *notify.Dispatcher, tokens *apitoken.Store, config *ephconfig.LiveConfig, gatewayTLS ephconfig.GatewayTLS, authSettings AuthSettings) (*Server, error) {
 	s := &Server{
 		envClient:    envClient,
-		allowlist:    allowlist,
-		gatewayHost:  gatewayHost,
+		auditLog:     auditLog,
+		notifier:     notifier,
+		tokens:       tokens,
+		config:       config,
+		gatewayTLS:   gatewayTLS,
 		authSettings: authSettings,
+		csrf:         newCSRFProtection(authSettings.CSRFSecret, gatewayTLS.Enabled()),
 	}
 
 	r := mux.NewRouter()
@@ -44,26 +70,80 @@ func NewServer(envClient *env.Client, allowlist *ephconfig.Allowlist, gatewayHos
 		return nil, err
 	}
 
+	if authSettings.OIDC.Enabled() {
+		s.oidc, err = newOIDCAuth(context.Background(), authSettings.OIDC, config, gatewayTLS)
+		if err != nil {
+			return nil, err
+		}
+		s.oidc.addRoutes(r)
+	}
+	if authSettings.Proxy != "" {
+		s.proxyVerifier, err = newProxyVerifier(context.Background(), authSettings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticContent))
 	r.Handle("/favicon.ico", staticContent).Methods("GET")
 	r.HandleFunc("/index.html", s.index).Methods("GET")
 	r.HandleFunc("/create", s.create).Methods("POST")
 	r.HandleFunc("/delete", s.deleteEnv).Methods("POST")
-	r.HandleFunc("/", s.index).Methods("GET", "POST")
+	r.HandleFunc("/action", s.action).Methods("POST")
+	r.HandleFunc("/api/env", s.apiGetEnv).Methods("GET")
+	r.HandleFunc("/api/env", s.apiSetEnv).Methods("POST")
+	r.HandleFunc("/api/env", s.apiDeleteEnv).Methods("DELETE")
+	r.HandleFunc("/api/env/action", s.apiGetAction).Methods("GET")
+	r.HandleFunc("/api/env/action", s.apiCreateAction).Methods("POST")
+	r.HandleFunc("/api/env/share", s.apiCreateShare).Methods("POST")
+	r.HandleFunc("/visibility", s.setVisibility).Methods("POST")
+	r.HandleFunc("/share", s.share).Methods("GET")
+	r.HandleFunc("/share/revoke", s.revokeShares).Methods("POST")
+	r.HandleFunc("/tokens", s.tokensPage).Methods("GET")
+	r.HandleFunc("/tokens", s.createToken).Methods("POST")
+	r.HandleFunc("/tokens/revoke", s.revokeToken).Methods("POST")
+	r.HandleFunc("/gateway/auth", s.gatewayAuth).Methods("GET")
+	r.HandleFunc("/admin", s.adminEnvs).Methods("GET")
+	r.HandleFunc("/admin/envs", s.adminBulk).Methods("POST")
+	r.HandleFunc("/admin/audit", s.adminAudit).Methods("GET")
+	r.HandleFunc("/api/admin/envs", s.apiAdminEnvs).Methods("GET")
+	r.HandleFunc("/api/admin/envs", s.apiAdminBulk).Methods("POST")
+	r.HandleFunc("/api/admin/audit", s.apiAdminAudit).Methods("GET")
+	r.HandleFunc("/api/admin/config", s.apiAdminConfig).Methods("GET")
+	r.HandleFunc("/", s.index).Methods("GET")
+	r.Use(metricsMiddleware)
+	r.Use(s.apiTokenMiddleware)
+	if s.oidc != nil {
+		r.Use(s.oidc.middleware)
+	}
+	if s.proxyVerifier != nil {
+		r.Use(s.proxyAuthMiddleware)
+	}
+	r.Use(s.csrfMiddleware)
 
 	s.Router = r
 	s.tmpl = tmpl
 	return s, nil
 }
 
+// The allowlist and gateway host can change while we're running,
+// when an operator edits the ephconfig ConfigMap.
+func (s *Server) allowlist() *ephconfig.Allowlist {
+	return s.config.Allowlist()
+}
+
+func (s *Server) gatewayHost() string {
+	return s.config.GatewayHost()
+}
+
 func (s *Server) index(res http.ResponseWriter, r *http.Request) {
-	user, err := s.username(r)
+	id, err := s.identity(r)
 	if err != nil {
-		if r.Host != s.gatewayHost {
+		if r.Host != s.gatewayHost() {
 			res.WriteHeader(http.StatusNotFound)
 			_ = s.tmpl.ExecuteTemplate(res, "not-found.tmpl", map[string]interface{}{
 				"host":        r.Host,
-				"gatewayHost": s.gatewayHost,
+				"gatewayHost": s.gatewayHost(),
 			})
 			return
 		}
@@ -72,36 +152,83 @@ func (s *Server) index(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.renderIndex(res, r, id, http.StatusOK, nil)
+}
+
+// Renders the dashboard for the user. The creation form is filled in
+// from the query, and highlights the fields with errors, if any.
+func (s *Server) renderIndex(res http.ResponseWriter, r *http.Request, id Identity, code int, fieldErrors map[string]string) {
+	user := id.User
 	env, envError := s.envClient.GetEnv(r.Context(), user)
-	repoOptions, selectedRepo := s.repoOptions(r)
+	policy, policyError := s.allowlist().PolicyFor(id.Groups)
+	repoOptions, selectedRepo := s.repoOptions(r, policy)
 	githubClient := s.githubClient(r)
 	branchOptions, selectedBranch := s.branchOptions(r, githubClient, selectedRepo)
 	pathOptions := s.pathOptions(r, githubClient, selectedRepo, selectedBranch)
 
-	err = s.tmpl.ExecuteTemplate(res, "index.tmpl", map[string]interface{}{
+	var shareLinks []ShareLink
+	if env != nil && env.Visibility() == ephconfig.VisibilityPublic {
+		_, shareLinks, _ = s.shareLinks(env)
+	}
+
+	data := map[string]interface{}{
 		"env":           env,
 		"envError":      envError,
-		"gatewayHost":   s.gatewayHost,
+		"visibilities":  ephconfig.Visibilities,
+		"shareEnabled":  len(s.authSettings.ShareSecret) > 0,
+		"shareLinks":    shareLinks,
+		"gatewayHost":   s.gatewayHost(),
+		"gatewayScheme": s.gatewayTLS.Scheme(),
 		"user":          user,
+		"isAdmin":       s.isAdmin(r),
 		"repoOptions":   repoOptions,
+		"repoPatterns":  s.allowlist().HasRepoPatterns(),
 		"branchOptions": branchOptions,
 		"pathOptions":   pathOptions,
-	})
+		"paramFields":   s.paramFields(r, selectedRepo),
+		"sizeOptions":   s.sizeOptions(r, policy),
+		"policy":        policy,
+		"policyError":   policyError,
+		"fieldErrors":   fieldErrors,
+		"csrfToken":     s.csrfToken(res, r),
+	}
+
+	// Render first, so a template error can still set the status.
+	var buf bytes.Buffer
+	err := s.tmpl.ExecuteTemplate(&buf, "index.tmpl", data)
 	if err != nil {
 		http.Error(res, fmt.Sprintf("Rendering HTML: %v", err), http.StatusInternalServerError)
+		return
 	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(code)
+	_, _ = buf.WriteTo(res)
+}
+
+// A link to the dashboard, for notifications.
+func (s *Server) dashboardLinks() []notify.Link {
+	return []notify.Link{{Name: "Dashboard", URL: fmt.Sprintf("%s://%s/", s.gatewayTLS.Scheme(), s.gatewayHost())}}
 }
 
 func (s *Server) username(r *http.Request) (string, error) {
+	id, err := s.identity(r)
+	return id.User, err
+}
+
+// Reads the user, with the email and groups that the oauth2-proxy
+// passes along, or from the OIDC session. The fake user has no email or groups.
+//
+// The auth middleware verifies the user before we trust them.
+func (s *Server) identity(r *http.Request) (Identity, error) {
 	if s.authSettings.FakeUser != "" {
-		return s.authSettings.FakeUser, nil
+		return Identity{User: s.authSettings.FakeUser}, nil
 	}
 
-	user := r.Header.Get("X-Auth-Request-User")
-	if user == "" {
-		return "", fmt.Errorf("userinfo empty")
+	id, ok := identityFromContext(r.Context())
+	if !ok {
+		return Identity{}, fmt.Errorf("userinfo empty")
 	}
-	return user, nil
+	return id, nil
 }
 
 // Creates an environment.
@@ -115,7 +242,7 @@ func (s *Server) create(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.username(r)
+	id, err := s.identity(r)
 	if err != nil {
 		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusInternalServerError)
 		return
@@ -125,26 +252,93 @@ func (s *Server) create(res http.ResponseWriter, r *http.Request) {
 		Repo:   r.FormValue("repo"),
 		Branch: r.FormValue("branch"),
 		Path:   r.FormValue("path"),
+		Size:   r.FormValue("size"),
 	}
+	s.readParams(r, &spec)
 
 	if spec.Repo == "" || spec.Branch == "" || spec.Path == "" {
 		http.Error(res, fmt.Sprintf("Missing form data: %v", spec), http.StatusBadRequest)
 		return
 	}
 
-	err = ephconfig.IsAllowed(s.allowlist, spec)
+	code, err := s.setEnvSpec(r, id, spec)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("May not create env for repo %q: %v", spec.Repo, err), http.StatusForbidden)
+		if errs := ephconfig.AsFieldErrors(err); errs != nil {
+			// Show the form again, with what the user picked, and the fields to fix.
+			r.URL.RawQuery = r.PostForm.Encode()
+			s.renderIndex(res, r, id, code, errs.ByField())
+			return
+		}
+		http.Error(res, err.Error(), code)
 		return
 	}
 
-	err = s.envClient.SetEnvSpec(r.Context(), user, spec)
+	http.Redirect(res, r, "/", http.StatusSeeOther)
+}
+
+// Creates or updates the user's env, if the spec is allowed.
+//
+// Records the change in the audit log, and sends notifications.
+// Returns an HTTP status code with the error.
+func (s *Server) setEnvSpec(r *http.Request, id Identity, spec ephconfig.EnvSpec) (int, error) {
+	user := id.User
+	entry := audit.Entry{User: user, Action: audit.ActionCreate, Spec: &spec}
+	eventType := notify.EventCreated
+	if existing, _ := s.envClient.GetEnvConfig(user); existing != nil {
+		entry.Action = audit.ActionUpdate
+		eventType = notify.EventUpdated
+	}
+
+	policy, code, err := s.checkAllowed(id, spec)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Creating env: %v", err), http.StatusInternalServerError)
-		return
+		s.recordAudit(r, entry, code, err)
+		if code == http.StatusForbidden {
+			return code, fmt.Errorf("May not create env for repo %q: %w", spec.Repo, err)
+		}
+		return code, err
 	}
 
-	http.Redirect(res, r, "/", http.StatusSeeOther)
+	group := ""
+	if policy != nil {
+		group = policy.Name
+	}
+	err = s.envClient.SetEnvSpec(r.Context(), user, spec, group)
+	s.recordAudit(r, entry, http.StatusInternalServerError, err)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Creating env: %v", err)
+	}
+	s.notifier.Notify(notify.Event{Type: eventType, Env: user, Spec: &spec, Links: s.dashboardLinks()})
+	return http.StatusOK, nil
+}
+
+// Checks the spec against the allowlist and the policy of the user's group,
+// including the group's limit on envs.
+//
+// Returns the policy (nil if the allowlist has no groups) and an HTTP status code.
+func (s *Server) checkAllowed(id Identity, spec ephconfig.EnvSpec) (*ephconfig.GroupPolicy, int, error) {
+	allowlist := s.allowlist()
+	policy, err := allowlist.PolicyFor(id.Groups)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	err = ephconfig.IsAllowedForGroup(allowlist, policy, spec)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	if policy == nil || policy.MaxEnvs == 0 {
+		return policy, http.StatusOK, nil
+	}
+
+	count, err := s.envClient.CountGroupEnvs(policy.Name, id.User)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Counting envs: %v", err)
+	}
+	if count >= policy.MaxEnvs {
+		return nil, http.StatusForbidden, fmt.Errorf("Forbidden: group %s may only run %d envs at once", policy.Name, policy.MaxEnvs)
+	}
+	return policy, http.StatusOK, nil
 }
 
 // Deletes an environment. One environment per user.
@@ -155,29 +349,102 @@ func (s *Server) deleteEnv(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.envClient.DeleteEnv(r.Context(), user)
+	err = s.deleteUserEnv(r, user)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) deleteUserEnv(r *http.Request, user string) error {
+	err := s.envClient.DeleteEnv(r.Context(), user)
+	s.recordAudit(r, audit.Entry{User: user, Action: audit.ActionDelete}, http.StatusInternalServerError, err)
+	if err != nil {
+		return fmt.Errorf("Deleting env: %v", err)
+	}
+	s.notifier.Notify(notify.Event{Type: notify.EventDeleted, Env: user})
+	return nil
+}
+
+// Runs an action against the Tilt instance in the user's environment.
+func (s *Server) action(res http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing form data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, code, err := s.requestAction(r, user, ephconfig.Action(r.FormValue("action")), r.FormValue("resource"))
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Deleting env: %v", err), http.StatusInternalServerError)
+		http.Error(res, err.Error(), code)
 		return
 	}
 
 	http.Redirect(res, r, "/", http.StatusSeeOther)
 }
 
+// Validates an action and forwards it to ephctrl.
+//
+// Returns the request and an HTTP status code.
+func (s *Server) requestAction(r *http.Request, user string, action ephconfig.Action, resource string) (ephconfig.ActionRequest, int, error) {
+	req := ephconfig.ActionRequest{
+		ID:       fmt.Sprintf("%d-%s", time.Now().Unix(), rand.String(6)),
+		Action:   action,
+		Resource: resource,
+		User:     user,
+	}
+
+	entry := audit.Entry{User: user, Action: string(action), Resource: resource}
+	err := ephconfig.IsActionAllowed(req)
+	if err != nil {
+		s.recordAudit(r, entry, http.StatusForbidden, err)
+		return req, http.StatusForbidden, fmt.Errorf("May not run action %q: %v", action, err)
+	}
+
+	err = s.envClient.RequestAction(r.Context(), user, req)
+	s.recordAudit(r, entry, http.StatusInternalServerError, err)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return req, http.StatusNotFound, fmt.Errorf("No env for user %s", user)
+		}
+		return req, http.StatusInternalServerError, fmt.Errorf("Requesting action: %v", err)
+	}
+	return req, http.StatusAccepted, nil
+}
+
 type FormOption struct {
 	Name     string
 	Value    string
 	Selected bool
 }
 
-// Generate all the valid options for the repo form.
+// Generate all the valid options for the repo form,
+// limited to the repos the user's group allows.
+//
+// Repos that the allowlist only matches by pattern aren't listed, but
+// users can type them in, and we add them to the options.
 // Returns the selected repo URL.
-func (s *Server) repoOptions(r *http.Request) ([]FormOption, string) {
+func (s *Server) repoOptions(r *http.Request, policy *ephconfig.GroupPolicy) ([]FormOption, string) {
 	result := []FormOption{}
 	selected := ""
 	qRepo := r.URL.Query().Get("repo")
-	for _, repo := range s.allowlist.RepoNames {
-		v := fmt.Sprintf("%s/%s", s.allowlist.RepoBase, repo)
+	allowlist := s.allowlist()
+	repos := allowlist.ListedRepos()
+	if qRepo != "" && !contains(repos, qRepo) && allowlist.IsRepoAllowed(qRepo) == nil {
+		repos = append([]string{qRepo}, repos...)
+	}
+	for _, v := range repos {
+		if !policy.AllowsRepo(v) {
+			continue
+		}
 		n := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(v, "http://"), "https://"), "github.com/")
 		s := qRepo == v
 		o := FormOption{
@@ -198,6 +465,89 @@ func (s *Server) repoOptions(r *http.Request) ([]FormOption, string) {
 	return result, selected
 }
 
+// A form field for a param that the repo's settings declare.
+type ParamField struct {
+	ephconfig.Param
+	Value   string
+	Options []FormOption
+}
+
+// Generate the form fields for the repo's params,
+// filled in from the query or the defaults.
+func (s *Server) paramFields(r *http.Request, repoURL string) []ParamField {
+	result := []ParamField{}
+	for _, p := range s.allowlist().RepoSettings(repoURL).Params {
+		value := r.URL.Query().Get(p.Key())
+		if value == "" {
+			value = p.Default
+		}
+		f := ParamField{Param: p, Value: value}
+		for _, o := range p.Options() {
+			f.Options = append(f.Options, FormOption{Value: o, Name: o, Selected: o == value})
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// Read the values of the repo's params from the form into the spec.
+// Empty values are left out, so the defaults apply.
+func (s *Server) readParams(r *http.Request, spec *ephconfig.EnvSpec) {
+	for _, p := range s.allowlist().RepoSettings(spec.Repo).Params {
+		value := r.FormValue(p.Key())
+		if value == "" {
+			continue
+		}
+		if p.EffectiveKind() == ephconfig.ParamKindEnv {
+			if spec.Env == nil {
+				spec.Env = map[string]string{}
+			}
+			spec.Env[p.Name] = value
+		} else {
+			if spec.Args == nil {
+				spec.Args = map[string]string{}
+			}
+			spec.Args[p.Name] = value
+		}
+	}
+}
+
+// Generate the options for the size form, limited to the sizes
+// the user's group allows. Selects the size in the query,
+// or the first allowed size.
+func (s *Server) sizeOptions(r *http.Request, policy *ephconfig.GroupPolicy) []FormOption {
+	result := []FormOption{}
+	qSize := r.URL.Query().Get("size")
+	selected := false
+	for _, size := range s.allowlist().Sizes {
+		if policy != nil && len(policy.Sizes) > 0 && !contains(policy.Sizes, size.Name) {
+			continue
+		}
+
+		var details []string
+		if size.CPU != "" {
+			details = append(details, fmt.Sprintf("%s CPU", size.CPU))
+		}
+		if size.Memory != "" {
+			details = append(details, fmt.Sprintf("%s memory", size.Memory))
+		}
+		name := size.Name
+		if len(details) > 0 {
+			name = fmt.Sprintf("%s (%s)", size.Name, strings.Join(details, ", "))
+		}
+		result = append(result, FormOption{
+			Value:    size.Name,
+			Name:     name,
+			Selected: size.Name == qSize,
+		})
+		selected = selected || size.Name == qSize
+	}
+	if !selected && len(result) > 0 {
+		result[0].Selected = true
+	}
+	return result
+}
+
 // Create a github go client.
 // These use the users' auth token for rate-limiting, so
 // need to be created per-request.
@@ -225,29 +575,126 @@ func (s *Server) toGithubOwnerAndRepo(repoURL string) (string, string) {
 
 var defaultBranchName = "master"
 
+func hasBranch(branches []*github.Branch, name string) bool {
+	for _, b := range branches {
+		if b.Name != nil && *b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Repos rarely change their default branch, so we remember it for a while
+// instead of asking GitHub every time we render the form.
+const defaultBranchTTL = time.Hour
+
+// Users can type in any repo a glob allows, so we drop the cached
+// default branches once there are more than this many.
+const maxCachedDefaultBranches = 1024
+
+type defaultBranchCache struct {
+	mu      sync.Mutex
+	entries map[string]defaultBranchEntry
+}
+
+type defaultBranchEntry struct {
+	branch  string
+	expires time.Time
+}
+
+// The repo's default branch on GitHub, or "" if we can't fetch it.
+func (s *Server) githubDefaultBranch(ctx context.Context, client *github.Client, owner, repoName string) string {
+	key := owner + "/" + repoName
+	c := &s.defaultBranches
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.branch
+	}
+
+	repo, _, err := client.Repositories.Get(ctx, owner, repoName)
+	observeGitHubCall("get_repo", err)
+	if err != nil {
+		log.Printf("error: fetching repo %s/%s: %v", owner, repoName, err)
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCachedDefaultBranches {
+		c.entries = make(map[string]defaultBranchEntry)
+	}
+	c.entries[key] = defaultBranchEntry{branch: repo.GetDefaultBranch(), expires: time.Now().Add(defaultBranchTTL)}
+	return repo.GetDefaultBranch()
+}
+
 // Generate a list of valid branches for the given repo.
 // Returns the SHA hash of the selected branch.
+//
+// Selects the branch in the query, or else the default branch from the
+// repo settings, or else the repo's default branch on GitHub. The default
+// branch is always in the list, if it exists.
 func (s *Server) branchOptions(r *http.Request, client *github.Client, repoURL string) ([]FormOption, string) {
 	result := []FormOption{}
 	selected := ""
 
+	allowlist := s.allowlist()
+	settings := allowlist.RepoSettings(repoURL)
 	branchList := []*github.Branch{&github.Branch{Name: &defaultBranchName}}
+	if listed := allowlist.ListedBranches(repoURL); len(listed) > 0 {
+		branchList = nil
+		for i := range listed {
+			branchList = append(branchList, &github.Branch{Name: &listed[i]})
+		}
+	}
+	if settings.DefaultBranch != "" && !hasBranch(branchList, settings.DefaultBranch) {
+		branchList = append([]*github.Branch{&github.Branch{Name: &settings.DefaultBranch}}, branchList...)
+	}
+
+	defaultBranch := settings.DefaultBranch
 	owner, repoName := s.toGithubOwnerAndRepo(repoURL)
 	if repoName != "" {
+		if defaultBranch == "" {
+			defaultBranch = s.githubDefaultBranch(r.Context(), client, owner, repoName)
+		}
+
 		branches, _, err := client.Repositories.ListBranches(r.Context(), owner, repoName,
 			&github.BranchListOptions{ListOptions: github.ListOptions{PerPage: 100}})
+		observeGitHubCall("list_branches", err)
 		if err != nil {
 			log.Printf("error: fetching branches %s/%s: %v", owner, repoName, err)
 		} else {
 			branchList = branches
 		}
+
+		// We only list the first page of branches, which may not have the default.
+		if err == nil && defaultBranch != "" && !hasBranch(branchList, defaultBranch) {
+			b, _, err := client.Repositories.GetBranch(r.Context(), owner, repoName, defaultBranch, true)
+			observeGitHubCall("get_branch", err)
+			if err != nil {
+				log.Printf("error: fetching branch %s/%s %s: %v", owner, repoName, defaultBranch, err)
+			} else {
+				branchList = append([]*github.Branch{b}, branchList...)
+			}
+		}
 	}
 
 	qBranch := r.URL.Query().Get("branch")
+	if qBranch == "" {
+		qBranch = defaultBranch
+	}
+
+	var allowed []*github.Branch
 	for _, b := range branchList {
-		if b.Name == nil {
+		if b.Name == nil || (repoURL != "" && !allowlist.IsBranchAllowed(repoURL, *b.Name)) {
 			continue
 		}
+		allowed = append(allowed, b)
+	}
+	branchList = allowed
+	found := false
+	for _, b := range branchList {
 		name := *b.Name
 		s := qBranch == name
 		o := FormOption{
@@ -257,12 +704,15 @@ func (s *Server) branchOptions(r *http.Request, client *github.Client, repoURL s
 		}
 		result = append(result, o)
 
-		if s && b.Commit != nil && b.Commit.SHA != nil {
-			selected = *(b.Commit.SHA)
+		if s {
+			found = true
+			if b.Commit != nil && b.Commit.SHA != nil {
+				selected = *(b.Commit.SHA)
+			}
 		}
 	}
 
-	if selected == "" && len(branchList) > 0 {
+	if !found && len(branchList) > 0 {
 		result[0].Selected = true
 		b := branchList[0]
 		if b.Name != nil && *b.Name == result[0].Value && b.Commit != nil && b.Commit.SHA != nil {
@@ -274,18 +724,35 @@ func (s *Server) branchOptions(r *http.Request, client *github.Client, repoURL s
 }
 
 // Generate a list of valid paths with Tiltfiles for the given repo/branch.
+//
+// We can only list the files of GitHub repos. For other hosts,
+// we offer the Tiltfile at the root.
 func (s *Server) pathOptions(r *http.Request, client *github.Client, repoURL, sha string) []FormOption {
+	qPath := r.URL.Query().Get("path")
+	if qPath == "" {
+		qPath = s.allowlist().RepoSettings(repoURL).DefaultPath
+	}
+
 	owner, repoName := s.toGithubOwnerAndRepo(repoURL)
 	if repoName == "" {
-		return nil
+		if repoURL == "" {
+			return nil
+		}
+		if qPath == "" {
+			qPath = "Tiltfile"
+		}
+		return []FormOption{{Value: qPath, Name: qPath, Selected: true}}
 	}
 
 	if sha == "" {
 		return nil
 	}
 
-	qPath := r.URL.Query().Get("path")
+	if qPath == "" {
+		qPath = "Tiltfile"
+	}
 	tree, _, err := client.Git.GetTree(r.Context(), owner, repoName, sha, true /* recursive */)
+	observeGitHubCall("get_tree", err)
 	if err != nil {
 		log.Printf("error: fetching tree %s/%s: %v", owner, repoName, err)
 		return nil
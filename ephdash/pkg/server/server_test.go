@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v42/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+func TestFormDefaultsFromRepoSettings(t *testing.T) {
+	s := &Server{config: ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{
+			Base:     "https://gitea.internal/team",
+			Names:    []string{"app"},
+			Branches: []string{"main", "develop"},
+			Settings: ephconfig.RepoSettings{DefaultBranch: "develop", DefaultPath: "deploy/Tiltfile"},
+		}},
+	}, "preview.localhost")}
+	repo := "https://gitea.internal/team/app"
+
+	branches, _ := s.branchOptions(httptest.NewRequest("GET", "/", nil), nil, repo)
+	assert.Equal(t, []FormOption{
+		{Value: "main", Name: "main"},
+		{Value: "develop", Name: "develop", Selected: true},
+	}, branches)
+
+	paths := s.pathOptions(httptest.NewRequest("GET", "/", nil), nil, repo, "")
+	assert.Equal(t, []FormOption{{Value: "deploy/Tiltfile", Name: "deploy/Tiltfile", Selected: true}}, paths)
+
+	// What the user picked wins over the defaults.
+	branches, _ = s.branchOptions(httptest.NewRequest("GET", "/?branch=main", nil), nil, repo)
+	assert.True(t, branches[0].Selected)
+	assert.False(t, branches[1].Selected)
+}
+
+// A GitHub API for the repo acme/app, with trunk as the default branch.
+// Counts the calls to each path.
+func newFakeGitHub(t *testing.T, branches string) (*github.Client, map[string]int) {
+	calls := map[string]int{}
+	gh := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		switch r.URL.Path {
+		case "/repos/acme/app":
+			_, _ = fmt.Fprint(res, `{"default_branch": "trunk"}`)
+		case "/repos/acme/app/branches":
+			_, _ = fmt.Fprint(res, branches)
+		case "/repos/acme/app/branches/trunk", "/repos/acme/app/branches/develop":
+			name := strings.TrimPrefix(r.URL.Path, "/repos/acme/app/branches/")
+			_, _ = fmt.Fprintf(res, `{"name": %q, "commit": {"sha": "%s-sha"}}`, name, name)
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(gh.Close)
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(gh.URL + "/")
+	return client, calls
+}
+
+func TestDefaultBranchCached(t *testing.T) {
+	client, calls := newFakeGitHub(t, `[{"name": "main"}, {"name": "trunk"}]`)
+	s := &Server{config: ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{Base: "https://github.com/acme", Names: []string{"app"}}},
+	}, "preview.localhost")}
+	repo := "https://github.com/acme/app"
+
+	for i := 0; i < 2; i++ {
+		branches, _ := s.branchOptions(httptest.NewRequest("GET", "/", nil), client, repo)
+		assert.Equal(t, []FormOption{
+			{Value: "main", Name: "main"},
+			{Value: "trunk", Name: "trunk", Selected: true},
+		}, branches)
+	}
+	assert.Equal(t, 1, calls["/repos/acme/app"])
+}
+
+func TestDefaultBranchNotListed(t *testing.T) {
+	// The default branch isn't on the first page of branches.
+	client, calls := newFakeGitHub(t, `[{"name": "a-branch"}, {"name": "main"}]`)
+	s := &Server{config: ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{Base: "https://github.com/acme", Names: []string{"app"}}},
+	}, "preview.localhost")}
+	repo := "https://github.com/acme/app"
+
+	branches, sha := s.branchOptions(httptest.NewRequest("GET", "/", nil), client, repo)
+	assert.Equal(t, []FormOption{
+		{Value: "trunk", Name: "trunk", Selected: true},
+		{Value: "a-branch", Name: "a-branch"},
+		{Value: "main", Name: "main"},
+	}, branches)
+	assert.Equal(t, "trunk-sha", sha)
+
+	// Same for the default branch in the repo settings.
+	s.config = ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{
+			Base:     "https://github.com/acme",
+			Names:    []string{"app"},
+			Settings: ephconfig.RepoSettings{DefaultBranch: "develop"},
+		}},
+	}, "preview.localhost")
+	branches, sha = s.branchOptions(httptest.NewRequest("GET", "/", nil), client, repo)
+	assert.Equal(t, []FormOption{
+		{Value: "develop", Name: "develop", Selected: true},
+		{Value: "a-branch", Name: "a-branch"},
+		{Value: "main", Name: "main"},
+	}, branches)
+	assert.Equal(t, "develop-sha", sha)
+	assert.Equal(t, 1, calls["/repos/acme/app"])
+}
+
+func TestRenderIndex(t *testing.T) {
+	s := &Server{
+		envClient: newFakeEnvClient(t),
+		config:    ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost"),
+		csrf:      newCSRFProtection("", false),
+		tmpl:      template.Must(template.New("index.tmpl").Parse(`user: {{.user}}`)),
+	}
+	id := Identity{User: "alice"}
+
+	rec := httptest.NewRecorder()
+	s.renderIndex(rec, httptest.NewRequest("POST", "/create", nil), id, http.StatusBadRequest, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "user: alice", rec.Body.String())
+
+	// A template error is a server error, whatever the status would have been.
+	s.tmpl = template.Must(template.New("index.tmpl").Parse(`{{template "missing"}}`))
+	rec = httptest.NewRecorder()
+	s.renderIndex(rec, httptest.NewRequest("POST", "/create", nil), id, http.StatusBadRequest, nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Rendering HTML")
+}
+
+func TestReadParams(t *testing.T) {
+	s := &Server{config: ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{
+			Base:  "https://gitea.internal/team",
+			Names: []string{"app"},
+			Settings: ephconfig.RepoSettings{Params: []ephconfig.Param{
+				{Name: "profile", Enum: []string{"dev", "full"}, Default: "dev"},
+				{Name: "ticket"},
+				{Name: "DEBUG", Kind: ephconfig.ParamKindEnv, Type: ephconfig.ParamTypeBool},
+			}},
+		}},
+	}, "preview.localhost")}
+	repo := "https://gitea.internal/team/app"
+
+	fields := s.paramFields(httptest.NewRequest("GET", "/?arg.profile=full", nil), repo)
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, ephconfig.ParamKindArg, fields[1].EffectiveKind())
+		assert.Equal(t, "full", fields[0].Value)
+		assert.Equal(t, []FormOption{{Value: "dev", Name: "dev"}, {Value: "full", Name: "full", Selected: true}}, fields[0].Options)
+		assert.Nil(t, fields[1].Options)
+		assert.Len(t, fields[2].Options, 2)
+	}
+
+	r := httptest.NewRequest("POST", "/create", strings.NewReader("arg.ticket=ENG-1&arg.profile=&env.DEBUG=true&arg.host=evil"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	spec := ephconfig.EnvSpec{Repo: repo}
+	s.readParams(r, &spec)
+	assert.Equal(t, map[string]string{"ticket": "ENG-1"}, spec.Args)
+	assert.Equal(t, map[string]string{"DEBUG": "true"}, spec.Env)
+}
+
+func TestAPISetEnvFieldErrors(t *testing.T) {
+	s := &Server{
+		authSettings: AuthSettings{FakeUser: "alice"},
+		config:       ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost"),
+	}
+	rec := httptest.NewRecorder()
+	s.apiSetEnv(rec, httptest.NewRequest("POST", "/api/env", strings.NewReader(`{"repo": "https://github.com/acme/web"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, ephconfig.FieldErrors{
+		{Field: "branch", Reason: ephconfig.ReasonRequired, Message: "missing branch"},
+		{Field: "path", Reason: ephconfig.ReasonRequired, Message: "missing path"},
+	}, resp.FieldErrors)
+}
+
+func TestCheckAllowedFieldErrors(t *testing.T) {
+	s := &Server{config: ephconfig.StaticConfig(&ephconfig.Allowlist{
+		Repos: []ephconfig.RepoRule{{Base: "https://github.com/acme", Names: []string{"web", "api"}}},
+		Sizes: []ephconfig.SizeClass{{Name: "small"}, {Name: "large"}},
+		Groups: []ephconfig.GroupPolicy{
+			{Name: "eng", RepoNames: []string{"web"}, Sizes: []string{"small"}},
+		},
+	}, "preview.localhost")}
+	id := Identity{User: "alice", Groups: []string{"eng"}}
+
+	_, code, err := s.checkAllowed(id, ephconfig.EnvSpec{Repo: "https://github.com/acme/web", Branch: "m x", Path: "../Tiltfile"})
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, map[string]string{
+		"branch": "malformed branch name",
+		"path":   "no '..' references allowed in path",
+	}, ephconfig.AsFieldErrors(err).ByField())
+
+	_, _, err = s.checkAllowed(id, ephconfig.EnvSpec{Repo: "https://github.com/acme/api", Branch: "main", Path: "Tiltfile"})
+	errs := ephconfig.AsFieldErrors(err)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "repo", errs[0].Field)
+		assert.Equal(t, ephconfig.ReasonNotAllowed, errs[0].Reason)
+	}
+
+	_, _, err = s.checkAllowed(id, ephconfig.EnvSpec{Repo: "https://github.com/acme/web", Branch: "main", Path: "Tiltfile", Size: "large"})
+	errs = ephconfig.AsFieldErrors(err)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "size", errs[0].Field)
+		assert.Equal(t, ephconfig.ReasonNotAllowed, errs[0].Reason)
+	}
+}
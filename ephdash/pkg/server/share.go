@@ -0,0 +1,348 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/apitoken"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
+)
+
+// How long a share link stays valid.
+const shareTokenTTL = 24 * time.Hour
+
+// The contents of a signed share token.
+type shareClaims struct {
+	Env     string `json:"env"`
+	ShareID string `json:"sid"`
+	Expires int64  `json:"exp"`
+}
+
+// Share links set a cookie on all the gateway hosts, so that
+// the env's endpoints can load their own assets.
+func shareCookieName(envName string) string {
+	return fmt.Sprintf("eph_share_%s", envName)
+}
+
+func signShareToken(secret []byte, claims shareClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return fmt.Sprintf("%s.%s", encoded, shareSignature(secret, encoded)), nil
+}
+
+func shareSignature(secret []byte, encoded string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify the token signature and expiration.
+//
+// Callers must still check that the share ID matches the env.
+func verifyShareToken(secret []byte, token string, now time.Time) (shareClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return shareClaims{}, fmt.Errorf("malformed share token")
+	}
+
+	expected := shareSignature(secret, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return shareClaims{}, fmt.Errorf("invalid share token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return shareClaims{}, fmt.Errorf("malformed share token: %v", err)
+	}
+
+	var claims shareClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return shareClaims{}, fmt.Errorf("malformed share token: %v", err)
+	}
+
+	if now.Unix() >= claims.Expires {
+		return shareClaims{}, fmt.Errorf("share token expired")
+	}
+	return claims, nil
+}
+
+// Returns true if the token grants access to the given env.
+func (s *Server) isShareTokenValid(token string, e *env.Env) bool {
+	if len(s.authSettings.ShareSecret) == 0 || token == "" || e == nil {
+		return false
+	}
+	if e.Visibility() != ephconfig.VisibilityPublic || e.ShareID() == "" {
+		return false
+	}
+
+	claims, err := verifyShareToken([]byte(s.authSettings.ShareSecret), token, time.Now())
+	if err != nil {
+		return false
+	}
+	return claims.Env == e.ConfigMap.Name && claims.ShareID == e.ShareID()
+}
+
+// A link that grants access to a single endpoint.
+type ShareLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Mint a share token for the env, and links to each of its endpoints.
+func (s *Server) shareLinks(e *env.Env) (string, []ShareLink, error) {
+	if len(s.authSettings.ShareSecret) == 0 {
+		return "", nil, fmt.Errorf("share links are not enabled on this server")
+	}
+	if e == nil || e.Visibility() != ephconfig.VisibilityPublic || e.ShareID() == "" {
+		return "", nil, fmt.Errorf("env is not public")
+	}
+
+	token, err := signShareToken([]byte(s.authSettings.ShareSecret), shareClaims{
+		Env:     e.ConfigMap.Name,
+		ShareID: e.ShareID(),
+		Expires: time.Now().Add(shareTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	links := []ShareLink{}
+	seen := make(map[string]bool)
+	for _, endpoint := range e.Endpoints(s.gatewayTLS.Scheme(), s.gatewayHost()) {
+		if seen[endpoint.PortName] {
+			continue
+		}
+		seen[endpoint.PortName] = true
+
+		q := url.Values{}
+		q.Set("token", token)
+		q.Set("endpoint", endpoint.PortName)
+		links = append(links, ShareLink{
+			Name: endpoint.Name,
+			URL:  fmt.Sprintf("%s://%s/share?%s", s.gatewayTLS.Scheme(), s.gatewayHost(), q.Encode()),
+		})
+	}
+	return token, links, nil
+}
+
+var shareEndpointRe = regexp.MustCompile("^[a-z0-9-]+$")
+
+// Follows a share link.
+//
+// Sets a cookie with the share token for all gateway hosts,
+// then redirects to the shared endpoint.
+func (s *Server) share(res http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	endpoint := r.URL.Query().Get("endpoint")
+	if !shareEndpointRe.MatchString(endpoint) {
+		http.Error(res, "Malformed endpoint", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := verifyShareToken([]byte(s.authSettings.ShareSecret), token, time.Now())
+	if len(s.authSettings.ShareSecret) == 0 || err != nil {
+		http.Error(res, "This share link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	e, err := s.envClient.GetEnvConfig(claims.Env)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Fetching env: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !s.isShareTokenValid(token, e) {
+		http.Error(res, "This share link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     shareCookieName(claims.Env),
+		Value:    token,
+		Domain:   s.gatewayHost(),
+		Path:     "/",
+		Expires:  time.Unix(claims.Expires, 0),
+		Secure:   s.gatewayTLS.Enabled(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	host := ephconfig.EndpointHost(endpoint, claims.Env, s.gatewayHost())
+	http.Redirect(res, r, fmt.Sprintf("%s://%s/", s.gatewayTLS.Scheme(), host), http.StatusSeeOther)
+}
+
+// Checks whether a gateway request may reach its destination.
+//
+// The gateway Ingress uses this as its auth URL. We delegate sign-in
+// to the oauth2-proxy (or the OIDC login), then apply the env's visibility on top.
+func (s *Server) gatewayAuth(res http.ResponseWriter, r *http.Request) {
+	originalURL, err := url.Parse(r.Header.Get("X-Original-URL"))
+	if err != nil || originalURL.Host == "" {
+		http.Error(res, "Missing X-Original-URL", http.StatusBadRequest)
+		return
+	}
+
+	host := originalURL.Hostname()
+	if host == s.gatewayHost() && originalURL.Path == "/share" {
+		// Anyone may follow a share link. The share handler checks the token.
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+	if host == s.gatewayHost() && isEnvAPIPath(originalURL.Path) && strings.HasPrefix(bearerToken(r), apitoken.Prefix) {
+		// CI jobs call the API with API tokens, which the API checks itself.
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var e *env.Env
+	_, envName, isEnvHost := ephconfig.ParseEndpointHost(host, s.gatewayHost())
+	if isEnvHost {
+		e, err = s.envClient.GetEnvConfig(envName)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Fetching env: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		cookie, err := r.Cookie(shareCookieName(envName))
+		if err == nil && s.isShareTokenValid(cookie.Value, e) {
+			res.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	user, headers, code, err := s.proxyAuth(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Checking auth: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if code < 200 || code >= 300 {
+		res.WriteHeader(code)
+		return
+	}
+
+	if e != nil && e.Visibility() == ephconfig.VisibilityPrivate && user != envName {
+		log.Printf("gateway auth: user %s denied access to private env %s", user, envName)
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	for k, vs := range headers {
+		for _, v := range vs {
+			res.Header().Add(k, v)
+		}
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// Ask the oauth2-proxy whether the request is signed in,
+// or check the OIDC session cookie ourselves.
+//
+// Returns the user, the auth headers to pass upstream, and the status code from the proxy.
+func (s *Server) proxyAuth(r *http.Request) (string, http.Header, int, error) {
+	if s.authSettings.FakeUser != "" {
+		return s.authSettings.FakeUser, http.Header{}, http.StatusOK, nil
+	}
+
+	if s.oidc != nil {
+		session, err := s.oidc.loadGatewaySession(r)
+		if err != nil {
+			return "", http.Header{}, http.StatusUnauthorized, nil
+		}
+		return session.User, s.oidc.headers(session), http.StatusOK, nil
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", fmt.Sprintf("%s/oauth2/auth", s.authSettings.Proxy), nil)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	for _, h := range []string{"Cookie", "Authorization"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	headers := http.Header{}
+	for k, vs := range resp.Header {
+		if strings.HasPrefix(k, "X-Auth-Request-") || k == "Authorization" {
+			headers[k] = vs
+		}
+	}
+	return resp.Header.Get("X-Auth-Request-User"), headers, resp.StatusCode, nil
+}
+
+// Changes who can reach the user's env.
+func (s *Server) setVisibility(res http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing form data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	v, err := ephconfig.ParseVisibility(r.FormValue("visibility"))
+	if err != nil || r.FormValue("visibility") == "" {
+		http.Error(res, fmt.Sprintf("Invalid visibility: %q", r.FormValue("visibility")), http.StatusBadRequest)
+		return
+	}
+
+	entry := audit.Entry{User: user, Action: audit.ActionVisibility, Detail: string(v)}
+	if v == ephconfig.VisibilityPublic && len(s.authSettings.ShareSecret) == 0 {
+		s.recordAudit(r, entry, http.StatusForbidden, fmt.Errorf("share links not enabled"))
+		http.Error(res, "Share links are not enabled on this server", http.StatusForbidden)
+		return
+	}
+
+	err = s.envClient.SetVisibility(r.Context(), user, v)
+	s.recordAudit(r, entry, http.StatusInternalServerError, err)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Setting visibility: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, r, "/", http.StatusSeeOther)
+}
+
+// Revokes all share links for the user's env.
+func (s *Server) revokeShares(res http.ResponseWriter, r *http.Request) {
+	user, err := s.username(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.envClient.RotateShareID(r.Context(), user)
+	s.recordAudit(r, audit.Entry{User: user, Action: audit.ActionRevoke}, http.StatusInternalServerError, err)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Revoking share links: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/env"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testShareSecret = "share-secret"
+
+func TestVerifyShareToken(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	valid, err := signShareToken([]byte(testShareSecret), shareClaims{Env: "alice", ShareID: "s1", Expires: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	expired, err := signShareToken([]byte(testShareSecret), shareClaims{Env: "alice", ShareID: "s1", Expires: now.Unix()})
+	require.NoError(t, err)
+	otherSecret, err := signShareToken([]byte("other-secret"), shareClaims{Env: "alice", ShareID: "s1", Expires: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	// Swap in a payload for another env, but keep alice's signature.
+	parts := strings.Split(valid, ".")
+	bob, err := signShareToken([]byte(testShareSecret), shareClaims{Env: "bob", ShareID: "s1", Expires: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	tampered := strings.Split(bob, ".")[0] + "." + parts[1]
+
+	type tc struct {
+		token string
+		err   string
+	}
+	cases := []tc{
+		{valid, ""},
+		{expired, "share token expired"},
+		{otherSecret, "invalid share token signature"},
+		{tampered, "invalid share token signature"},
+		{parts[0] + "." + parts[1] + "x", "invalid share token signature"},
+		{parts[0], "malformed share token"},
+		{"", "malformed share token"},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestVerifyShareToken%d", i), func(t *testing.T) {
+			claims, err := verifyShareToken([]byte(testShareSecret), c.token, now)
+			if c.err == "" {
+				require.NoError(t, err)
+				assert.Equal(t, shareClaims{Env: "alice", ShareID: "s1", Expires: now.Add(time.Hour).Unix()}, claims)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+}
+
+func TestIsShareTokenValid(t *testing.T) {
+	s := &Server{authSettings: AuthSettings{ShareSecret: testShareSecret}}
+	token := mintShareToken(t, "alice", "s1", time.Hour)
+
+	type tc struct {
+		env   *env.Env
+		token string
+		valid bool
+	}
+	cases := []tc{
+		{shareEnv("alice", ephconfig.VisibilityPublic, "s1"), token, true},
+		{shareEnv("alice", ephconfig.VisibilityPublic, "s1"), mintShareToken(t, "alice", "s1", -time.Minute), false},
+
+		// Revoking share links rotates the share ID.
+		{shareEnv("alice", ephconfig.VisibilityPublic, "s2"), token, false},
+
+		// Making the env non-public revokes share links too.
+		{shareEnv("alice", ephconfig.VisibilityTeam, "s1"), token, false},
+		{shareEnv("alice", ephconfig.VisibilityPrivate, "s1"), token, false},
+		{shareEnv("alice", ephconfig.VisibilityPublic, ""), token, false},
+
+		// Tokens only grant access to the env they were minted for.
+		{shareEnv("bob", ephconfig.VisibilityPublic, "s1"), token, false},
+		{shareEnv("alice", ephconfig.VisibilityPublic, "s1"), "", false},
+		{nil, token, false},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestIsShareTokenValid%d", i), func(t *testing.T) {
+			assert.Equal(t, c.valid, s.isShareTokenValid(c.token, c.env))
+		})
+	}
+
+	s.authSettings.ShareSecret = ""
+	assert.False(t, s.isShareTokenValid(token, shareEnv("alice", ephconfig.VisibilityPublic, "s1")))
+}
+
+func TestShare(t *testing.T) {
+	f := newShareFixture(t, shareEnv("alice", ephconfig.VisibilityPublic, "s1").ConfigMap)
+
+	token := mintShareToken(t, "alice", "s1", time.Hour)
+	rec := f.share(token, "web")
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "http://web---alice.preview.localhost/", rec.Header().Get("Location"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "eph_share_alice", cookies[0].Name)
+	assert.Equal(t, token, cookies[0].Value)
+	assert.Equal(t, "preview.localhost", cookies[0].Domain)
+	assert.True(t, cookies[0].HttpOnly)
+
+	assert.Equal(t, http.StatusForbidden, f.share(mintShareToken(t, "alice", "s1", -time.Minute), "web").Code)
+	assert.Equal(t, http.StatusForbidden, f.share(mintShareToken(t, "alice", "s0", time.Hour), "web").Code)
+	assert.Equal(t, http.StatusForbidden, f.share(token+"x", "web").Code)
+	assert.Equal(t, http.StatusBadRequest, f.share(token, "web.evil.com").Code)
+}
+
+func TestGatewayAuth(t *testing.T) {
+	f := newShareFixture(t,
+		shareEnv("alice", ephconfig.VisibilityPrivate, "s1").ConfigMap,
+		shareEnv("bob", ephconfig.VisibilityTeam, "s1").ConfigMap,
+		shareEnv("carol", ephconfig.VisibilityPublic, "s1").ConfigMap)
+
+	type tc struct {
+		host     string
+		user     string
+		shareEnv string
+		shareID  string
+		code     int
+	}
+	cases := []tc{
+		// Private envs are only for the owner.
+		{"web---alice.preview.localhost", "alice", "", "", http.StatusOK},
+		{"web---alice.preview.localhost", "bob", "", "", http.StatusForbidden},
+		{"web---alice.preview.localhost", "", "", "", http.StatusUnauthorized},
+		{"web---alice.preview.localhost", "", "alice", "s1", http.StatusUnauthorized},
+
+		// Team envs are for any signed-in user.
+		{"web---bob.preview.localhost", "alice", "", "", http.StatusOK},
+		{"web---bob.preview.localhost", "", "", "", http.StatusUnauthorized},
+		{"web---bob.preview.localhost", "", "bob", "s1", http.StatusUnauthorized},
+
+		// Public envs are also for anyone with a share link.
+		{"web---carol.preview.localhost", "alice", "", "", http.StatusOK},
+		{"web---carol.preview.localhost", "", "carol", "s1", http.StatusOK},
+		{"web---carol.preview.localhost", "", "carol", "s0", http.StatusUnauthorized},
+		{"web---carol.preview.localhost", "", "", "", http.StatusUnauthorized},
+
+		// A share link for one env doesn't open another.
+		{"web---bob.preview.localhost", "", "carol", "s1", http.StatusUnauthorized},
+
+		// The dashboard itself.
+		{"preview.localhost", "alice", "", "", http.StatusOK},
+		{"preview.localhost", "", "", "", http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("TestGatewayAuth%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("X-Original-URL", fmt.Sprintf("http://%s/index.html", c.host))
+			if c.user != "" {
+				req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: c.user})
+			}
+			if c.shareEnv != "" {
+				req.AddCookie(&http.Cookie{
+					Name:  shareCookieName(c.shareEnv),
+					Value: mintShareToken(t, c.shareEnv, c.shareID, time.Hour),
+				})
+			}
+			rec := httptest.NewRecorder()
+			f.s.gatewayAuth(rec, req)
+			assert.Equal(t, c.code, rec.Code)
+		})
+	}
+}
+
+func TestGatewayAuthShareLinkIsOpen(t *testing.T) {
+	f := newShareFixture(t)
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-URL", "http://preview.localhost/share?token=x")
+	rec := httptest.NewRecorder()
+	f.s.gatewayAuth(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest("GET", "/auth", nil)
+	rec = httptest.NewRecorder()
+	f.s.gatewayAuth(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+type shareFixture struct {
+	t *testing.T
+	s *Server
+}
+
+// Serves envs from a fake clientset, with an oauth2-proxy that
+// signs in the user named by the _oauth2_proxy cookie.
+func newShareFixture(t *testing.T, cms ...*v1.ConfigMap) *shareFixture {
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("_oauth2_proxy")
+		if err != nil {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		res.Header().Set("X-Auth-Request-User", cookie.Value)
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(proxy.Close)
+
+	s := &Server{
+		envClient:    newFakeEnvClient(t, cms...),
+		authSettings: AuthSettings{Proxy: proxy.URL, ShareSecret: testShareSecret},
+		config:       ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost"),
+	}
+	return &shareFixture{t: t, s: s}
+}
+
+// An env client for a fake clientset with the given ConfigMaps.
+//
+// Waits for the informers to see the env ConfigMaps.
+func newFakeEnvClient(t *testing.T, cms ...*v1.ConfigMap) *env.Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	clientset := fake.NewSimpleClientset()
+	for _, cm := range cms {
+		_, err := clientset.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	envClient := env.NewClient(ctx, clientset, "default")
+	for _, cm := range cms {
+		if cm.Labels[ephconfig.LabelNameKey] != ephconfig.LabelNameValueEphrunner {
+			continue
+		}
+		name := cm.Name
+		require.Eventually(t, func() bool {
+			e, err := envClient.GetEnvConfig(name)
+			return err == nil && e != nil
+		}, time.Second, 10*time.Millisecond)
+	}
+	return envClient
+}
+
+func (f *shareFixture) share(token, endpoint string) *httptest.ResponseRecorder {
+	q := url.Values{}
+	q.Set("token", token)
+	q.Set("endpoint", endpoint)
+	req := httptest.NewRequest("GET", "/share?"+q.Encode(), nil)
+	rec := httptest.NewRecorder()
+	f.s.share(rec, req)
+	return rec
+}
+
+func mintShareToken(t *testing.T, envName, shareID string, ttl time.Duration) string {
+	token, err := signShareToken([]byte(testShareSecret), shareClaims{
+		Env:     envName,
+		ShareID: shareID,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	require.NoError(t, err)
+	return token
+}
+
+func shareEnv(name string, v ephconfig.Visibility, shareID string) *env.Env {
+	return &env.Env{ConfigMap: &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+				ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+			},
+			Annotations: map[string]string{
+				ephconfig.AnnotationVisibility: string(v),
+				ephconfig.AnnotationShareID:    shareID,
+			},
+		},
+	}}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/apitoken"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+)
+
+// How long new tokens live, if the user doesn't say.
+const defaultTokenDays = 30
+
+// Options for how long new tokens live, in days.
+var tokenDayOptions = []int{1, 7, 30, 90}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+func isEnvAPIPath(path string) bool {
+	return path == "/api/env" || strings.HasPrefix(path, "/api/env/")
+}
+
+// Signs in requests with a personal API token in the Authorization header.
+//
+// Tokens only work with the user's own env API. They can't reach the admin
+// API, or mint more tokens. Other bearer tokens (like ID tokens from
+// the proxy) pass through to the other auth middleware.
+func (s *Server) apiTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		value := bearerToken(r)
+		if !strings.HasPrefix(value, apitoken.Prefix) {
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		if !isEnvAPIPath(r.URL.Path) {
+			http.Error(res, "API tokens may only be used with /api/env", http.StatusForbidden)
+			return
+		}
+
+		token, err := s.tokens.Lookup(r.Context(), value)
+		if err != nil {
+			if errors.Is(err, apitoken.ErrInvalid) {
+				log.Printf("auth: rejected API token from %s: %v", audit.SourceIP(r), err)
+				http.Error(res, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+			http.Error(res, fmt.Sprintf("Checking API token: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		scope := apitoken.ScopeRead
+		if !isSafeMethod(r.Method) {
+			scope = apitoken.ScopeWrite
+		}
+		if !token.HasScope(scope) {
+			http.Error(res, fmt.Sprintf("API token %s lacks scope %s", token.ID, scope), http.StatusForbidden)
+			return
+		}
+
+		id := Identity{User: token.User, Email: token.Email, Groups: token.Groups, TokenID: token.ID}
+		ctx := context.WithValue(r.Context(), identityKey{}, id)
+		next.ServeHTTP(res, r.WithContext(ctx))
+	})
+}
+
+// Shows the user's API tokens, with a form to mint more.
+func (s *Server) tokensPage(res http.ResponseWriter, r *http.Request) {
+	s.renderTokens(res, r, "")
+}
+
+// Renders the tokens page, with a token we've just minted, if any.
+func (s *Server) renderTokens(res http.ResponseWriter, r *http.Request, newToken string) {
+	id, err := s.identity(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.tokens.List(r.Context(), id.User)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Listing API tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if newToken != "" {
+		res.Header().Set("Cache-Control", "no-store")
+	}
+	err = s.tmpl.ExecuteTemplate(res, "tokens.tmpl", map[string]interface{}{
+		"user":          id.User,
+		"gatewayHost":   s.gatewayHost(),
+		"gatewayScheme": s.gatewayTLS.Scheme(),
+		"tokens":        tokens,
+		"newToken":      newToken,
+		"scopes":        apitoken.Scopes,
+		"dayOptions":    tokenDayOptions,
+		"defaultDays":   defaultTokenDays,
+		"csrfToken":     s.csrfToken(res, r),
+	})
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Rendering HTML: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Mints a token, and shows it to the user once.
+func (s *Server) createToken(res http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Parsing form data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.identity(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil {
+		days = defaultTokenDays
+	}
+	var scopes []apitoken.Scope
+	for _, scope := range r.Form["scope"] {
+		scopes = append(scopes, apitoken.Scope(scope))
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	value, token, err := s.tokens.Create(r.Context(), apitoken.Token{
+		Name:   name,
+		User:   id.User,
+		Email:  id.Email,
+		Groups: id.Groups,
+		Scopes: scopes,
+	}, time.Duration(days)*24*time.Hour)
+	entry := audit.Entry{User: id.User, Action: audit.ActionCreateToken, Detail: name}
+	if err == nil {
+		entry.Detail = fmt.Sprintf("%s %s", token.ID, name)
+	}
+	s.recordAudit(r, entry, http.StatusBadRequest, err)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Creating API token: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.renderTokens(res, r, value)
+}
+
+// Revokes one of the user's tokens.
+func (s *Server) revokeToken(res http.ResponseWriter, r *http.Request) {
+	id, err := s.identity(r)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Reading username: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	tokenID := r.FormValue("id")
+	err = s.tokens.Revoke(r.Context(), id.User, tokenID)
+	s.recordAudit(r, audit.Entry{User: id.User, Action: audit.ActionRevokeToken, Detail: tokenID}, http.StatusInternalServerError, err)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, apitoken.ErrInvalid) {
+			code = http.StatusNotFound
+		}
+		http.Error(res, fmt.Sprintf("Revoking API token: %v", err), code)
+		return
+	}
+
+	http.Redirect(res, r, "/tokens", http.StatusSeeOther)
+}
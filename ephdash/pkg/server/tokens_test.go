@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/apitoken"
+	"github.com/tilt-dev/ephemerator/ephdash/pkg/audit"
+	webtemplate "github.com/tilt-dev/ephemerator/ephdash/web/template"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTokensFixture(t *testing.T) (*Server, http.Handler) {
+	tmpl, err := template.ParseFS(webtemplate.Content, "*.tmpl")
+	require.NoError(t, err)
+	s := &Server{
+		authSettings: AuthSettings{Proxy: "http://oauth2-proxy", ProxySecret: "shh"},
+		tokens:       apitoken.NewStore(fake.NewSimpleClientset(), "ephemerator"),
+		auditLog:     audit.NewLogger(&strings.Builder{}, audit.DefaultCapacity),
+		csrf:         newCSRFProtection("shh", false),
+		config:       ephconfig.StaticConfig(&ephconfig.Allowlist{}, "preview.localhost"),
+		tmpl:         tmpl,
+	}
+	handler := s.apiTokenMiddleware(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		id, err := s.identity(r)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		_, _ = res.Write([]byte(id.User + " " + strings.Join(id.Groups, ",") + " " + id.TokenID))
+	}))
+	return s, handler
+}
+
+func mintToken(t *testing.T, s *Server, scopes ...apitoken.Scope) (string, apitoken.Token) {
+	value, token, err := s.tokens.Create(context.Background(), apitoken.Token{
+		Name:   "ci",
+		User:   "alice",
+		Groups: []string{"eng"},
+		Scopes: scopes,
+	}, time.Hour)
+	require.NoError(t, err)
+	return value, token
+}
+
+func serveToken(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPITokenSignsIn(t *testing.T) {
+	s, h := newTokensFixture(t)
+	value, token := mintToken(t, s, apitoken.ScopeRead, apitoken.ScopeWrite)
+
+	rec := serveToken(h, "POST", "/api/env", value)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "alice eng "+token.ID, rec.Body.String())
+
+	// Tokens can't reach the admin API or anything else.
+	rec = serveToken(h, "GET", "/api/admin/envs", value)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serveToken(h, "POST", "/tokens", value)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = serveToken(h, "GET", "/api/env", apitoken.Prefix+"guess")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	require.NoError(t, s.tokens.Revoke(context.Background(), "alice", token.ID))
+	rec = serveToken(h, "GET", "/api/env", value)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	s, h := newTokensFixture(t)
+	value, _ := mintToken(t, s, apitoken.ScopeRead)
+
+	rec := serveToken(h, "GET", "/api/env", value)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serveToken(h, "DELETE", "/api/env", value)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "lacks scope env:write")
+}
+
+func TestCreateTokenShowsItOnce(t *testing.T) {
+	s, _ := newTokensFixture(t)
+
+	form := url.Values{"name": {"ci"}, "scope": {"env:read"}, "days": {"7"}}
+	req := httptest.NewRequest("POST", "/tokens", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, Identity{User: "alice"}))
+	rec := httptest.NewRecorder()
+	s.createToken(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), apitoken.Prefix)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	tokens, err := s.tokens.List(context.Background(), "alice")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, []apitoken.Scope{apitoken.ScopeRead}, tokens[0].Scopes)
+
+	entries := s.auditLog.Query(audit.Query{Action: audit.ActionCreateToken})
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.OutcomeSuccess, entries[0].Outcome)
+
+	// The list page doesn't show the token again.
+	req = httptest.NewRequest("GET", "/tokens", nil)
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, Identity{User: "alice"}))
+	rec = httptest.NewRecorder()
+	s.tokensPage(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), apitoken.Prefix)
+	assert.Contains(t, rec.Body.String(), tokens[0].ID)
+}
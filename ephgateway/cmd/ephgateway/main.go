@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	"github.com/tilt-dev/ephemerator/ephconfig/live"
+	"github.com/tilt-dev/ephemerator/ephgateway/pkg/proxy"
+)
+
+func main() {
+	// Config reloads are logged through the controller-runtime logger.
+	ctrllog.SetLogger(zap.New())
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("kubernetes connection setup failed: %v", err)
+	}
+
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("kubernetes connection setup failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	namespace := os.Getenv("NAMESPACE")
+
+	// Start with the config from env vars, then follow edits to the ConfigMap.
+	initialConfig, err := ephconfig.ReadConfig()
+	if err != nil {
+		log.Fatalf("server setup failed: %v", err)
+	}
+	liveConfig := ephconfig.NewLiveConfig(initialConfig)
+	go live.Watch(ctx, liveConfig, clientset, namespace)
+	log.Printf("loaded config %s", liveConfig.Version())
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, time.Hour,
+		informers.WithNamespace(namespace))
+	svcInformer := factory.Core().V1().Services()
+	go svcInformer.Informer().Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), svcInformer.Informer().HasSynced) {
+		log.Fatal("server setup failed: service cache never synced")
+	}
+
+	activity := proxy.NewActivityTracker(clientset, namespace)
+	go activity.Run(ctx, time.Minute)
+
+	handler := proxy.NewProxy(liveConfig, namespace, svcInformer.Lister(), activity)
+
+	fmt.Printf("Starting gateway at port 8080\n")
+	if err := http.ListenAndServe(":8080", handler); err != nil {
+		log.Fatal(err)
+	}
+}
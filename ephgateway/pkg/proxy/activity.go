@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Tracks the last time each env served a request.
+//
+// Requests are recorded in memory, and periodically written
+// to the env ConfigMap, so that we don't write on every request.
+type ActivityTracker struct {
+	clientset kubernetes.Interface
+	namespace string
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+func NewActivityTracker(clientset kubernetes.Interface, namespace string) *ActivityTracker {
+	return &ActivityTracker{
+		clientset: clientset,
+		namespace: namespace,
+		pending:   make(map[string]time.Time),
+	}
+}
+
+// Record a request for the env.
+func (t *ActivityTracker) Touch(envName string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.After(t.pending[envName]) {
+		t.pending[envName] = at
+	}
+}
+
+// Write the recorded activity every interval, until the context is done.
+func (t *ActivityTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.flush(ctx)
+		}
+	}
+}
+
+func (t *ActivityTracker) flush(ctx context.Context) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]time.Time)
+	t.mu.Unlock()
+
+	for envName, at := range pending {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{
+					ephconfig.AnnotationLastActivity: at.UTC().Format(time.RFC3339),
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("recording activity for env %s: %v", envName, err)
+			continue
+		}
+
+		_, err = t.clientset.CoreV1().ConfigMaps(t.namespace).Patch(ctx, envName,
+			types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("recording activity for env %s: %v", envName, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+// Proxies requests for env endpoint hosts directly to the env Services.
+//
+// An alternative to routing with Ingress rules. Each endpoint host
+// is resolved against the Service ports on every request, so new envs
+// and ports are reachable as soon as the Service informer sees them.
+//
+// Hosts are matched with the same scheme that ephctrl uses for Ingress rules:
+// both the port name and the port number forms are served. The gateway host
+// comes from the live config, so an edit to it applies without a restart.
+type Proxy struct {
+	config    *ephconfig.LiveConfig
+	namespace string
+	svcs      listersv1.ServiceLister
+	activity  *ActivityTracker
+
+	mu      sync.Mutex
+	proxies map[proxyKey]*httputil.ReverseProxy
+}
+
+type proxyKey struct {
+	envName string
+	target  string
+}
+
+// Envs come and go, so we drop the cached proxies
+// once there are more than this many.
+const maxCachedProxies = 1024
+
+func NewProxy(config *ephconfig.LiveConfig, namespace string, svcs listersv1.ServiceLister, activity *ActivityTracker) *Proxy {
+	return &Proxy{
+		config:    config,
+		namespace: namespace,
+		svcs:      svcs,
+		activity:  activity,
+		proxies:   make(map[proxyKey]*httputil.ReverseProxy),
+	}
+}
+
+func (p *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: res}
+	defer func() {
+		log.Printf("%s %s %s%s %d %s",
+			req.RemoteAddr, req.Method, req.Host, req.URL.RequestURI(), rec.Status(), time.Since(start))
+	}()
+
+	envName, target, err := p.route(req.Host)
+	if err != nil {
+		http.Error(rec, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if p.activity != nil {
+		p.activity.Touch(envName, start)
+	}
+
+	rp := p.reverseProxy(envName, target)
+	rp.ServeHTTP(rec, req)
+}
+
+// Returns the reverse proxy for a backend, creating it if needed.
+func (p *Proxy) reverseProxy(envName string, target *url.URL) *httputil.ReverseProxy {
+	key := proxyKey{envName: envName, target: target.String()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rp, ok := p.proxies[key]
+	if ok {
+		return rp
+	}
+
+	if len(p.proxies) >= maxCachedProxies {
+		p.proxies = make(map[proxyKey]*httputil.ReverseProxy)
+	}
+
+	rp = &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = target.Scheme
+			out.URL.Host = target.Host
+			if _, ok := out.Header["User-Agent"]; !ok {
+				// Don't let the proxy add a default User-Agent.
+				out.Header.Set("User-Agent", "")
+			}
+		},
+
+		// Flush immediately, so that server-sent events stream through.
+		FlushInterval: -1,
+
+		Transport: backendTransport,
+
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("proxying to env %s: %v", envName, err)
+			http.Error(res, fmt.Sprintf("Env %s is not responding", envName), http.StatusBadGateway)
+		},
+	}
+	p.proxies[key] = rp
+	return rp
+}
+
+// Env servers with https endpoints almost always use self-signed certificates,
+// and the traffic never leaves the cluster, so we don't verify them.
+var backendTransport = func() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint:gosec
+	return t
+}()
+
+// Find the env and the backend URL for a request host.
+func (p *Proxy) route(hostport string) (string, *url.URL, error) {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+
+	gatewayHost := p.config.GatewayHost()
+	_, envName, ok := ephconfig.ParseEndpointHost(host, gatewayHost)
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown host: %s", host)
+	}
+
+	svc, err := p.svcs.Services(p.namespace).Get(envName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil, fmt.Errorf("No env found: %s", envName)
+		}
+		return "", nil, err
+	}
+
+	if svc.Labels[ephconfig.LabelAppKey] != ephconfig.LabelAppValueEphemerator ||
+		svc.Labels[ephconfig.LabelNameKey] != ephconfig.LabelNameValueEphrunner {
+		return "", nil, fmt.Errorf("No env found: %s", envName)
+	}
+
+	for _, port := range svc.Spec.Ports {
+		if !ephconfig.IsHTTPPort(string(port.Protocol), port.AppProtocol) {
+			continue
+		}
+		for _, h := range ephconfig.PortHosts(port.Name, port.Port, svc.Name, gatewayHost) {
+			if h == host {
+				scheme := "http"
+				if port.AppProtocol != nil && *port.AppProtocol == "https" {
+					scheme = "https"
+				}
+				return envName, &url.URL{Scheme: scheme, Host: serviceHost(svc, port.Port)}, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("No endpoint found: %s", host)
+}
+
+// The address of a service port inside the cluster.
+func serviceHost(svc *v1.Service, port int32) string {
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return net.JoinHostPort(svc.Spec.ClusterIP, fmt.Sprintf("%d", port))
+	}
+	return fmt.Sprintf("%s.%s.svc.cluster.local:%d", svc.Name, svc.Namespace, port)
+}
+
+// Records the response status for the access log.
+//
+// Passes through flushes and hijacks, so that server-sent events
+// and websockets work through the proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
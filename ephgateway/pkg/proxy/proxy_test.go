@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newService(name string, clusterIP string, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				ephconfig.LabelAppKey:  ephconfig.LabelAppValueEphemerator,
+				ephconfig.LabelNameKey: ephconfig.LabelNameValueEphrunner,
+			},
+		},
+		Spec: v1.ServiceSpec{ClusterIP: clusterIP, Ports: ports},
+	}
+}
+
+func newProxy(t *testing.T, svcs ...*v1.Service) *Proxy {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, svc := range svcs {
+		require.NoError(t, indexer.Add(svc))
+	}
+	return NewProxy(ephconfig.StaticConfig(nil, "preview.localhost"), "default", listersv1.NewServiceLister(indexer), nil)
+}
+
+func TestRoute(t *testing.T) {
+	p := newProxy(t, newService("nick", "10.0.0.1",
+		v1.ServicePort{Name: "frontend", Port: 8000},
+		v1.ServicePort{Name: "8001", Port: 8001}))
+
+	envName, target, err := p.route("frontend---nick.preview.localhost")
+	require.NoError(t, err)
+	assert.Equal(t, "nick", envName)
+	assert.Equal(t, "http://10.0.0.1:8000", target.String())
+
+	_, target, err = p.route("8000---nick.preview.localhost:443")
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.1:8000", target.String())
+
+	_, target, err = p.route("8001---nick.preview.localhost")
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.1:8001", target.String())
+}
+
+func TestRouteFollowsGatewayHost(t *testing.T) {
+	p := newProxy(t, newService("nick", "10.0.0.1", v1.ServicePort{Name: "frontend", Port: 8000}))
+	err := p.config.Apply(map[string]string{
+		"allowlist":   "repoBase: https://github.com/tilt-dev\nrepoNames: [tilt-avatars]\n",
+		"gatewayHost": "preview.tilt.build",
+	})
+	require.NoError(t, err)
+
+	_, target, err := p.route("frontend---nick.preview.tilt.build")
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.1:8000", target.String())
+
+	_, _, err = p.route("frontend---nick.preview.localhost")
+	assert.Error(t, err)
+}
+
+func TestRouteHTTPS(t *testing.T) {
+	appProtocol := "https"
+	p := newProxy(t, newService("nick", "10.0.0.1",
+		v1.ServicePort{Name: "admin", Port: 8443, AppProtocol: &appProtocol}))
+
+	_, target, err := p.route("admin---nick.preview.localhost")
+	require.NoError(t, err)
+	assert.Equal(t, "https://10.0.0.1:8443", target.String())
+}
+
+func TestRouteNotFound(t *testing.T) {
+	unlabeled := newService("other", "10.0.0.2", v1.ServicePort{Name: "frontend", Port: 8000})
+	unlabeled.Labels = nil
+	p := newProxy(t, newService("nick", "10.0.0.1", v1.ServicePort{Name: "frontend", Port: 8000}), unlabeled)
+
+	for _, host := range []string{
+		"preview.localhost",
+		"frontend---nick.example.com",
+		"backend---nick.preview.localhost",
+		"frontend---alice.preview.localhost",
+		"frontend---other.preview.localhost",
+	} {
+		_, _, err := p.route(host)
+		assert.Error(t, err, host)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(res, "hello from "+req.URL.Path)
+	}))
+	defer backend.Close()
+
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	p := newProxy(t, newService("nick", u.Hostname(), v1.ServicePort{Name: "web", Port: int32(port)}))
+	p.activity = NewActivityTracker(nil, "default")
+
+	req := httptest.NewRequest("GET", "http://web---nick.preview.localhost/index.html", nil)
+	res := httptest.NewRecorder()
+	p.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "hello from /index.html", res.Body.String())
+	assert.Contains(t, p.activity.pending, "nick")
+
+	req = httptest.NewRequest("GET", "http://api---nick.preview.localhost/", nil)
+	res = httptest.NewRecorder()
+	p.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+// Serves the backend through the proxy, as the web endpoint of env nick.
+func newProxyServer(t *testing.T, backend http.Handler) (*Proxy, *httptest.Server) {
+	b := httptest.NewServer(backend)
+	t.Cleanup(b.Close)
+
+	u, err := url.Parse(b.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	p := newProxy(t, newService("nick", u.Hostname(), v1.ServicePort{Name: "web", Port: int32(port)}))
+	s := httptest.NewServer(p)
+	t.Cleanup(s.Close)
+	return p, s
+}
+
+func TestReverseProxyCached(t *testing.T) {
+	p, s := newProxyServer(t, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", s.URL, nil)
+		require.NoError(t, err)
+		req.Host = "web---nick.preview.localhost"
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Len(t, p.proxies, 1)
+}
+
+func TestServeWebsocket(t *testing.T) {
+	_, s := newProxyServer(t, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			http.Error(res, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := res.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+
+		// Echo lines until the client hangs up.
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = rw.WriteString("echo " + line)
+			_ = rw.Flush()
+		}
+	}))
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: web---nick.preview.localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	for _, msg := range []string{"hello", "goodbye"} {
+		_, err = fmt.Fprintf(conn, "%s\n", msg)
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo "+msg+"\n", line)
+	}
+}
+
+func TestServeEventStream(t *testing.T) {
+	sent := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	_, s := newProxyServer(t, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(res, "data: first\n\n")
+		res.(http.Flusher).Flush()
+		close(sent)
+
+		// Keep the stream open, so the event only arrives if the proxy flushes it.
+		<-done
+	}))
+
+	req, err := http.NewRequest("GET", s.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Host = "web---nick.preview.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	<-sent
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+}
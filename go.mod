@@ -4,8 +4,11 @@ go 1.17
 
 require (
 	github.com/acarl005/stripansi v0.0.0-20180116102854-5a71ef0e047d
+	github.com/coreos/go-oidc/v3 v3.1.0
 	github.com/google/go-github/v42 v42.0.0
 	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/stretchr/testify v1.7.0
 	github.com/tilt-dev/tilt v0.23.8
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f
@@ -16,6 +19,7 @@ require (
 	k8s.io/client-go v0.23.2
 	k8s.io/kubectl v0.23.2
 	sigs.k8s.io/controller-runtime v0.11.0
+	sigs.k8s.io/gateway-api v0.4.1
 )
 
 require (
@@ -51,8 +55,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.11.0 // indirect
-	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.28.0 // indirect
 	github.com/prometheus/procfs v0.6.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
@@ -70,6 +72,7 @@ require (
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
+	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 	k8s.io/apiextensions-apiserver v0.23.0 // indirect
 	k8s.io/apiserver v0.23.0 // indirect
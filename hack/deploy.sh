@@ -7,6 +7,15 @@ set -euxo pipefail
 TODAY=$(date +"%Y-%m-%d")
 SECONDS=$(date +"%s")
 TAG="$TODAY-$SECONDS"
+# Shared between the gateway Ingress and ephdash, so that ephdash can trust
+# the oauth2-proxy's identity headers. The two charts are upgraded one after
+# the other, so reuse the secret that ephdash already has, and only generate
+# one on the first deploy. To rotate it, delete the ephproxy Secret first.
+PROXY_SECRET=$(kubectl get secret ephproxy --namespace=ephemerator \
+                       --ignore-not-found -o jsonpath='{.data.secret}' | base64 -d)
+if [[ -z "$PROXY_SECRET" ]]; then
+    PROXY_SECRET=$(head -c 32 /dev/urandom | base64 | tr -dc 'a-zA-Z0-9')
+fi
 REPO="gcr.io/windmill-prod"
 
 docker_build() {
@@ -38,6 +47,7 @@ helm upgrade --install ephctrl ./chart --namespace=ephemerator \
      --set=tiltUpperImage.repository="$REPO/ephctrl-tilt-upper" \
      --set=tiltUpperImage.tag="$TAG" \
      --set=auth.enabled=true \
+     --set=auth.proxySecret="$PROXY_SECRET" \
      --set=gateway.scheme=https \
      --set=gateway.host=preview.tilt.build \
      --set=gateway.tlsSecretName=preview-tilt-build \
@@ -54,5 +64,6 @@ helm upgrade --install ephdash ./chart --namespace=ephemerator \
      --values=../.secrets/values-prod.yaml \
      --set=image.repository="$REPO/ephdash" \
      --set=image.tag="$TAG" \
-     --set=auth.proxy=http://oauth2-proxy:4180
+     --set=auth.proxy=http://oauth2-proxy:4180 \
+     --set=auth.proxySecret="$PROXY_SECRET"
 popd
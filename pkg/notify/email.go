@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Emails events to a fixed list of recipients over SMTP.
+type EmailNotifier struct {
+	addr string
+	host string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+// Sends through the SMTP server at addr (host:port). Authenticates
+// with PLAIN auth if a username is given.
+func NewEmailNotifier(addr, from string, to []string, username, password string) (*EmailNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMTP address %q: %v", addr, err)
+	}
+
+	recipients := []string{}
+	for _, r := range to {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("No email recipients")
+	}
+
+	n := &EmailNotifier{addr: addr, host: host, from: from, to: recipients}
+	if username != "" {
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n, nil
+}
+
+func (n *EmailNotifier) message(e Event) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "From: %s\r\n", n.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[ephemerator] "+e.Summary()))
+	fmt.Fprintf(buf, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "\r\n")
+
+	fmt.Fprintf(buf, "%s\r\n", e.Summary())
+	for _, d := range e.Details() {
+		fmt.Fprintf(buf, "%s\r\n", d)
+	}
+	if len(e.Links) > 0 {
+		fmt.Fprintf(buf, "\r\n")
+		for _, link := range e.Links {
+			fmt.Fprintf(buf, "%s: %s\r\n", link.Name, link.URL)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Does what smtp.SendMail does, but gives up when the context is done.
+func (n *EmailNotifier) Notify(ctx context.Context, e Event) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// net/smtp doesn't take a context, so close the connection
+	// to interrupt a slow server.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	err = n.send(conn, n.message(e))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (n *EmailNotifier) send(conn net.Conn, msg []byte) error {
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: n.host})
+		if err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't support AUTH", n.addr)
+		}
+		err = c.Auth(n.auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(n.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,233 @@
+// Package notify tells people about env lifecycle events, like an env
+// becoming ready or about to expire.
+//
+// Both ephdash (for user actions) and ephctrl (for controller decisions)
+// send notifications through a Dispatcher, which delivers them
+// asynchronously to each configured Notifier.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+type EventType string
+
+const (
+	EventCreated  EventType = "created"
+	EventUpdated  EventType = "updated"
+	EventDeleted  EventType = "deleted"
+	EventReady    EventType = "ready"
+	EventFailed   EventType = "failed"
+	EventExpiring EventType = "expiring"
+)
+
+// Annotations on the env ConfigMap that record which controller
+// notifications we've already sent, so that we send each one once.
+const (
+	// The UID of the pod we sent a ready notification for.
+	AnnotationNotifiedReady = "ephemerator.tilt.dev/notified-ready"
+
+	// The UID of the pod we sent a failure notification for.
+	AnnotationNotifiedFailed = "ephemerator.tilt.dev/notified-failed"
+
+	// The expiration we sent an expiring notification for.
+	AnnotationNotifiedExpiring = "ephemerator.tilt.dev/notified-expiring"
+)
+
+type Link struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type Event struct {
+	Type EventType `json:"type"`
+	Env  string    `json:"env"`
+	Time time.Time `json:"time"`
+
+	Spec *ephconfig.EnvSpec `json:"spec,omitempty"`
+
+	// Details, e.g., why the env failed.
+	Message string `json:"message,omitempty"`
+
+	Expiration *time.Time `json:"expiration,omitempty"`
+
+	// Links to the dashboard and the env endpoints.
+	Links []Link `json:"links,omitempty"`
+}
+
+// A one-line summary of the event.
+func (e Event) Summary() string {
+	switch e.Type {
+	case EventCreated:
+		return fmt.Sprintf("Env %s created", e.Env)
+	case EventUpdated:
+		return fmt.Sprintf("Env %s updated", e.Env)
+	case EventDeleted:
+		return fmt.Sprintf("Env %s deleted", e.Env)
+	case EventReady:
+		return fmt.Sprintf("Env %s is ready", e.Env)
+	case EventFailed:
+		return fmt.Sprintf("Env %s failed", e.Env)
+	case EventExpiring:
+		if e.Expiration != nil {
+			return fmt.Sprintf("Env %s expires in %s", e.Env, e.Expiration.Sub(e.Time).Round(time.Minute))
+		}
+		return fmt.Sprintf("Env %s expires soon", e.Env)
+	}
+	return fmt.Sprintf("Env %s: %s", e.Env, e.Type)
+}
+
+// Details of the event, one per line, not including links.
+func (e Event) Details() []string {
+	var result []string
+	if e.Spec != nil {
+		result = append(result, fmt.Sprintf("Repo: %s, branch: %s, path: %s", e.Spec.Repo, e.Spec.Branch, e.Spec.Path))
+	}
+	if e.Message != "" {
+		result = append(result, e.Message)
+	}
+	if e.Expiration != nil {
+		result = append(result, fmt.Sprintf("Expires at %s", e.Expiration.UTC().Format(time.RFC3339)))
+	}
+	return result
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// The number of undelivered events we queue for each notifier
+// before dropping new ones.
+const queueSize = 100
+
+type sink struct {
+	notifier Notifier
+	queue    chan Event
+}
+
+// Delivers events to each notifier asynchronously, retrying failures.
+//
+// Each notifier gets its own queue, so a slow notifier doesn't
+// hold up the others. A nil Dispatcher drops all events.
+type Dispatcher struct {
+	sinks    []*sink
+	attempts int
+	backoff  time.Duration
+}
+
+func NewDispatcher(notifiers ...Notifier) *Dispatcher {
+	d := &Dispatcher{attempts: 4, backoff: time.Second}
+	for _, n := range notifiers {
+		d.sinks = append(d.sinks, &sink{notifier: n, queue: make(chan Event, queueSize)})
+	}
+	return d
+}
+
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.sinks) > 0
+}
+
+// Queue an event for delivery. Never blocks.
+func (d *Dispatcher) Notify(e Event) {
+	if !d.Enabled() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range d.sinks {
+		select {
+		case s.queue <- e:
+		default:
+			log.Printf("error: notification queue full for %T, dropping %s event for env %s", s.notifier, e.Type, e.Env)
+		}
+	}
+}
+
+// Deliver events until the context is canceled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if !d.Enabled() {
+		<-ctx.Done()
+		return
+	}
+
+	done := make(chan struct{})
+	for _, s := range d.sinks {
+		go func(s *sink) {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e := <-s.queue:
+					d.deliver(ctx, s.notifier, e)
+				}
+			}
+		}(s)
+	}
+	for range d.sinks {
+		<-done
+	}
+}
+
+// Deliver an event, retrying with exponential backoff.
+func (d *Dispatcher) deliver(ctx context.Context, n Notifier, e Event) {
+	backoff := d.backoff
+	var err error
+	for i := 0; i < d.attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = n.Notify(attemptCtx, e)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("error: delivering %s event for env %s with %T: %v", e.Type, e.Env, n, err)
+}
+
+// Read the notifiers configured in the environment.
+func ReadNotifiers() ([]Notifier, error) {
+	var result []Notifier
+	if url := os.Getenv("EPH_SLACK_WEBHOOK"); url != "" {
+		result = append(result, NewSlackNotifier(url))
+	}
+
+	if url := os.Getenv("EPH_WEBHOOK_URL"); url != "" {
+		secret := os.Getenv("EPH_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("Missing env var EPH_WEBHOOK_SECRET, required by EPH_WEBHOOK_URL")
+		}
+		result = append(result, NewWebhookNotifier(url, secret))
+	}
+
+	if addr := os.Getenv("EPH_SMTP_ADDR"); addr != "" {
+		from := os.Getenv("EPH_SMTP_FROM")
+		to := os.Getenv("EPH_SMTP_TO")
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("Missing env var EPH_SMTP_FROM or EPH_SMTP_TO, required by EPH_SMTP_ADDR")
+		}
+		n, err := NewEmailNotifier(addr, from, strings.Split(to, ","),
+			os.Getenv("EPH_SMTP_USERNAME"), os.Getenv("EPH_SMTP_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
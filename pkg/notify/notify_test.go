@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilt-dev/ephemerator/ephconfig"
+)
+
+type fakeNotifier struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	events   chan Event
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, e Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	if n.calls <= n.failures {
+		return fmt.Errorf("failure %d", n.calls)
+	}
+	n.events <- e
+	return nil
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	flaky := &fakeNotifier{failures: 2, events: make(chan Event, 1)}
+	ok := &fakeNotifier{events: make(chan Event, 1)}
+	d := NewDispatcher(flaky, ok)
+	d.backoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Notify(Event{Type: EventReady, Env: "alice"})
+
+	for _, n := range []*fakeNotifier{ok, flaky} {
+		select {
+		case e := <-n.events:
+			assert.Equal(t, "alice", e.Env)
+			assert.False(t, e.Time.IsZero())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for notification")
+		}
+	}
+	assert.Equal(t, 3, flaky.calls)
+}
+
+func TestNilDispatcher(t *testing.T) {
+	var d *Dispatcher
+	assert.False(t, d.Enabled())
+	d.Notify(Event{Type: EventReady, Env: "alice"})
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	n := NewWebhookNotifier(server.URL, "s3cret")
+	err := n.Notify(context.Background(), Event{Type: EventFailed, Env: "alice", Message: "CrashLoopBackOff"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "failed", header.Get(HeaderEvent))
+	assert.Equal(t, Sign([]byte("s3cret"), body), header.Get(HeaderSignature))
+	assert.NotEqual(t, Sign([]byte("wrong"), body), header.Get(HeaderSignature))
+
+	var e Event
+	require.NoError(t, json.Unmarshal(body, &e))
+	assert.Equal(t, "CrashLoopBackOff", e.Message)
+}
+
+func TestWebhookErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL, "s3cret").Notify(context.Background(), Event{Type: EventReady, Env: "alice"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "502")
+}
+
+func TestSlackMessage(t *testing.T) {
+	msg := slackMessageFor(Event{
+		Type:  EventCreated,
+		Env:   "alice",
+		Spec:  &ephconfig.EnvSpec{Repo: "https://github.com/tilt-dev/tilt", Branch: "a<b", Path: "Tiltfile"},
+		Links: []Link{{Name: "Dashboard", URL: "http://preview.localhost/"}},
+	})
+
+	assert.Equal(t, "Env alice created", msg.Text)
+	require.Len(t, msg.Blocks, 2)
+	assert.Equal(t, "*Env alice created*\nRepo: https://github.com/tilt-dev/tilt, branch: a&lt;b, path: Tiltfile", msg.Blocks[0].Text.Text)
+	assert.Equal(t, "http://preview.localhost/", msg.Blocks[1].Elements[0].URL)
+}
+
+func TestEmailMessage(t *testing.T) {
+	n, err := NewEmailNotifier("smtp.example.com:587", "eph@example.com", []string{"a@example.com", " b@example.com"}, "", "")
+	require.NoError(t, err)
+
+	expiration := time.Date(2022, 3, 1, 12, 5, 0, 0, time.UTC)
+	msg := string(n.message(Event{
+		Type:       EventExpiring,
+		Env:        "alice",
+		Time:       time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+		Expiration: &expiration,
+		Links:      []Link{{Name: "Dashboard", URL: "http://preview.localhost/"}},
+	}))
+
+	assert.Contains(t, msg, "To: a@example.com, b@example.com\r\n")
+	assert.Contains(t, msg, "Subject: [ephemerator] Env alice expires in 5m0s\r\n")
+	assert.True(t, strings.HasSuffix(msg, "Expires at 2022-03-01T12:05:00Z\r\n\r\nDashboard: http://preview.localhost/\r\n"))
+
+	_, err = NewEmailNotifier("smtp.example.com:587", "eph@example.com", []string{""}, "", "")
+	assert.Error(t, err)
+}
+
+// A minimal SMTP server that accepts every message.
+//
+// Sends each message body on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		_ = tc.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "MAIL"), strings.HasPrefix(line, "RCPT"):
+				_ = tc.PrintfLine("250 OK")
+			case line == "DATA":
+				_ = tc.PrintfLine("354 Go ahead")
+				body, err := tc.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- string(body)
+				_ = tc.PrintfLine("250 OK")
+			case line == "QUIT":
+				_ = tc.PrintfLine("221 Bye")
+				return
+			default:
+				_ = tc.PrintfLine("502 Unknown command")
+			}
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func TestEmailSend(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+	n, err := NewEmailNotifier(addr, "eph@example.com", []string{"a@example.com"}, "", "")
+	require.NoError(t, err)
+
+	err = n.Notify(context.Background(), Event{Type: EventReady, Env: "alice", Time: time.Now()})
+	require.NoError(t, err)
+	assert.Contains(t, <-messages, "Subject: [ephemerator] Env alice is ready\n")
+}
+
+func TestEmailHonorsContext(t *testing.T) {
+	// A server that accepts connections, but never says anything.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	n, err := NewEmailNotifier(l.Addr().String(), "eph@example.com", []string{"a@example.com"}, "", "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = n.Notify(ctx, Event{Type: EventReady, Env: "alice", Time: time.Now()})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Posts events to a Slack incoming webhook, with a button for each link.
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewSlackNotifier(url string) *SlackNotifier {
+	return &SlackNotifier{url: url, client: http.DefaultClient}
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackElement struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+	URL  string     `json:"url,omitempty"`
+}
+
+type slackBlock struct {
+	Type     string         `json:"type"`
+	Text     *slackText     `json:"text,omitempty"`
+	Elements []slackElement `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	// Fallback for notifications that can't show blocks.
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+// Slack only allows so many buttons in a block.
+const maxSlackButtons = 25
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackMessageFor(e Event) slackMessage {
+	lines := []string{fmt.Sprintf("*%s*", slackEscaper.Replace(e.Summary()))}
+	for _, d := range e.Details() {
+		lines = append(lines, slackEscaper.Replace(d))
+	}
+
+	msg := slackMessage{
+		Text: e.Summary(),
+		Blocks: []slackBlock{
+			{Type: "section", Text: &slackText{Type: "mrkdwn", Text: strings.Join(lines, "\n")}},
+		},
+	}
+
+	var buttons []slackElement
+	for _, link := range e.Links {
+		if len(buttons) == maxSlackButtons {
+			break
+		}
+		buttons = append(buttons, slackElement{
+			Type: "button",
+			Text: &slackText{Type: "plain_text", Text: link.Name},
+			URL:  link.URL,
+		})
+	}
+	if len(buttons) > 0 {
+		msg.Blocks = append(msg.Blocks, slackBlock{Type: "actions", Elements: buttons})
+	}
+	return msg
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, e Event) error {
+	content, err := json.Marshal(slackMessageFor(e))
+	if err != nil {
+		return err
+	}
+	return post(ctx, n.client, n.url, content, nil)
+}
+
+// Post a JSON body, and fail on any non-2xx response.
+func post(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
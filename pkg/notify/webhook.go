@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// Headers on webhook requests.
+const (
+	HeaderEvent     = "X-Ephemerator-Event"
+	HeaderSignature = "X-Ephemerator-Signature"
+)
+
+// Posts events as JSON to a URL.
+//
+// Each request is signed with the shared secret, so the receiver can
+// check it came from us. The signature is "sha256=" followed by the
+// hex HMAC-SHA256 of the body, in the X-Ephemerator-Signature header.
+type WebhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookNotifier(url, secret string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, secret: []byte(secret), client: http.DefaultClient}
+}
+
+// The signature of a webhook body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, e Event) error {
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return post(ctx, n.client, n.url, content, map[string]string{
+		HeaderEvent:     string(e.Type),
+		HeaderSignature: Sign(n.secret, content),
+	})
+}